@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"distributed-db/config"
+	"distributed-db/db"
+
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// snapshotPath returns the path of the snapshot of the named shard in dir,
+// e.g. "New York" is stored in dir/new_york.db.
+func snapshotPath(dir, shard string) string {
+	return filepath.Join(dir, strings.ToLower(strings.ReplaceAll(shard, " ", "_"))+".db")
+}
+
+// runBackup pulls a snapshot from the main server of every shard in the
+// config file into a directory.
+func runBackup(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	configFile := fs.String("configFile", "", "Config file for static sharding")
+	dir := fs.String("dir", "", "Directory to write the snapshots to")
+	fs.Parse(args)
+
+	if *configFile == "" || *dir == "" {
+		log.Fatalf("backup needs the -configFile and -dir flags")
+	}
+
+	c, err := config.ParseFile(*configFile)
+	if err != nil {
+		log.Fatalf("ParseFile: error parsing file %q: %v", *configFile, err)
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		log.Fatalf("MkdirAll(%q): %v", *dir, err)
+	}
+
+	failed := false
+	for _, s := range c.Shards {
+		path := snapshotPath(*dir, s.Name)
+		if err := backupShard(s.Address, path); err != nil {
+			log.Printf("Backup of shard %q (%s) failed: %v", s.Name, s.Address, err)
+			failed = true
+			continue
+		}
+		log.Printf("Backed up shard %q (%s) to %s", s.Name, s.Address, path)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// backupShard downloads a snapshot from the server at addr to path.
+func backupShard(addr, path string) error {
+	resp, err := http.Get("http://" + addr + "/backup")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return db.RestoreSnapshot(resp.Body, path)
+}
+
+// runRestore replaces the database file of a shard with its snapshot. The
+// shard's server must be stopped.
+func runRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dir := fs.String("dir", "", "Directory containing the snapshots")
+	shard := fs.String("shard", "", "Shard name to restore")
+	dbLocation := fs.String("db-location", "", "Path to the database to restore")
+	force := fs.Bool("force", false, "Overwrite an existing database")
+	fs.Parse(args)
+
+	if *dir == "" || *shard == "" || *dbLocation == "" {
+		log.Fatalf("restore needs the -dir, -shard and -db-location flags")
+	}
+
+	if _, err := os.Stat(*dbLocation); err == nil && !*force {
+		log.Fatalf("%s already exists; use -force to overwrite it", *dbLocation)
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Fatalf("Stat(%q): %v", *dbLocation, err)
+	}
+
+	path := snapshotPath(*dir, *shard)
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Could not open the snapshot of shard %q: %v", *shard, err)
+	}
+	defer f.Close()
+
+	if err := db.RestoreSnapshot(f, *dbLocation); err != nil {
+		log.Fatalf("RestoreSnapshot(%q, %q): %v", path, *dbLocation, err)
+	}
+	log.Printf("Restored shard %q from %s to %s", *shard, path, *dbLocation)
+}
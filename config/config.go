@@ -3,29 +3,77 @@ package config
 import (
 	"fmt"
 	"hash/fnv"
+	"io"
+	"reflect"
+	"sort"
 
 	"github.com/BurntSushi/toml"
 )
 
 // Shard represents a shard that holds a subset of the data.
-// Each shard has a unique set of keys
+// Each shard has a unique set of keys. Replicas are the addresses of the
+// read-only replicas of the shard. Replication selects how writes reach
+// the replicas: "async" (the default) streams them from the primary after
+// they were applied and "raft" only applies writes once a majority of the
+// primary and the replicas stored them. Weight is the share of the keys
+// that the shard owns relative to the other shards with consistent
+// hashing; it defaults to 1. Start is the first key of the range of keys
+// that the shard owns with range partitioning.
 type Shard struct {
-	Name    string
-	ShardID int
-	Address string
+	Name        string   `toml:"name"`
+	ShardID     int      `toml:"shardID"`
+	Address     string   `toml:"address"`
+	Replicas    []string `toml:"replicas,omitempty"`
+	Replication string   `toml:"replication,omitempty"`
+	Weight      int      `toml:"weight,omitzero"`
+	Start       string   `toml:"start,omitempty"`
 }
 
-// Config represents the sharding configuration of the system.
+// Replication modes of a shard.
+const (
+	ReplicationAsync = "async"
+	ReplicationRaft  = "raft"
+)
+
+// Hashing schemes that assign keys to shards. Modulo hashing takes the
+// hash of the key modulo the number of shards, so changing the number of
+// shards moves almost all keys. Consistent hashing places the shards on a
+// Ring and only moves about 1/N of the keys when a shard is added. Range
+// partitioning does not hash keys but assigns contiguous Ranges of keys
+// to the shards.
+const (
+	HashingModulo     = "modulo"
+	HashingConsistent = "consistent"
+	HashingRange      = "range"
+)
+
+// Config represents the sharding configuration of the system. Hashing is
+// the scheme that assigns keys to shards, modulo hashing by default.
+// VirtualNodes is the number of points of a shard of weight 1 on the ring
+// with consistent hashing.
 type Config struct {
-	Shards []Shard
+	Hashing      string  `toml:"hashing,omitempty"`
+	VirtualNodes int     `toml:"virtualNodes,omitzero"`
+	Shards       []Shard `toml:"shards"`
 }
 
 // Shards is a representation of the sharding config: the shard count, the
-// ID of the current shard, and the addresses of other shards
+// ID of the current shard, the addresses of other shards, the addresses
+// of the replicas of shards that have any and the shards that use Raft
+// replication. Ring is the consistent-hash ring of the shards, or nil
+// without consistent hashing, and Ranges the ranges of keys of the shards,
+// or nil without range partitioning. Epoch is the version of the routing
+// table on a server; it increases whenever the server switches to a new
+// config.
 type Shards struct {
-	Count int
-	CurID int
-	Addrs map[int]string
+	Count    int
+	CurID    int
+	Addrs    map[int]string
+	Replicas map[int][]string
+	Raft     map[int]bool
+	Ring     *Ring
+	Ranges   *Ranges
+	Epoch    uint64
 }
 
 // ParseFile parses the config file and returns a Config struct upon success.
@@ -38,6 +86,15 @@ func ParseFile(configFile string) (Config, error) {
 	return c, nil
 }
 
+// Decode parses a config in the format of the config file.
+func Decode(r io.Reader) (Config, error) {
+	var c Config
+	if _, err := toml.NewDecoder(r).Decode(&c); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
 // ParseShards converts and verifies the list of shards specified
 // in the config file into a Shards struct, which can be used for routing
 // by the server.
@@ -45,12 +102,35 @@ func ParseShards(shards []Shard, curShard string) (*Shards, error) {
 	shardCount := len(shards)
 	shardIdx := -1
 	addrs := make(map[int]string)
+	replicas := make(map[int][]string)
+	raft := make(map[int]bool)
+	seen := make(map[string]bool)
 
 	for _, s := range shards {
 		if _, ok := addrs[s.ShardID]; ok {
 			return nil, fmt.Errorf("duplicate shard ID %d", s.ShardID)
 		}
 		addrs[s.ShardID] = s.Address
+
+		for _, addr := range append([]string{s.Address}, s.Replicas...) {
+			if seen[addr] {
+				return nil, fmt.Errorf("address %q is used by more than one server", addr)
+			}
+			seen[addr] = true
+		}
+		if len(s.Replicas) > 0 {
+			replicas[s.ShardID] = s.Replicas
+		}
+		switch s.Replication {
+		case "", ReplicationAsync:
+		case ReplicationRaft:
+			raft[s.ShardID] = true
+		default:
+			return nil, fmt.Errorf("shard %d: unknown replication mode %q", s.ShardID, s.Replication)
+		}
+		if s.Weight < 0 {
+			return nil, fmt.Errorf("shard %d: negative weight %d", s.ShardID, s.Weight)
+		}
 		if s.Name == curShard {
 			shardIdx = s.ShardID
 		}
@@ -67,15 +147,129 @@ func ParseShards(shards []Shard, curShard string) (*Shards, error) {
 	}
 
 	return &Shards{
-		Count: shardCount,
-		CurID: shardIdx,
-		Addrs: addrs,
+		Count:    shardCount,
+		CurID:    shardIdx,
+		Addrs:    addrs,
+		Replicas: replicas,
+		Raft:     raft,
 	}, nil
 }
 
+// ParseConfig is like ParseShards and also sets up the hashing scheme
+// selected in the config.
+func ParseConfig(c Config, curShard string) (*Shards, error) {
+	shards, err := ParseShards(c.Shards, curShard)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c.Hashing {
+	case "", HashingModulo:
+	case HashingConsistent:
+		vnodes := c.VirtualNodes
+		if vnodes == 0 {
+			vnodes = DefaultVirtualNodes
+		}
+		if vnodes < 0 {
+			return nil, fmt.Errorf("negative number of virtual nodes %d", vnodes)
+		}
+
+		weights := make(map[int]int, len(c.Shards))
+		for _, s := range c.Shards {
+			weights[s.ShardID] = s.Weight
+			if s.Weight == 0 {
+				weights[s.ShardID] = 1
+			}
+		}
+		shards.Ring = NewRing(weights, vnodes)
+	case HashingRange:
+		if shards.Ranges, err = configRanges(c); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown hashing scheme %q", c.Hashing)
+	}
+
+	if c.Hashing != HashingRange {
+		for _, s := range c.Shards {
+			if s.Start != "" {
+				return nil, fmt.Errorf("shard %d: start is only used with range partitioning", s.ShardID)
+			}
+		}
+	}
+	return shards, nil
+}
+
 // Id returns the shard ID for the given key.
 func (s *Shards) Id(key string) int {
+	if s.Ring != nil {
+		return s.Ring.Id(key)
+	}
+	if s.Ranges != nil {
+		return s.Ranges.Id(key)
+	}
+
 	h := fnv.New64a()
 	h.Write([]byte(key))
 	return int(h.Sum64() % uint64(s.Count))
 }
+
+// Overlapping returns the IDs of the shards that may own keys from start
+// up to end, in ascending order of their keys with range partitioning and
+// of their IDs otherwise. An empty end does not limit the keys.
+func (s *Shards) Overlapping(start, end string) []int {
+	if s.Ranges != nil {
+		return s.Ranges.Overlapping(start, end)
+	}
+	ids := make([]int, 0, len(s.Addrs))
+	for id := range s.Addrs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// SameOwners reports whether s and o assign every key to the same shard.
+func (s *Shards) SameOwners(o *Shards) bool {
+	return s.Count == o.Count && reflect.DeepEqual(s.Ring, o.Ring) && reflect.DeepEqual(s.Ranges, o.Ranges)
+}
+
+// WithPrimary returns a copy of s in which the replica at addr is the
+// primary of the given shard. The previous primary takes its place among
+// the replicas, since it can only rejoin the shard as a replica.
+func (s *Shards) WithPrimary(shard int, addr string) *Shards {
+	res := &Shards{
+		Count:    s.Count,
+		CurID:    s.CurID,
+		Addrs:    make(map[int]string, len(s.Addrs)),
+		Replicas: make(map[int][]string, len(s.Replicas)),
+		Raft:     s.Raft,
+		Ring:     s.Ring,
+		Ranges:   s.Ranges,
+		Epoch:    s.Epoch,
+	}
+	for id, a := range s.Addrs {
+		res.Addrs[id] = a
+	}
+	for id, replicas := range s.Replicas {
+		res.Replicas[id] = replicas
+	}
+
+	old := s.Addrs[shard]
+	if old == addr {
+		return res
+	}
+	res.Addrs[shard] = addr
+
+	replicas := make([]string, 0, len(s.Replicas[shard])+1)
+	for _, r := range s.Replicas[shard] {
+		if r != addr {
+			replicas = append(replicas, r)
+		}
+	}
+	if old != "" {
+		replicas = append(replicas, old)
+	}
+	res.Replicas[shard] = replicas
+	return res
+}
@@ -1,10 +1,16 @@
 package config_test
 
 import (
+	"context"
 	"distributed-db/config"
+	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"reflect"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func createConfig(t *testing.T, contents string) config.Config {
@@ -75,6 +81,8 @@ func TestParseShards(t *testing.T) {
 			0: "localhost:8080",
 			1: "localhost:8081",
 		},
+		Replicas: map[int][]string{},
+		Raft:     map[int]bool{},
 	}
 
 	if !reflect.DeepEqual(shards, want) {
@@ -82,3 +90,339 @@ func TestParseShards(t *testing.T) {
 	}
 
 }
+
+func TestParseShardsReplicas(t *testing.T) {
+	c := createConfig(t, `[[shards]]
+	name = "shard1"
+	shardID = 0
+	address = "localhost:8080"
+	replicas = ["localhost:8081", "localhost:8082"]
+	[[shards]]
+	name = "shard2"
+	shardID = 1
+	address = "localhost:8083"`)
+
+	shards, err := config.ParseShards(c.Shards, "shard1")
+	if err != nil {
+		t.Fatalf("ParseShards: %v", err)
+	}
+
+	want := map[int][]string{0: {"localhost:8081", "localhost:8082"}}
+	if !reflect.DeepEqual(shards.Replicas, want) {
+		t.Errorf("Mismatch replicas: got %#v, want %#v", shards.Replicas, want)
+	}
+
+	c.Shards[1].Replicas = []string{"localhost:8082"}
+	if _, err := config.ParseShards(c.Shards, "shard1"); err == nil {
+		t.Errorf("ParseShards with a shared replica address: got nil error, want non-nil error")
+	}
+}
+
+func TestParseShardsReplication(t *testing.T) {
+	c := createConfig(t, `[[shards]]
+	name = "shard1"
+	shardID = 0
+	address = "localhost:8080"
+	replicas = ["localhost:8081", "localhost:8082"]
+	replication = "raft"
+	[[shards]]
+	name = "shard2"
+	shardID = 1
+	address = "localhost:8083"
+	replication = "async"`)
+
+	shards, err := config.ParseShards(c.Shards, "shard1")
+	if err != nil {
+		t.Fatalf("ParseShards: %v", err)
+	}
+	if want := map[int]bool{0: true}; !reflect.DeepEqual(shards.Raft, want) {
+		t.Errorf("Mismatch raft shards: got %#v, want %#v", shards.Raft, want)
+	}
+
+	c.Shards[1].Replication = "paxos"
+	if _, err := config.ParseShards(c.Shards, "shard1"); err == nil {
+		t.Errorf("ParseShards with an unknown replication mode: got nil error, want non-nil error")
+	}
+}
+
+func TestWithPrimary(t *testing.T) {
+	shards := &config.Shards{
+		Count:    2,
+		CurID:    1,
+		Addrs:    map[int]string{0: "a:1", 1: "b:1"},
+		Replicas: map[int][]string{0: {"a:2", "a:3"}},
+	}
+
+	got := shards.WithPrimary(0, "a:3")
+	want := &config.Shards{
+		Count:    2,
+		CurID:    1,
+		Addrs:    map[int]string{0: "a:3", 1: "b:1"},
+		Replicas: map[int][]string{0: {"a:2", "a:1"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("WithPrimary(0, a:3) = %#v, want %#v", got, want)
+	}
+
+	// The original routing table is not modified.
+	if shards.Addrs[0] != "a:1" || !reflect.DeepEqual(shards.Replicas[0], []string{"a:2", "a:3"}) {
+		t.Errorf("WithPrimary modified the original shards: %#v", shards)
+	}
+}
+
+// shardConfig returns a config with n shards using the given hashing
+// scheme.
+func shardConfig(n int, hashing string) config.Config {
+	c := config.Config{Hashing: hashing}
+	for i := 0; i < n; i++ {
+		c.Shards = append(c.Shards, config.Shard{
+			Name:    fmt.Sprint("shard", i),
+			ShardID: i,
+			Address: fmt.Sprintf("localhost:%d", 8080+i),
+		})
+	}
+	return c
+}
+
+func TestParseConfigHashing(t *testing.T) {
+	shards, err := config.ParseConfig(shardConfig(2, ""), "shard0")
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	if shards.Ring != nil {
+		t.Errorf("ParseConfig without a hashing scheme: got a ring, want modulo hashing")
+	}
+
+	if _, err := config.ParseConfig(shardConfig(2, "rendezvous"), "shard0"); err == nil {
+		t.Errorf("ParseConfig with an unknown hashing scheme: got nil error, want non-nil error")
+	}
+}
+
+func TestConsistentHashing(t *testing.T) {
+	const keys = 10000
+	owners := func(c config.Config) []int {
+		t.Helper()
+		shards, err := config.ParseConfig(c, "shard0")
+		if err != nil {
+			t.Fatalf("ParseConfig: %v", err)
+		}
+		res := make([]int, keys)
+		for i := range res {
+			res[i] = shards.Id(fmt.Sprint("key", i))
+		}
+		return res
+	}
+	counts := func(owners []int) map[int]int {
+		res := make(map[int]int)
+		for _, id := range owners {
+			res[id]++
+		}
+		return res
+	}
+
+	before := owners(shardConfig(4, config.HashingConsistent))
+	for id, n := range counts(before) {
+		if n < keys/8 || n > keys*3/8 {
+			t.Errorf("Shard %d owns %d of %d keys, want about a quarter", id, n, keys)
+		}
+	}
+
+	// Adding a shard only moves keys to the new shard.
+	after := owners(shardConfig(5, config.HashingConsistent))
+	moved := 0
+	for i := range before {
+		if before[i] == after[i] {
+			continue
+		}
+		moved++
+		if after[i] != 4 {
+			t.Fatalf("Key %d moved from shard %d to shard %d, want shard 4", i, before[i], after[i])
+		}
+	}
+	if moved < keys/10 || moved > keys*3/10 {
+		t.Errorf("Adding a fifth shard moved %d of %d keys, want about a fifth", moved, keys)
+	}
+
+	// A shard with weight 3 owns about half of the keys of 4 shards.
+	c := shardConfig(4, config.HashingConsistent)
+	c.Shards[0].Weight = 3
+	if n := counts(owners(c))[0]; n < keys*4/10 || n > keys*6/10 {
+		t.Errorf("Shard 0 with weight 3 owns %d of %d keys, want about a half", n, keys)
+	}
+}
+
+func TestSameOwners(t *testing.T) {
+	parse := func(c config.Config) *config.Shards {
+		t.Helper()
+		shards, err := config.ParseConfig(c, "shard0")
+		if err != nil {
+			t.Fatalf("ParseConfig: %v", err)
+		}
+		return shards
+	}
+	base := parse(shardConfig(2, config.HashingConsistent))
+
+	moved := shardConfig(2, config.HashingConsistent)
+	moved.Shards[1].Address = "localhost:9090"
+	moved.Shards[1].Replicas = []string{"localhost:9091"}
+	if !base.SameOwners(parse(moved)) {
+		t.Errorf("SameOwners with new addresses: got false, want true")
+	}
+
+	weighted := shardConfig(2, config.HashingConsistent)
+	weighted.Shards[1].Weight = 2
+	vnodes := shardConfig(2, config.HashingConsistent)
+	vnodes.VirtualNodes = 16
+	for name, c := range map[string]config.Config{
+		"more shards":   shardConfig(3, config.HashingConsistent),
+		"modulo":        shardConfig(2, ""),
+		"weights":       weighted,
+		"virtual nodes": vnodes,
+		"ranges":        rangeConfig("", "m"),
+	} {
+		if base.SameOwners(parse(c)) {
+			t.Errorf("SameOwners with other %s: got true, want false", name)
+		}
+	}
+	if parse(rangeConfig("", "m")).SameOwners(parse(rangeConfig("", "n"))) {
+		t.Errorf("SameOwners with other starts: got true, want false")
+	}
+}
+
+// rangeConfig returns a config with range partitioning in which shard i
+// starts at starts[i].
+func rangeConfig(starts ...string) config.Config {
+	c := shardConfig(len(starts), config.HashingRange)
+	for i, start := range starts {
+		c.Shards[i].Start = start
+	}
+	return c
+}
+
+func TestRangePartitioning(t *testing.T) {
+	shards, err := config.ParseConfig(rangeConfig("", "m", "f"), "shard0")
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+
+	for key, want := range map[string]int{"": 0, "apple": 0, "f": 2, "fig": 2, "lemon": 2, "m": 1, "mango": 1, "zebra": 1} {
+		if got := shards.Id(key); got != want {
+			t.Errorf("Id(%q): got %d, want %d", key, got, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		start, end string
+		want       []int
+	}{
+		{"a", "b", []int{0}},
+		{"fig", "fih", []int{2}},
+		{"e", "n", []int{0, 2, 1}},
+		{"g", "", []int{2, 1}},
+		{"", "f", []int{0}},
+	} {
+		if got := shards.Overlapping(tc.start, tc.end); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Overlapping(%q, %q): got %v, want %v", tc.start, tc.end, got, tc.want)
+		}
+	}
+
+	for _, c := range []config.Config{rangeConfig("a", "m"), rangeConfig("", "m", "m")} {
+		if _, err := config.ParseConfig(c, "shard0"); err == nil {
+			t.Errorf("ParseConfig(%+v): got nil error, want non-nil error", c.Shards)
+		}
+	}
+	c := shardConfig(2, "")
+	c.Shards[1].Start = "m"
+	if _, err := config.ParseConfig(c, "shard0"); err == nil {
+		t.Errorf("ParseConfig with a start but modulo hashing: got nil error, want non-nil error")
+	}
+}
+
+func TestSplitMergeRange(t *testing.T) {
+	c := rangeConfig("", "m")
+	split, err := config.SplitRange(c, 0, "f", config.Shard{Name: "new", Address: "localhost:9000"})
+	if err != nil {
+		t.Fatalf("SplitRange: %v", err)
+	}
+	if len(c.Shards) != 2 {
+		t.Errorf("SplitRange modified the config: got %d shards, want 2", len(c.Shards))
+	}
+	want := config.Shard{Name: "new", ShardID: 2, Address: "localhost:9000", Start: "f"}
+	if got := split.Shards[2]; !reflect.DeepEqual(got, want) {
+		t.Errorf("SplitRange: got new shard %+v, want %+v", got, want)
+	}
+	for _, at := range []string{"", "m", "x"} {
+		if _, err := config.SplitRange(c, 0, at, config.Shard{Name: "new"}); err == nil {
+			t.Errorf("SplitRange of shard 0 at %q: got nil error, want non-nil error", at)
+		}
+	}
+
+	// Merging shard 1 gives its range to shard 2, and shard 2 takes its
+	// ID.
+	merged, err := config.MergeRange(split, 1)
+	if err != nil {
+		t.Fatalf("MergeRange: %v", err)
+	}
+	shards, err := config.ParseConfig(merged, "new")
+	if err != nil {
+		t.Fatalf("ParseConfig of the merged config: %v", err)
+	}
+	if shards.CurID != 1 || shards.Count != 2 {
+		t.Errorf("Merged config: got shard %d of %d, want shard 1 of 2", shards.CurID, shards.Count)
+	}
+	for key, want := range map[string]int{"apple": 0, "fig": 1, "zebra": 1} {
+		if got := shards.Id(key); got != want {
+			t.Errorf("Id(%q) after merge: got %d, want %d", key, got, want)
+		}
+	}
+	if _, err := config.MergeRange(split, 0); err == nil {
+		t.Errorf("MergeRange of the first range: got nil error, want non-nil error")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sharding.toml")
+	write := func(addr string) {
+		t.Helper()
+		contents := fmt.Sprintf("[[shards]]\nname = \"shard0\"\nshardID = 0\naddress = %q\n", addr)
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("Could not write the config: %v", err)
+		}
+	}
+	write("localhost:8080")
+	loaded := createConfig(t, fmt.Sprintf("[[shards]]\nname = \"shard0\"\nshardID = 0\naddress = %q\n", "localhost:8080"))
+
+	// SIGHUP does not terminate the test while it is delivered to a
+	// channel.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloaded := make(chan config.Config, 10)
+	go config.Watch(ctx, path, loaded, func(c config.Config) { reloaded <- c })
+
+	write("localhost:9090")
+	select {
+	case c := <-reloaded:
+		if got := c.Shards[0].Address; got != "localhost:9090" {
+			t.Errorf("Reloaded config after a change: got address %q, want %q", got, "localhost:9090")
+		}
+	case <-time.After(5 * config.WatchInterval):
+		t.Fatalf("The config was not reloaded after a change")
+	}
+
+	// SIGHUP reloads the config even if it did not change.
+	deadline := time.After(5 * config.WatchInterval)
+	for done := false; !done; {
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		select {
+		case <-reloaded:
+			done = true
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("The config was not reloaded on SIGHUP")
+		}
+	}
+}
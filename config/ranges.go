@@ -0,0 +1,147 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// Ranges assigns contiguous ranges of keys to shards. Every shard owns the
+// keys from its start up to the start of the next shard, and the last
+// shard all keys after its start. Keys with a common prefix are mostly on
+// the same shard, so scans only need to ask the shards whose ranges
+// overlap the scanned range. A Ranges is not modified after it is built.
+type Ranges struct {
+	bounds []rangeBound
+}
+
+// rangeBound is the start of the range of a shard.
+type rangeBound struct {
+	start string
+	shard int
+}
+
+// NewRanges builds the ranges of shards with the given starts. One shard
+// must start at the empty key, so that every key has an owner.
+func NewRanges(starts map[int]string) (*Ranges, error) {
+	r := &Ranges{}
+	for id, start := range starts {
+		r.bounds = append(r.bounds, rangeBound{start: start, shard: id})
+	}
+	sort.Slice(r.bounds, func(i, j int) bool {
+		a, b := r.bounds[i], r.bounds[j]
+		return a.start < b.start || a.start == b.start && a.shard < b.shard
+	})
+
+	if len(r.bounds) == 0 || r.bounds[0].start != "" {
+		return nil, fmt.Errorf("no shard starts at the empty key")
+	}
+	for i := 1; i < len(r.bounds); i++ {
+		if a, b := r.bounds[i-1], r.bounds[i]; a.start == b.start {
+			return nil, fmt.Errorf("shards %d and %d both start at %q", a.shard, b.shard, a.start)
+		}
+	}
+	return r, nil
+}
+
+// index returns the index of the range that holds the key.
+func (r *Ranges) index(key string) int {
+	return sort.Search(len(r.bounds), func(i int) bool { return r.bounds[i].start > key }) - 1
+}
+
+// Id returns the shard that owns the key.
+func (r *Ranges) Id(key string) int {
+	return r.bounds[r.index(key)].shard
+}
+
+// Range returns the first key of the range of a shard and the first key
+// after it, or "" if the range is the last one. ok is false if the shard
+// has no range.
+func (r *Ranges) Range(shard int) (start, end string, ok bool) {
+	for i, b := range r.bounds {
+		if b.shard == shard {
+			if i+1 < len(r.bounds) {
+				end = r.bounds[i+1].start
+			}
+			return b.start, end, true
+		}
+	}
+	return "", "", false
+}
+
+// Overlapping returns the shards whose ranges overlap the keys from start
+// up to end, in the order of their ranges. An empty end does not limit
+// the keys.
+func (r *Ranges) Overlapping(start, end string) []int {
+	var res []int
+	for i := r.index(start); i < len(r.bounds) && (end == "" || r.bounds[i].start < end); i++ {
+		res = append(res, r.bounds[i].shard)
+	}
+	return res
+}
+
+// configRanges returns the ranges of the shards of a config with range
+// partitioning.
+func configRanges(c Config) (*Ranges, error) {
+	if c.Hashing != HashingRange {
+		return nil, fmt.Errorf("the config does not use range partitioning")
+	}
+	starts := make(map[int]string, len(c.Shards))
+	for _, s := range c.Shards {
+		starts[s.ShardID] = s.Start
+	}
+	return NewRanges(starts)
+}
+
+// SplitRange returns a copy of the config with range partitioning in which
+// the new shard s owns the keys of the range of the given shard from the
+// key at on. s gets the next free shard ID.
+func SplitRange(c Config, shard int, at string, s Shard) (Config, error) {
+	r, err := configRanges(c)
+	if err != nil {
+		return Config{}, err
+	}
+	start, end, ok := r.Range(shard)
+	if !ok {
+		return Config{}, fmt.Errorf("shard %d not found in config", shard)
+	}
+	if at <= start || end != "" && at >= end {
+		return Config{}, fmt.Errorf("key %q is not inside the range of shard %d", at, shard)
+	}
+
+	s.ShardID, s.Start = len(c.Shards), at
+	c.Shards = append(slices.Clone(c.Shards), s)
+	return c, nil
+}
+
+// MergeRange returns a copy of the config with range partitioning in which
+// the shard owning the range before that of the given shard also owns the
+// keys of the given shard, which is removed. Shard IDs are contiguous, so
+// the shard with the highest ID takes the ID of the removed shard.
+func MergeRange(c Config, shard int) (Config, error) {
+	r, err := configRanges(c)
+	if err != nil {
+		return Config{}, err
+	}
+	start, _, ok := r.Range(shard)
+	if !ok {
+		return Config{}, fmt.Errorf("shard %d not found in config", shard)
+	}
+	if start == "" {
+		return Config{}, fmt.Errorf("shard %d owns the first range and has no range before it", shard)
+	}
+
+	last := len(c.Shards) - 1
+	shards := make([]Shard, 0, last)
+	for _, s := range c.Shards {
+		switch s.ShardID {
+		case shard:
+			continue
+		case last:
+			s.ShardID = shard
+		}
+		shards = append(shards, s)
+	}
+	c.Shards = shards
+	return c, nil
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is the number of points of a shard of weight 1 on
+// the consistent-hash ring when the config does not set VirtualNodes.
+const DefaultVirtualNodes = 128
+
+// Ring is a consistent-hash ring. Every shard owns a number of points on
+// the ring proportional to its weight, and a key belongs to the shard of
+// the first point at or after the hash of the key. Adding a shard only
+// moves the keys that fall just before its points, about 1/N of all keys.
+// A Ring is not modified after it is built.
+type Ring struct {
+	points []ringPoint
+}
+
+// ringPoint is a point of a shard on the ring.
+type ringPoint struct {
+	hash  uint64
+	shard int
+}
+
+// hashKey hashes a key or a point of the ring. FNV alone clusters the
+// hashes of similar short strings, so its result is mixed with the
+// finalizer of SplitMix64.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// NewRing builds a ring on which every shard has vnodes points for each
+// unit of its weight. The points of a shard only depend on its ID, so the
+// other shards keep their points when shards are added or removed.
+func NewRing(weights map[int]int, vnodes int) *Ring {
+	r := &Ring{}
+	for id, w := range weights {
+		for i := 0; i < vnodes*w; i++ {
+			h := hashKey(strconv.Itoa(id) + "#" + strconv.Itoa(i))
+			r.points = append(r.points, ringPoint{hash: h, shard: id})
+		}
+	}
+
+	// Ties between points of different shards are broken by shard ID so
+	// that the ring does not depend on the order of the map.
+	sort.Slice(r.points, func(i, j int) bool {
+		a, b := r.points[i], r.points[j]
+		return a.hash < b.hash || a.hash == b.hash && a.shard < b.shard
+	})
+	return r
+}
+
+// Id returns the shard that owns the key.
+func (r *Ring) Id(key string) int {
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
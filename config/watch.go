@@ -0,0 +1,49 @@
+package config
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// WatchInterval is how often Watch checks whether the config file changed.
+const WatchInterval = time.Second
+
+// Watch calls reload with the config parsed from the file whenever it
+// differs from the last loaded config, starting with loaded, or when the
+// process receives SIGHUP, until ctx is done. A file that cannot be parsed
+// is logged and skipped, since it may only be partially written.
+func Watch(ctx context.Context, path string, loaded Config, reload func(Config)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	t := time.NewTicker(WatchInterval)
+	defer t.Stop()
+
+	for {
+		force := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			force = true
+		case <-t.C:
+		}
+
+		c, err := ParseFile(path)
+		if err != nil {
+			log.Printf("Watch: error parsing file %q: %v", path, err)
+			continue
+		}
+		if !force && reflect.DeepEqual(c, loaded) {
+			continue
+		}
+		loaded = c
+		reload(c)
+	}
+}
@@ -0,0 +1,320 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Snapshots are BoltDB files, whatever the storage engine of the database
+// they were taken from, so that a snapshot can be used as the -db-location
+// of a shard as is.
+
+// snapshotter is implemented by storage engines that can write a
+// consistent snapshot of themselves without copying every bucket.
+type snapshotter interface {
+	writeSnapshot(w io.Writer) (int64, error)
+}
+
+// writeSnapshot streams the BoltDB file as of a single read transaction.
+// Writers are not blocked while the snapshot is written.
+func (s *boltStorage) writeSnapshot(w io.Writer) (n int64, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// WriteSnapshot writes a consistent snapshot of the database to w as a
+// BoltDB file and returns the number of bytes written. The database stays
+// online while the snapshot is taken.
+func (d *DB) WriteSnapshot(w io.Writer) (int64, error) {
+	if s, ok := d.store.(snapshotter); ok {
+		return s.writeSnapshot(w)
+	}
+
+	// Other engines are copied bucket by bucket into a temporary BoltDB
+	// file within a single read transaction.
+	f, err := os.CreateTemp("", "jdbgo-snapshot-*.db")
+	if err != nil {
+		return 0, err
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+
+	dst, err := OpenBolt(path)
+	if err != nil {
+		return 0, err
+	}
+	err = d.store.View(func(src Tx) error {
+		return dst.Update(func(tx Tx) error {
+			return copyBuckets(src, tx)
+		})
+	})
+	if err != nil {
+		dst.Close()
+		return 0, err
+	}
+	if err := dst.Close(); err != nil {
+		return 0, err
+	}
+
+	f, err = os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+// namespaceBuckets returns the names of the buckets that hold the
+// namespaces and their keys.
+func namespaceBuckets(tx Tx) ([][]byte, error) {
+	names := [][]byte{namespacesBucket}
+	all, err := namespaces(tx)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range all {
+		names = append(names, n.data, n.ttl, n.expiry, n.history)
+	}
+	return names, nil
+}
+
+// copyBuckets copies the keys and sequences of all buckets of the database
+// from src to dst.
+func copyBuckets(src, dst Tx) error {
+	names, err := namespaceBuckets(src)
+	if err != nil {
+		return err
+	}
+	names = append(names, logBucket, replicasBucket, logPinsBucket, replicationStateBucket)
+
+	for _, name := range names {
+		if err := copyBucket(src, dst, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyBucket copies the keys and the sequence of a bucket from src to dst.
+func copyBucket(src, dst Tx, name []byte) error {
+	from := src.Bucket(name)
+	if from == nil {
+		return nil
+	}
+	to, err := dst.CreateBucketIfNotExists(name)
+	if err != nil {
+		return err
+	}
+
+	c := from.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if err := to.Put(k, v); err != nil {
+			return err
+		}
+	}
+	return to.SetSequence(from.Sequence())
+}
+
+// LoadSnapshot replaces all namespaces of the database with those of a
+// snapshot of the primary and returns the position of the primary's
+// replication log that the snapshot corresponds to. That position is
+// recorded as the last applied change, so that replication resumes right
+// after the snapshot. The snapshot is loaded in a single transaction, so
+// readers see either the old or the new data.
+// This method is only intended to be used on replicas.
+func (d *DB) LoadSnapshot(r io.Reader) (uint64, error) {
+	return d.loadSnapshot(r, nil)
+}
+
+// loadSnapshot loads a snapshot like LoadSnapshot. fn, if not nil, is
+// called with the snapshot and the transaction that loads it.
+func (d *DB) loadSnapshot(r io.Reader, fn func(src, tx Tx, seq uint64) error) (seq uint64, err error) {
+	dir, err := os.MkdirTemp("", "jdbgo-bootstrap-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapshot.db")
+	if err := RestoreSnapshot(r, path); err != nil {
+		return 0, err
+	}
+	src, err := OpenBolt(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	err = src.View(func(stx Tx) error {
+		log := stx.Bucket(logBucket)
+		if log == nil {
+			return errors.New("snapshot has no replication log")
+		}
+		seq = log.Sequence()
+
+		return d.store.Update(func(tx Tx) error {
+			local, err := namespaces(tx)
+			if err != nil {
+				return err
+			}
+			for _, n := range local {
+				if err := n.drop(tx); err != nil {
+					return err
+				}
+			}
+
+			names, err := namespaceBuckets(stx)
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				if err := copyBucket(stx, tx, name); err != nil {
+					return err
+				}
+			}
+
+			// The log, the replicas and the pins in the snapshot belong
+			// to the primary; the replica only keeps its position.
+			for _, name := range [][]byte{logBucket, replicasBucket, logPinsBucket, replicationStateBucket} {
+				if err := tx.DeleteBucket(name); err != nil {
+					return err
+				}
+			}
+			if err := createReplicationBuckets(tx); err != nil {
+				return err
+			}
+			if err := tx.Bucket(replicationStateBucket).Put(appliedKey, seqKey(seq)); err != nil {
+				return err
+			}
+
+			if fn == nil {
+				return nil
+			}
+			return fn(stx, tx, seq)
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// RestoreSnapshot writes the snapshot read from r to a BoltDB file at path.
+// The snapshot is verified before it replaces the file, so a truncated or
+// corrupt snapshot leaves path untouched. The database at path must not be
+// in use.
+func RestoreSnapshot(r io.Reader, path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := verifySnapshot(tmp.Name()); err != nil {
+		return fmt.Errorf("invalid snapshot: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// BoltDB file layout constants used to check the size of a snapshot before
+// it is opened: each of the first two pages holds a meta page with the
+// magic number, the page size and the high water mark of the file.
+const (
+	boltMagic           = 0xED0CDAED
+	boltMetaOffset      = 16 // size of the page header
+	boltPageSizeOffset  = boltMetaOffset + 8
+	boltHighWaterOffset = boltMetaOffset + 40
+	boltTxIDOffset      = boltMetaOffset + 48
+)
+
+// checkSnapshotSize checks that the BoltDB file at path is not shorter than
+// its most recent meta page says. BoltDB maps the file into memory and
+// would crash reading past the end of a truncated file.
+func checkSnapshotSize(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// The second meta page starts after the first page, whose size is
+	// stored in the first meta page.
+	var size, txid, pageSize uint64
+	header := make([]byte, boltTxIDOffset+8)
+	for i := uint64(0); i < 2; i++ {
+		if _, err := f.ReadAt(header, int64(i*pageSize)); err != nil {
+			return fmt.Errorf("reading meta page %d: %w", i, err)
+		}
+		if binary.LittleEndian.Uint32(header[boltMetaOffset:]) != boltMagic {
+			return fmt.Errorf("meta page %d: not a BoltDB file", i)
+		}
+		pageSize = uint64(binary.LittleEndian.Uint32(header[boltPageSizeOffset:]))
+		if t := binary.LittleEndian.Uint64(header[boltTxIDOffset:]); i == 0 || t > txid {
+			txid = t
+			size = pageSize * binary.LittleEndian.Uint64(header[boltHighWaterOffset:])
+		}
+	}
+
+	if uint64(st.Size()) < size {
+		return fmt.Errorf("file is truncated: %d bytes, want %d", st.Size(), size)
+	}
+	return nil
+}
+
+// verifySnapshot checks that the BoltDB file at path is consistent and
+// holds a database.
+func verifySnapshot(path string) error {
+	if err := checkSnapshotSize(path); err != nil {
+		return err
+	}
+
+	b, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	return b.View(func(tx *bolt.Tx) error {
+		// Drain the channel so that the checking goroutine finishes.
+		var checkErr error
+		for err := range tx.Check() {
+			if checkErr == nil {
+				checkErr = err
+			}
+		}
+		if checkErr != nil {
+			return checkErr
+		}
+		if tx.Bucket(defaultBucket) == nil {
+			return fmt.Errorf("bucket %q not found", defaultBucket)
+		}
+		return nil
+	})
+}
@@ -2,78 +2,365 @@ package db
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
-
-	bolt "go.etcd.io/bbolt"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// DB is a wrapper around the BoltDB database.
+// DB is a key-value database on top of a storage engine, BoltDB by default.
+// Keys are grouped in namespaces, each stored in its own buckets.
 type DB struct {
-	db       *bolt.DB
-	readOnly bool
+	store Storage
+	// readOnly is set on replicas and cleared when a replica is promoted.
+	readOnly atomic.Bool
+
+	// historyLimit is the number of previous versions kept for every key.
+	historyLimit atomic.Int64
+
+	// logChanged is closed and replaced after every transaction that may
+	// have appended to the replication log, and ackChanged after every
+	// acknowledgement of a replica.
+	logMu      sync.Mutex
+	logChanged chan struct{}
+	ackChanged chan struct{}
+
+	// proposer replicates writes before they are applied on shards that
+	// use consensus replication. proposeMu serializes the proposals.
+	proposer  atomic.Pointer[Proposer]
+	proposeMu sync.Mutex
 }
 
 var defaultBucket = []byte("default")
-var replicateBucket = []byte("replication")
 
-// NewDB returns an instance of a database.
+// ErrConflict is returned by conditional writes whose precondition does not
+// hold.
+var ErrConflict = errors.New("precondition failed")
+
+// Values in the data bucket of a namespace are stored as records: the
+// version of the key as a big-endian uint64 followed by the value. Versions
+// are taken from the sequence of the data bucket, so they only ever
+// increase, even if a key is deleted and set again.
+
+// encodeRecord returns the representation of a value and its version as
+// stored in the data bucket.
+func encodeRecord(version uint64, value []byte) []byte {
+	res := make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint64(res, version)
+	return append(res, value...)
+}
+
+// decodeRecord parses a record of the data bucket. The returned value is
+// a copy that is safe to use after the transaction ends.
+func decodeRecord(record []byte) (version uint64, value []byte) {
+	if len(record) < 8 {
+		return 0, nil
+	}
+	return binary.BigEndian.Uint64(record), copyByteSlice(record[8:])
+}
+
+// getRecord returns the version and value of a key that has not expired, or
+// zero and nil if there is no such key.
+func (n *namespace) getRecord(tx Tx, key []byte, now time.Time) (version uint64, value []byte) {
+	if n.expired(tx, key, now) {
+		return 0, nil
+	}
+	return decodeRecord(tx.Bucket(n.data).Get(key))
+}
+
+var (
+	// metaBucket holds the formatKey of the database.
+	metaBucket = []byte("meta")
+	// formatKey is the format of the data buckets: recordFormat once their
+	// values are stored as records.
+	formatKey = []byte("format")
+)
+
+const recordFormat = 1
+
+// migrateRecords converts the values of databases created before values
+// had versions, which only have the default namespace, to records. Versions
+// are taken from the sequence of the data bucket, so a bucket whose
+// sequence is set already holds records.
+func migrateRecords(tx Tx) error {
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+	if getUint64(meta, formatKey) >= recordFormat {
+		return nil
+	}
+
+	if b := tx.Bucket(defaultBucket); b != nil && b.Sequence() == 0 {
+		var keys, values [][]byte
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			keys = append(keys, copyByteSlice(k))
+			values = append(values, copyByteSlice(v))
+		}
+		for i := range keys {
+			version, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err := b.Put(keys[i], encodeRecord(version, values[i])); err != nil {
+				return err
+			}
+		}
+	}
+	return meta.Put(formatKey, seqKey(recordFormat))
+}
+
+// NewDB returns an instance of a database stored in a BoltDB file.
 func NewDB(dbPath string, readOnly bool) (db *DB, closeFunc func() error, err error) {
-	boltDB, err := bolt.Open(dbPath, 0600, nil)
+	store, err := OpenBolt(dbPath)
 	if err != nil {
 		return nil, nil, err
 	}
+	return NewDBWithStorage(store, readOnly)
+}
 
-	//	boltDB.NoSync = true
-
-	db = &DB{db: boltDB, readOnly: readOnly}
-	closeFunc = boltDB.Close
+// NewDBWithStorage returns an instance of a database that keeps its data in
+// the given storage engine. The returned function closes the storage.
+func NewDBWithStorage(store Storage, readOnly bool) (db *DB, closeFunc func() error, err error) {
+	db = &DB{store: store, logChanged: make(chan struct{}), ackChanged: make(chan struct{})}
+	db.readOnly.Store(readOnly)
 
 	if err := db.createBuckets(); err != nil {
-		closeFunc()
+		store.Close()
 		return nil, nil, fmt.Errorf("creating default bucket: %w", err)
 	}
 
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		db.reapLoop(stop)
+	}()
+
+	closeFunc = func() error {
+		close(stop)
+		wg.Wait()
+		return store.Close()
+	}
 	return db, closeFunc, nil
 }
 
 // create a bucket in the database
 func (d *DB) createBuckets() error {
-	return d.db.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucketIfNotExists(defaultBucket); err != nil {
+	return d.store.Update(func(tx Tx) error {
+		if err := migrateRecords(tx); err != nil {
 			return err
 		}
-		if _, err := tx.CreateBucketIfNotExists(replicateBucket); err != nil {
+		if err := createReplicationBuckets(tx); err != nil {
 			return err
 		}
-		return nil
+		if err := createRaftBuckets(tx); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(namespacesBucket); err != nil {
+			return err
+		}
+
+		// Databases created before namespaces already have the buckets
+		// of the default namespace but not its registry entry.
+		n, _ := lookupNamespace(DefaultNamespace)
+		for _, name := range [][]byte{n.data, n.ttl, n.expiry, n.history} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(namespacesBucket).Put([]byte(n.name), nil)
+	})
+}
+
+// view runs fn in a read-only transaction if the namespace exists. Reads
+// from a missing namespace behave like reads from an empty one.
+func (d *DB) view(ns string, fn func(tx Tx, n *namespace) error) error {
+	n, err := lookupNamespace(ns)
+	if err != nil {
+		return err
+	}
+
+	return d.store.View(func(tx Tx) error {
+		if !n.exists(tx) {
+			return nil
+		}
+		return fn(tx, n)
+	})
+}
+
+// update runs fn in a read-write transaction, creating the namespace if
+// it does not exist yet.
+func (d *DB) update(ns string, fn func(tx Tx, n *namespace) error) error {
+	n, err := lookupNamespace(ns)
+	if err != nil {
+		return err
+	}
+
+	return d.commit(func(tx Tx) error {
+		if err := n.create(tx); err != nil {
+			return err
+		}
+		return fn(tx, n)
 	})
 }
 
 // SetKey sets a key in the database. Returns an error if the operation fails.
-func (d *DB) SetKey(key string, value []byte) error {
-	if d.readOnly {
+func (d *DB) SetKey(ns, key string, value []byte) error {
+	return d.SetKeyWithTTL(ns, key, value, 0)
+}
+
+// SetKeyWithTTL sets a key in the database that expires after the given
+// duration. A zero ttl means that the key never expires.
+func (d *DB) SetKeyWithTTL(ns, key string, value []byte, ttl time.Duration) error {
+	if d.readOnly.Load() {
 		return errors.New("read-only mode")
 	}
+	if ttl < 0 {
+		return fmt.Errorf("negative ttl %v", ttl)
+	}
 
-	return d.db.Update(func(tx *bolt.Tx) error {
-		if err := tx.Bucket(defaultBucket).Put([]byte(key), value); err != nil {
-			return err
+	return d.update(ns, func(tx Tx, n *namespace) error {
+		return d.setKey(tx, n, []byte(key), value, ttl)
+	})
+}
+
+// CompareAndSwap sets the key to value if its current value equals expected.
+// A nil expected value only matches a missing key. Returns ErrConflict if
+// the current value does not match.
+func (d *DB) CompareAndSwap(ns, key string, expected, value []byte) error {
+	return d.setKeyIf(ns, key, value, 0, func(version uint64, cur []byte) bool {
+		if expected == nil {
+			return version == 0
 		}
+		return version != 0 && bytes.Equal(cur, expected)
+	})
+}
+
+// SetKeyIfAbsent sets the key to value if it does not exist. Returns
+// ErrConflict if the key exists.
+func (d *DB) SetKeyIfAbsent(ns, key string, value []byte) error {
+	return d.SetKeyIfVersion(ns, key, value, 0)
+}
+
+// SetKeyIfVersion sets the key to value if its current version equals
+// version. Version 0 only matches a missing key. Returns ErrConflict if the
+// version does not match.
+func (d *DB) SetKeyIfVersion(ns, key string, value []byte, version uint64) error {
+	return d.SetKeyIfVersionWithTTL(ns, key, value, version, 0)
+}
 
-		return tx.Bucket(replicateBucket).Put([]byte(key), value)
+// SetKeyIfVersionWithTTL is like SetKeyIfVersion for a key that expires
+// after the given duration. A zero ttl means that the key never expires.
+func (d *DB) SetKeyIfVersionWithTTL(ns, key string, value []byte, version uint64, ttl time.Duration) error {
+	return d.setKeyIf(ns, key, value, ttl, func(cur uint64, _ []byte) bool {
+		return cur == version
 	})
 }
 
-// SetKeyOnReplica sets the key to the requested value into the default
-// database. It does not write to the replication queue.
-// This method is only intended to be used on replicas.
-func (d *DB) SetKeyOnReplica(key string, value []byte) error {
-	return d.db.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket(defaultBucket).Put([]byte(key), value)
+// setKeyIf sets the key to value with the given ttl if cond returns true
+// for the current version and value of the key. The check and the write
+// happen in the same transaction.
+func (d *DB) setKeyIf(ns, key string, value []byte, ttl time.Duration, cond func(version uint64, value []byte) bool) error {
+	if d.readOnly.Load() {
+		return errors.New("read-only mode")
+	}
+	if ttl < 0 {
+		return fmt.Errorf("negative ttl %v", ttl)
+	}
+
+	return d.update(ns, func(tx Tx, n *namespace) error {
+		if !cond(n.getRecord(tx, []byte(key), time.Now())) {
+			return ErrConflict
+		}
+		return d.setKey(tx, n, []byte(key), value, ttl)
 	})
 }
 
+// SetKeys sets all given keys in a single transaction. Either all keys are
+// set or none of them.
+func (d *DB) SetKeys(ns string, kvs []KeyValue) error {
+	if d.readOnly.Load() {
+		return errors.New("read-only mode")
+	}
+
+	return d.update(ns, func(tx Tx, n *namespace) error {
+		for _, kv := range kvs {
+			if err := d.setKey(tx, n, []byte(kv.Key), kv.Value, 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// setKey sets the key and its expiration time and appends the change to
+// the replication log. The previous value is kept in the history.
+func (d *DB) setKey(tx Tx, n *namespace, key, value []byte, ttl time.Duration) error {
+	b := tx.Bucket(n.data)
+	version, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	if err := d.archive(tx, n, key); err != nil {
+		return err
+	}
+
+	if err := b.Put(key, encodeRecord(version, value)); err != nil {
+		return err
+	}
+
+	if err := n.clearTTL(tx, key); err != nil {
+		return err
+	}
+	var expiresAt int64
+	if ttl > 0 {
+		t := time.Now().Add(ttl)
+		if err := n.setTTL(tx, key, t); err != nil {
+			return err
+		}
+		expiresAt = t.UnixNano()
+	}
+
+	return appendLog(tx, &Change{Namespace: n.name, Key: key, Value: value, Version: version, ExpiresAt: expiresAt})
+}
+
+// DeleteKey deletes a key from the database and records a tombstone so that
+// the deletion is propagated to the replicas. Deleting a missing key is not
+// an error.
+func (d *DB) DeleteKey(ns, key string) error {
+	if d.readOnly.Load() {
+		return errors.New("read-only mode")
+	}
+
+	return d.update(ns, func(tx Tx, n *namespace) error {
+		return d.deleteKey(tx, n, []byte(key))
+	})
+}
+
+// deleteKey deletes the key and its expiration time and appends a tombstone
+// to the replication log. The deleted value is kept in the history.
+func (d *DB) deleteKey(tx Tx, n *namespace, key []byte) error {
+	if err := d.archive(tx, n, key); err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(n.data).Delete(key); err != nil {
+		return err
+	}
+
+	if err := n.clearTTL(tx, key); err != nil {
+		return err
+	}
+
+	return appendLog(tx, &Change{Namespace: n.name, Key: key, Deleted: true})
+}
+
 // copyByteSlice copies a byte slice into a new byte slice. Returns nil if the
 // input slice is nil.
 func copyByteSlice(b []byte) []byte {
@@ -85,83 +372,159 @@ func copyByteSlice(b []byte) []byte {
 	return res
 }
 
-// GetNextKeyForReplication gets the key and value for the keys that have
-// changed and have not been updated in the replica database(s).
-// If no keys are found, nil key and nil value are returned
-func (d *DB) GetNextKeyForReplication() (key, value []byte, err error) {
-	err = d.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(replicateBucket)
-		k, v := b.Cursor().First()
-		key = copyByteSlice(k)
-		value = copyByteSlice(v)
-		copy(key, k)
-		copy(value, v)
+// GetKey gets the value and the version of a given key in the requested
+// namespace. The version of a missing key is 0. Expired keys are reported as
+// missing even if the reaper has not deleted them yet.
+func (d *DB) GetKey(ns, key string) (value []byte, version uint64, err error) {
+	err = d.view(ns, func(tx Tx, n *namespace) error {
+		version, value = n.getRecord(tx, []byte(key), time.Now())
 		return nil
 	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, version, nil
+}
 
+// GetKeys gets the values of the given keys from a single consistent view of
+// the database. The value of a missing or expired key is nil.
+func (d *DB) GetKeys(ns string, keys []string) ([][]byte, error) {
+	res := make([][]byte, len(keys))
+	err := d.view(ns, func(tx Tx, n *namespace) error {
+		now := time.Now()
+		for i, key := range keys {
+			_, res[i] = n.getRecord(tx, []byte(key), now)
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	return key, value, nil
+	return res, nil
 }
 
-// DeleteReplicationKey deletes the key from the replication queue
-// if the value matches the contents or if the key is already absent.
-func (d *DB) DeleteReplicationKey(key, value []byte) (err error) {
-	return d.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(replicateBucket)
+// KeyValue is a key and its value as returned by scans.
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
 
-		v := b.Get(key)
-		if v == nil {
-			return errors.New("key not found")
+// Scan returns up to limit keys in the range [start, end) in ascending
+// order, skipping expired keys. An empty end scans until the last key and a
+// non-positive limit returns all keys in the range.
+func (d *DB) Scan(ns, start, end string, limit int) ([]KeyValue, error) {
+	var res []KeyValue
+	err := d.view(ns, func(tx Tx, n *namespace) error {
+		now := time.Now()
+		c := tx.Bucket(n.data).Cursor()
+		for k, v := c.Seek([]byte(start)); k != nil; k, v = c.Next() {
+			if end != "" && bytes.Compare(k, []byte(end)) >= 0 {
+				break
+			}
+			if limit > 0 && len(res) >= limit {
+				break
+			}
+			if n.expired(tx, k, now) {
+				continue
+			}
+			_, value := decodeRecord(v)
+			res = append(res, KeyValue{Key: string(k), Value: value})
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
 
-		if !bytes.Equal(v, value) {
-			return errors.New("value mismatch")
-		}
+// ScanPrefix returns up to limit keys starting with prefix in ascending
+// order. A non-positive limit returns all matching keys.
+func (d *DB) ScanPrefix(ns, prefix string, limit int) ([]KeyValue, error) {
+	return d.Scan(ns, prefix, PrefixEnd(prefix), limit)
+}
 
-		return b.Delete(key)
-	})
+// PrefixEnd returns the smallest key that is greater than all keys starting
+// with prefix, or an empty string if there is no such key.
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
 }
 
-// GetKey gets the value of a given key in the requested database.
-func (d *DB) GetKey(key string) ([]byte, error) {
-	var result []byte
-	err := d.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(defaultBucket)
-		result = b.Get([]byte(key))
+// CountKeys returns the number of keys of all namespaces by the shard that
+// owns them, as returned by owner.
+func (d *DB) CountKeys(owner func(key string) int) (map[int]int, error) {
+	counts := make(map[int]int)
+	err := d.store.View(func(tx Tx) error {
+		all, err := namespaces(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, n := range all {
+			c := tx.Bucket(n.data).Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				counts[owner(string(k))]++
+			}
+		}
 		return nil
 	})
-	if err == nil {
-		return result, nil
+	if err != nil {
+		return nil, err
 	}
-	return nil, err
+	return counts, nil
 }
 
-// DeleteExtraKeys deletes all keys that do not belong to the current shard.
+// DeleteExtraKeys deletes the keys of all namespaces that do not belong to
+// the current shard.
 func (d *DB) DeleteExtraKeys(isExtra func(string) bool) error {
-	var keys []string
-	err := d.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(defaultBucket)
-		return b.ForEach(func(k, v []byte) error {
-			ks := string(k)
-			if isExtra(ks) {
-				keys = append(keys, ks)
+	extra := make(map[*namespace][]string)
+	err := d.store.View(func(tx Tx) error {
+		all, err := namespaces(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, n := range all {
+			c := tx.Bucket(n.data).Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				ks := string(k)
+				if isExtra(ks) {
+					extra[n] = append(extra[n], ks)
+				}
 			}
-			return nil
-		})
+		}
+		return nil
 	})
 
 	if err != nil {
 		return err
 	}
 
-	return d.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(defaultBucket)
+	return d.store.Update(func(tx Tx) error {
+		for n, keys := range extra {
+			b := tx.Bucket(n.data)
+			if b == nil {
+				// The namespace was dropped in the meantime.
+				continue
+			}
 
-		for _, k := range keys {
-			if err := b.Delete([]byte(k)); err != nil {
-				return err
+			for _, k := range keys {
+				if err := b.Delete([]byte(k)); err != nil {
+					return err
+				}
+				if err := n.clearTTL(tx, []byte(k)); err != nil {
+					return err
+				}
+				if err := n.clearHistory(tx, []byte(k)); err != nil {
+					return err
+				}
 			}
 		}
 		return nil
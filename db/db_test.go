@@ -2,11 +2,19 @@ package db_test
 
 import (
 	"bytes"
+	"context"
 	"distributed-db/db"
+	"errors"
+	"fmt"
 	"os"
+	"reflect"
 	"testing"
+	"time"
 )
 
+// defaultNS is the namespace used by tests that do not exercise namespaces.
+const defaultNS = db.DefaultNamespace
+
 func createTempDb(t *testing.T, readOnly bool) *db.DB {
 	t.Helper()
 
@@ -30,15 +38,39 @@ func createTempDb(t *testing.T, readOnly bool) *db.DB {
 func setKey(t *testing.T, db *db.DB, key string, value string) {
 	t.Helper()
 
-	if err := db.SetKey(key, []byte(value)); err != nil {
+	if err := db.SetKey(defaultNS, key, []byte(value)); err != nil {
 		t.Fatalf("SetKey(%q, %q): failed to set key %q: %v", key, value, key, err)
 	}
 }
 
+// pinLog keeps the replication log of d, which is truncated when nothing
+// reads it, for the test to read.
+func pinLog(t *testing.T, d *db.DB) {
+	t.Helper()
+
+	if err := d.PinLog("test", 0); err != nil {
+		t.Fatalf("PinLog(test, 0): %v", err)
+	}
+}
+
+// lastChange returns the last change of the replication log.
+func lastChange(t *testing.T, d *db.DB) db.Change {
+	t.Helper()
+
+	changes, err := d.ReadLog(0, 1000)
+	if err != nil {
+		t.Fatalf("ReadLog: %v", err)
+	}
+	if len(changes) == 0 {
+		t.Fatalf("ReadLog: got no changes")
+	}
+	return changes[len(changes)-1]
+}
+
 func getKey(t *testing.T, db *db.DB, key string) string {
 	t.Helper()
 
-	val, err := db.GetKey(key)
+	val, _, err := db.GetKey(defaultNS, key)
 	if err != nil {
 		t.Fatalf("GetKey(%q): failed to get key %q: %v", key, key, err)
 	}
@@ -48,6 +80,7 @@ func getKey(t *testing.T, db *db.DB, key string) string {
 
 func TestGetSet(t *testing.T) {
 	db := createTempDb(t, false)
+	pinLog(t, db)
 
 	setKey(t, db, "a", "b")
 
@@ -65,54 +98,270 @@ func TestGetSet(t *testing.T) {
 		t.Errorf("Bytes.Equal failed")
 	}
 
-	k, v, err := db.GetNextKeyForReplication()
+	if c := lastChange(t, db); !bytes.Equal(c.Key, []byte("a")) || !bytes.Equal(c.Value, []byte("b")) || c.Deleted {
+		t.Errorf("Unexpected last change: got %+v, want {Key: %q, Value: %q}", c, "a", "b")
+	}
+}
+
+func TestMigrateLegacyValues(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "dbtest")
 	if err != nil {
-		t.Fatalf("GetNextKeyForReplication: got error %v, want nil", err)
+		t.Fatalf("Could not create a temp file: %v", err)
 	}
+	name := f.Name()
+	f.Close()
+	t.Cleanup(func() { os.Remove(name) })
 
-	if !bytes.Equal(k, []byte("a")) || !bytes.Equal(v, []byte("b")) || err != nil {
-		t.Errorf("GetNextKeyForReplication: got (%q, %q, %v), want (%q, %q, nil)", k, v, err, "a", "b")
+	// Values were stored as is before they had versions.
+	store, err := db.OpenBolt(name)
+	if err != nil {
+		t.Fatalf("OpenBolt: %v", err)
+	}
+	err = store.Update(func(tx db.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("default"))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("a"), []byte("x")); err != nil {
+			return err
+		}
+		return b.Put([]byte("b"), []byte("a longer value"))
+	})
+	store.Close()
+	if err != nil {
+		t.Fatalf("Could not write the legacy values: %v", err)
+	}
+
+	// The values are converted once, when the database is opened.
+	for i := 0; i < 2; i++ {
+		d, closeFunc, err := db.NewDB(name, false)
+		if err != nil {
+			t.Fatalf("NewDB: %v", err)
+		}
+		for key, want := range map[string]string{"a": "x", "b": "a longer value"} {
+			if value, version, err := d.GetKey(defaultNS, key); err != nil || string(value) != want || version == 0 {
+				t.Errorf("GetKey(%q) after opening %d times: got (%q, %d, %v), want (%q, a version, nil)", key, i+1, value, version, err, want)
+			}
+		}
+		closeFunc()
 	}
 }
 
-func TestDeleteReplicationKey(t *testing.T) {
-	db := createTempDb(t, false)
+func TestReplicationLog(t *testing.T) {
+	d := createTempDb(t, false)
+	if err := d.AckReplication("r1", 0); err != nil {
+		t.Fatalf("AckReplication(r1, 0): %v", err)
+	}
 
-	setKey(t, db, "a", "b")
+	// Intermediate writes of the same key are all kept, in order.
+	for _, v := range []string{"b", "c", "b"} {
+		setKey(t, d, "a", v)
+	}
+
+	changes, err := d.ReadLog(0, 2)
+	if err != nil {
+		t.Fatalf("ReadLog(0, 2): %v", err)
+	}
+	if len(changes) != 2 || changes[0].Seq != 1 || string(changes[0].Value) != "b" ||
+		changes[1].Seq != 2 || string(changes[1].Value) != "c" {
+		t.Fatalf("ReadLog(0, 2): got %+v, want changes 1 and 2 with values b and c", changes)
+	}
+
+	if err := d.AckReplication("r1", 2); err != nil {
+		t.Fatalf("AckReplication(r1, 2): %v", err)
+	}
+	if _, err := d.ReadLog(0, 10); !errors.Is(err, db.ErrLogTruncated) {
+		t.Errorf("ReadLog(0) after truncation: got error %v, want %v", err, db.ErrLogTruncated)
+	}
+
+	// A new replica that lags behind stops the log from being truncated.
+	if err := d.AckReplication("r2", 2); err != nil {
+		t.Fatalf("AckReplication(r2, 2): %v", err)
+	}
+	if err := d.AckReplication("r1", 3); err != nil {
+		t.Fatalf("AckReplication(r1, 3): %v", err)
+	}
+	changes, err = d.ReadLog(2, 10)
+	if err != nil {
+		t.Fatalf("ReadLog(2): %v", err)
+	}
+	if len(changes) != 1 || changes[0].Seq != 3 || string(changes[0].Value) != "b" {
+		t.Errorf("ReadLog(2): got %+v, want change 3 with value b", changes)
+	}
+
+	if err := d.AckReplication("r1", 4); err == nil {
+		t.Errorf("AckReplication(r1, 4): got nil error for a change past the end of the log")
+	}
+}
+
+func TestPinLog(t *testing.T) {
+	d := createTempDb(t, false)
+	if err := d.PinLog("pin", 0); err != nil {
+		t.Fatalf("PinLog(pin, 0): %v", err)
+	}
+	for _, v := range []string{"b", "c", "d"} {
+		setKey(t, d, "a", v)
+	}
+
+	if err := d.PinLog("pin", 1); err != nil {
+		t.Fatalf("PinLog(pin, 1): %v", err)
+	}
+	if err := d.AckReplication("r1", 3); err != nil {
+		t.Fatalf("AckReplication(r1, 3): %v", err)
+	}
+
+	// The pin keeps the log, but is not a replica.
+	if replicas, err := d.Replicas(); err != nil || !reflect.DeepEqual(replicas, map[string]uint64{"r1": 3}) {
+		t.Errorf("Replicas(): got (%v, %v), want (map[r1:3], nil)", replicas, err)
+	}
+	if n, err := d.WaitReplicated(context.Background(), 3, 1); err != nil || n != 1 {
+		t.Errorf("WaitReplicated(3, 1): got (%d, %v), want (1, nil)", n, err)
+	}
+	if changes, err := d.ReadLog(1, 10); err != nil || len(changes) != 2 {
+		t.Errorf("ReadLog(1) with a pin: got (%+v, %v), want changes 2 and 3", changes, err)
+	}
+
+	if err := d.UnpinLog("pin"); err != nil {
+		t.Fatalf("UnpinLog(pin): %v", err)
+	}
+	if _, err := d.ReadLog(1, 10); !errors.Is(err, db.ErrLogTruncated) {
+		t.Errorf("ReadLog(1) after UnpinLog: got error %v, want %v", err, db.ErrLogTruncated)
+	}
+}
+
+func TestTruncateUnreadLog(t *testing.T) {
+	d := createTempDb(t, false)
+
+	// Without replicas or pins, nothing reads the log and it is not kept.
+	setKey(t, d, "a", "b")
+	setKey(t, d, "a", "c")
+	if _, err := d.ReadLog(0, 10); !errors.Is(err, db.ErrLogTruncated) {
+		t.Errorf("ReadLog(0) without readers: got error %v, want %v", err, db.ErrLogTruncated)
+	}
+	if changes, err := d.ReadLog(2, 10); err != nil || len(changes) != 0 {
+		t.Errorf("ReadLog(2) without readers: got (%+v, %v), want no changes", changes, err)
+	}
+	if seq, err := d.LogSequence(); err != nil || seq != 2 {
+		t.Errorf("LogSequence() = %d, %v, want 2, nil", seq, err)
+	}
+}
 
-	k, v, err := db.GetNextKeyForReplication()
+func TestMigrateLegacyReplicationQueue(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "dbtest")
 	if err != nil {
-		t.Fatalf("GetNextKeyForReplication: got error %v, want nil", err)
+		t.Fatalf("Could not create a temp file: %v", err)
 	}
+	name := f.Name()
+	f.Close()
+	t.Cleanup(func() { os.Remove(name) })
 
-	if !bytes.Equal(k, []byte("a")) || !bytes.Equal(v, []byte("b")) {
-		t.Errorf("GetNextKeyForReplication: got (%q, %q, %v), want (%q, %q, nil)", k, v, err, "a", "b")
+	// The queue listed the keys changed since the replicas last synced: a
+	// key that was set and one that was deleted.
+	store, err := db.OpenBolt(name)
+	if err != nil {
+		t.Fatalf("OpenBolt: %v", err)
+	}
+	err = store.Update(func(tx db.Tx) error {
+		data, err := tx.CreateBucketIfNotExists([]byte("default"))
+		if err != nil {
+			return err
+		}
+		if err := data.Put([]byte("a"), []byte("x")); err != nil {
+			return err
+		}
+		queue, err := tx.CreateBucketIfNotExists([]byte("replication"))
+		if err != nil {
+			return err
+		}
+		if err := queue.Put([]byte("a"), []byte("x")); err != nil {
+			return err
+		}
+		return queue.Put([]byte("b"), nil)
+	})
+	store.Close()
+	if err != nil {
+		t.Fatalf("Could not write the legacy queue: %v", err)
+	}
+
+	d, closeFunc, err := db.NewDB(name, false)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
 	}
+	defer closeFunc()
 
-	if err := db.DeleteReplicationKey([]byte("a"), []byte("c")); err == nil {
-		t.Fatalf("DeleteReplicationKey(%q, %q): got nil error, want non-nil error", k, "c")
+	changes, err := d.ReadLog(0, 10)
+	if err != nil {
+		t.Fatalf("ReadLog: %v", err)
+	}
+	if len(changes) != 2 ||
+		string(changes[0].Key) != "a" || string(changes[0].Value) != "x" || changes[0].Version == 0 || changes[0].Deleted ||
+		string(changes[1].Key) != "b" || !changes[1].Deleted {
+		t.Errorf("ReadLog after opening a database with a legacy queue: got %+v, want a set of a and a deletion of b", changes)
 	}
+}
 
-	if err := db.DeleteReplicationKey([]byte("a"), []byte("b")); err != nil {
-		t.Fatalf("DeleteReplicationKey(%q, %q): got error %v, want nil", k, v, err)
+func TestApplyChanges(t *testing.T) {
+	primary := createTempDb(t, false)
+	replica := createTempDb(t, true)
+	pinLog(t, primary)
+
+	setKey(t, primary, "a", "b")
+	setKey(t, primary, "c", "d")
+	if err := primary.DeleteKey(defaultNS, "a"); err != nil {
+		t.Fatalf("DeleteKey: %v", err)
 	}
 
-	k, v, err = db.GetNextKeyForReplication()
+	changes, err := primary.ReadLog(0, 10)
 	if err != nil {
-		t.Fatalf("GetNextKeyForReplication: got error %v, want nil", err)
+		t.Fatalf("ReadLog: %v", err)
+	}
+	// Applying a batch twice is harmless.
+	for i := 0; i < 2; i++ {
+		if err := replica.ApplyChanges(changes); err != nil {
+			t.Fatalf("ApplyChanges: %v", err)
+		}
+	}
+
+	if seq, err := replica.AppliedSequence(); err != nil || seq != 3 {
+		t.Errorf("AppliedSequence() = %d, %v, want 3, nil", seq, err)
+	}
+	if value := getKey(t, replica, "a"); value != "" {
+		t.Errorf("Unexpected value for deleted key 'a' on the replica: got %q", value)
+	}
+	if value, version, err := replica.GetKey(defaultNS, "c"); err != nil || string(value) != "d" || version != 2 {
+		t.Errorf("GetKey(c) on the replica = %q, %d, %v, want %q, 2, nil", value, version, err, "d")
+	}
+}
+
+func TestDeleteKey(t *testing.T) {
+	db := createTempDb(t, false)
+	pinLog(t, db)
+
+	setKey(t, db, "a", "b")
+
+	if err := db.DeleteKey(defaultNS, "a"); err != nil {
+		t.Fatalf("DeleteKey(%q): got error %v, want nil", "a", err)
+	}
+
+	if value := getKey(t, db, "a"); value != "" {
+		t.Errorf("Unexpected value for key 'a' after deleting it: got %q, want %q", value, "")
 	}
 
-	if k != nil || v != nil {
-		t.Errorf("GetNextKeyForReplication: got (%q, %q), want (nil, nil)", k, v)
+	if c := lastChange(t, db); !bytes.Equal(c.Key, []byte("a")) || !c.Deleted {
+		t.Errorf("Unexpected last change: got %+v, want tombstone for %q", c, "a")
 	}
 }
 
 func TestSetReadOnly(t *testing.T) {
 	db := createTempDb(t, true)
 
-	if err := db.SetKey("a", []byte("b")); err == nil {
+	if err := db.SetKey(defaultNS, "a", []byte("b")); err == nil {
 		t.Fatalf("SetKey(%q, %q): got nil error, wanted non-nil error", "a", "b")
 	}
+
+	if err := db.DeleteKey(defaultNS, "a"); err == nil {
+		t.Fatalf("DeleteKey(%q): got nil error, wanted non-nil error", "a")
+	}
 }
 
 func TestDeleteExtraKeys(t *testing.T) {
@@ -137,3 +386,759 @@ func TestDeleteExtraKeys(t *testing.T) {
 			"got %q, want %q", value, "")
 	}
 }
+
+func TestCountKeys(t *testing.T) {
+	d := createTempDb(t, false)
+
+	setKey(t, d, "a", "b")
+	setKey(t, d, "b", "c")
+	if err := d.SetKey("other", "a", []byte("d")); err != nil {
+		t.Fatalf("SetKey(other, a): %v", err)
+	}
+
+	counts, err := d.CountKeys(func(key string) int { return int(key[0] - 'a') })
+	if err != nil {
+		t.Fatalf("CountKeys: %v", err)
+	}
+	if want := map[int]int{0: 2, 1: 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("CountKeys: got %v, want %v", counts, want)
+	}
+}
+
+func TestDeleteExported(t *testing.T) {
+	db := createTempDb(t, false)
+
+	setKey(t, db, "a", "b")
+	setKey(t, db, "c", "d")
+
+	changes, _, err := db.ExportKeys(defaultNS, nil, 10, func(string) bool { return true })
+	if err != nil {
+		t.Fatalf("ExportKeys: %v", err)
+	}
+	// A key that changed after it was exported is kept.
+	setKey(t, db, "c", "e")
+
+	if n, err := db.DeleteExported(changes); err != nil || n != 1 {
+		t.Fatalf("DeleteExported: got (%d, %v), want (1, nil)", n, err)
+	}
+	if value := getKey(t, db, "a"); value != "" {
+		t.Errorf("Unexpected value for key 'a' after DeleteExported: got %q, want %q", value, "")
+	}
+	if value := getKey(t, db, "c"); value != "e" {
+		t.Errorf("Unexpected value for key 'c' after DeleteExported: got %q, want %q", value, "e")
+	}
+}
+
+func TestSetKeyWithTTL(t *testing.T) {
+	db := createTempDb(t, false)
+
+	if err := db.SetKeyWithTTL(defaultNS, "a", []byte("b"), 50*time.Millisecond); err != nil {
+		t.Fatalf("SetKeyWithTTL(%q, %q): got error %v, want nil", "a", "b", err)
+	}
+	if err := db.SetKeyWithTTL(defaultNS, "c", []byte("d"), 50*time.Millisecond); err != nil {
+		t.Fatalf("SetKeyWithTTL(%q, %q): got error %v, want nil", "c", "d", err)
+	}
+	// Overwriting a key without a ttl makes it persistent again.
+	setKey(t, db, "c", "e")
+
+	if value := getKey(t, db, "a"); value != "b" {
+		t.Errorf("Unexpected value for key 'a' before expiry: got %q, want %q", value, "b")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if value := getKey(t, db, "a"); value != "" {
+		t.Errorf("Unexpected value for key 'a' after expiry: got %q, want %q", value, "")
+	}
+	if value := getKey(t, db, "c"); value != "e" {
+		t.Errorf("Unexpected value for key 'c' after expiry: got %q, want %q", value, "e")
+	}
+
+	if err := db.SetKeyWithTTL(defaultNS, "a", []byte("b"), -time.Second); err == nil {
+		t.Errorf("SetKeyWithTTL(%q, %q, -1s): got nil error, want non-nil error", "a", "b")
+	}
+}
+
+func TestReapExpiredKeys(t *testing.T) {
+	db := createTempDb(t, false)
+	pinLog(t, db)
+
+	if err := db.SetKeyWithTTL(defaultNS, "a", []byte("b"), time.Millisecond); err != nil {
+		t.Fatalf("SetKeyWithTTL(%q, %q): got error %v, want nil", "a", "b", err)
+	}
+
+	// Wait for the reaper to run at least once.
+	time.Sleep(1500 * time.Millisecond)
+
+	if c := lastChange(t, db); !bytes.Equal(c.Key, []byte("a")) || !c.Deleted {
+		t.Errorf("Unexpected last change: got %+v, want tombstone for %q", c, "a")
+	}
+}
+
+func TestScan(t *testing.T) {
+	d := createTempDb(t, false)
+
+	for _, k := range []string{"a", "b", "ba", "bb", "c"} {
+		setKey(t, d, k, "value-"+k)
+	}
+	if err := d.SetKeyWithTTL(defaultNS, "bc", []byte("expired"), time.Millisecond); err != nil {
+		t.Fatalf("SetKeyWithTTL(%q): got error %v, want nil", "bc", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	keys := func(kvs []db.KeyValue) (res []string) {
+		for _, kv := range kvs {
+			if string(kv.Value) != "value-"+kv.Key {
+				t.Errorf("Unexpected value for key %q: got %q, want %q", kv.Key, kv.Value, "value-"+kv.Key)
+			}
+			res = append(res, kv.Key)
+		}
+		return res
+	}
+
+	tests := []struct {
+		start, end string
+		limit      int
+		want       []string
+	}{
+		{"", "", 0, []string{"a", "b", "ba", "bb", "c"}},
+		{"b", "c", 0, []string{"b", "ba", "bb"}},
+		{"b", "", 2, []string{"b", "ba"}},
+		{"bz", "", 0, []string{"c"}},
+		{"d", "", 0, nil},
+	}
+
+	for _, tt := range tests {
+		got, err := d.Scan(defaultNS, tt.start, tt.end, tt.limit)
+		if err != nil {
+			t.Fatalf("Scan(%q, %q, %d): got error %v, want nil", tt.start, tt.end, tt.limit, err)
+		}
+		if !reflect.DeepEqual(keys(got), tt.want) {
+			t.Errorf("Scan(%q, %q, %d): got %q, want %q", tt.start, tt.end, tt.limit, keys(got), tt.want)
+		}
+	}
+
+	got, err := d.ScanPrefix(defaultNS, "b", 0)
+	if err != nil {
+		t.Fatalf("ScanPrefix(%q): got error %v, want nil", "b", err)
+	}
+	if want := []string{"b", "ba", "bb"}; !reflect.DeepEqual(keys(got), want) {
+		t.Errorf("ScanPrefix(%q): got %q, want %q", "b", keys(got), want)
+	}
+}
+
+func TestGetSetKeys(t *testing.T) {
+	d := createTempDb(t, false)
+
+	if err := d.SetKeys(defaultNS, []db.KeyValue{{Key: "a", Value: []byte("b")}, {Key: "c", Value: []byte("d")}}); err != nil {
+		t.Fatalf("SetKeys: got error %v, want nil", err)
+	}
+
+	got, err := d.GetKeys(defaultNS, []string{"c", "x", "a"})
+	if err != nil {
+		t.Fatalf("GetKeys: got error %v, want nil", err)
+	}
+
+	if want := [][]byte{[]byte("d"), nil, []byte("b")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetKeys: got %q, want %q", got, want)
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	d := createTempDb(t, false)
+
+	if err := d.SetKeyIfAbsent(defaultNS, "a", []byte("1")); err != nil {
+		t.Fatalf("SetKeyIfAbsent(%q): got error %v, want nil", "a", err)
+	}
+	if err := d.SetKeyIfAbsent(defaultNS, "a", []byte("2")); !errors.Is(err, db.ErrConflict) {
+		t.Errorf("SetKeyIfAbsent(%q) on existing key: got error %v, want %v", "a", err, db.ErrConflict)
+	}
+
+	if err := d.CompareAndSwap(defaultNS, "a", []byte("2"), []byte("3")); !errors.Is(err, db.ErrConflict) {
+		t.Errorf("CompareAndSwap(%q, %q, %q): got error %v, want %v", "a", "2", "3", err, db.ErrConflict)
+	}
+	if err := d.CompareAndSwap(defaultNS, "a", []byte("1"), []byte("3")); err != nil {
+		t.Errorf("CompareAndSwap(%q, %q, %q): got error %v, want nil", "a", "1", "3", err)
+	}
+	if err := d.CompareAndSwap(defaultNS, "b", nil, []byte("1")); err != nil {
+		t.Errorf("CompareAndSwap(%q, nil, %q): got error %v, want nil", "b", "1", err)
+	}
+
+	value, version, err := d.GetKey(defaultNS, "a")
+	if err != nil || string(value) != "3" || version == 0 {
+		t.Fatalf("GetKey(%q): got (%q, %d, %v), want (%q, >0, nil)", "a", value, version, err, "3")
+	}
+
+	if err := d.SetKeyIfVersion(defaultNS, "a", []byte("4"), version+1); !errors.Is(err, db.ErrConflict) {
+		t.Errorf("SetKeyIfVersion(%q, %d): got error %v, want %v", "a", version+1, err, db.ErrConflict)
+	}
+	if err := d.SetKeyIfVersion(defaultNS, "a", []byte("4"), version); err != nil {
+		t.Errorf("SetKeyIfVersion(%q, %d): got error %v, want nil", "a", version, err)
+	}
+
+	_, newVersion, err := d.GetKey(defaultNS, "a")
+	if err != nil || newVersion <= version {
+		t.Errorf("GetKey(%q) after update: got (%d, %v), want (>%d, nil)", "a", newVersion, err, version)
+	}
+}
+
+func TestConditionalWriteWithTTL(t *testing.T) {
+	d := createTempDb(t, false)
+
+	if err := d.SetKeyIfVersionWithTTL(defaultNS, "a", []byte("1"), 0, 50*time.Millisecond); err != nil {
+		t.Fatalf("SetKeyIfVersionWithTTL(%q, 0): got error %v, want nil", "a", err)
+	}
+	if value := getKey(t, d, "a"); value != "1" {
+		t.Errorf("Unexpected value for key 'a' before expiry: got %q, want %q", value, "1")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if value := getKey(t, d, "a"); value != "" {
+		t.Errorf("Unexpected value for key 'a' after expiry: got %q, want %q", value, "")
+	}
+	// The expired key is absent again.
+	if err := d.SetKeyIfAbsent(defaultNS, "a", []byte("2")); err != nil {
+		t.Errorf("SetKeyIfAbsent(%q) after expiry: got error %v, want nil", "a", err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	d := createTempDb(t, false)
+	d.SetHistoryLimit(2)
+
+	for _, v := range []string{"1", "2", "3", "4"} {
+		setKey(t, d, "a", v)
+	}
+
+	history, err := d.History(defaultNS, "a")
+	if err != nil {
+		t.Fatalf("History(%q): got error %v, want nil", "a", err)
+	}
+
+	var values []string
+	for i, v := range history {
+		if i > 0 && v.Version >= history[i-1].Version {
+			t.Errorf("History(%q): versions not in descending order: %+v", "a", history)
+		}
+		values = append(values, string(v.Value))
+	}
+	if want := []string{"4", "3", "2"}; !reflect.DeepEqual(values, want) {
+		t.Fatalf("History(%q): got values %q, want %q", "a", values, want)
+	}
+
+	old, err := d.GetKeyAtVersion(defaultNS, "a", history[2].Version)
+	if err != nil || string(old) != "2" {
+		t.Errorf("GetKeyAtVersion(%q, %d): got (%q, %v), want (%q, nil)", "a", history[2].Version, old, err, "2")
+	}
+
+	if err := d.DeleteKey(defaultNS, "a"); err != nil {
+		t.Fatalf("DeleteKey(%q): got error %v, want nil", "a", err)
+	}
+
+	// The deleted value can still be recovered.
+	old, err = d.GetKeyAtVersion(defaultNS, "a", history[0].Version)
+	if err != nil || string(old) != "4" {
+		t.Errorf("GetKeyAtVersion(%q, %d) after delete: got (%q, %v), want (%q, nil)", "a", history[0].Version, old, err, "4")
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	d := createTempDb(t, false)
+	pinLog(t, d)
+
+	if err := d.SetKey("tenant", "a", []byte("t")); err != nil {
+		t.Fatalf("SetKey(tenant, a): %v", err)
+	}
+	setKey(t, d, "a", "b")
+
+	if value, _, err := d.GetKey("tenant", "a"); err != nil || string(value) != "t" {
+		t.Errorf("GetKey(tenant, a) = %q, %v, want %q, nil", value, err, "t")
+	}
+	if value := getKey(t, d, "a"); value != "b" {
+		t.Errorf("GetKey(default, a) = %q, want %q", value, "b")
+	}
+	if value, _, err := d.GetKey("missing", "a"); err != nil || value != nil {
+		t.Errorf("GetKey(missing, a) = %q, %v, want nil, nil", value, err)
+	}
+
+	if err := d.CreateNamespace("empty"); err != nil {
+		t.Fatalf("CreateNamespace(empty): %v", err)
+	}
+	names, err := d.Namespaces()
+	if err != nil {
+		t.Fatalf("Namespaces: %v", err)
+	}
+	if want := []string{"default", "empty", "tenant"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Namespaces() = %q, want %q", names, want)
+	}
+
+	if err := d.SetKey("bad:name", "a", nil); err == nil {
+		t.Errorf("SetKey(bad:name): got nil error, want non-nil error")
+	}
+	if err := d.DropNamespace(db.DefaultNamespace); err == nil {
+		t.Errorf("DropNamespace(default): got nil error, want non-nil error")
+	}
+
+	if err := d.DropNamespace("tenant"); err != nil {
+		t.Fatalf("DropNamespace(tenant): %v", err)
+	}
+	if value, _, err := d.GetKey("tenant", "a"); err != nil || value != nil {
+		t.Errorf("GetKey(tenant, a) after drop = %q, %v, want nil, nil", value, err)
+	}
+	if err := d.DropNamespace("tenant"); err != nil {
+		t.Errorf("DropNamespace(tenant) twice: %v", err)
+	}
+
+	changes, err := d.ReadLog(0, 10)
+	if err != nil {
+		t.Fatalf("ReadLog: %v", err)
+	}
+	want := []db.Change{
+		{Seq: 1, Namespace: "tenant", Key: []byte("a"), Value: []byte("t"), Version: 1},
+		{Seq: 2, Namespace: "default", Key: []byte("a"), Value: []byte("b"), Version: 1},
+		{Seq: 3, Namespace: "tenant", Key: []byte{}, Drop: true},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("ReadLog() = %+v, want %+v", changes, want)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	for name, store := range storageEngines(t) {
+		t.Run(name, func(t *testing.T) {
+			d, _, err := db.NewDBWithStorage(store, true)
+			if err != nil {
+				t.Fatalf("NewDBWithStorage: %v", err)
+			}
+			if err := d.ApplyChanges([]db.Change{
+				{Seq: 1, Namespace: defaultNS, Key: []byte("a"), Value: []byte("b"), Version: 7},
+				{Seq: 2, Namespace: "tenant", Key: []byte("c"), Value: []byte("d"), Version: 1},
+			}); err != nil {
+				t.Fatalf("ApplyChanges: %v", err)
+			}
+
+			var buf bytes.Buffer
+			n, err := d.WriteSnapshot(&buf)
+			if err != nil {
+				t.Fatalf("WriteSnapshot: %v", err)
+			}
+			if n != int64(buf.Len()) {
+				t.Errorf("WriteSnapshot: got %d bytes, wrote %d", n, buf.Len())
+			}
+
+			path := t.TempDir() + "/restored.db"
+			if err := db.RestoreSnapshot(bytes.NewReader(buf.Bytes()[:buf.Len()/2]), path); err == nil {
+				t.Errorf("RestoreSnapshot(truncated): got nil error, want non-nil error")
+			}
+			if err := db.RestoreSnapshot(&buf, path); err != nil {
+				t.Fatalf("RestoreSnapshot: %v", err)
+			}
+
+			restored, closeFunc, err := db.NewDB(path, true)
+			if err != nil {
+				t.Fatalf("NewDB(%q): %v", path, err)
+			}
+			defer closeFunc()
+
+			if value, version, err := restored.GetKey(defaultNS, "a"); err != nil || string(value) != "b" || version != 7 {
+				t.Errorf("GetKey(a) = %q, %d, %v, want %q, 7, nil", value, version, err, "b")
+			}
+			if value, _, err := restored.GetKey("tenant", "c"); err != nil || string(value) != "d" {
+				t.Errorf("GetKey(tenant, c) = %q, %v, want %q, nil", value, err, "d")
+			}
+		})
+	}
+}
+
+func TestSetReplicas(t *testing.T) {
+	d := createTempDb(t, false)
+	if err := d.SetReplicas([]string{"r1", "r2"}); err != nil {
+		t.Fatalf("SetReplicas(r1, r2): %v", err)
+	}
+
+	for _, v := range []string{"1", "2"} {
+		setKey(t, d, "a", v)
+	}
+	if err := d.AckReplication("r1", 2); err != nil {
+		t.Fatalf("AckReplication(r1, 2): %v", err)
+	}
+
+	// r2 has not applied anything yet, so the whole log is kept.
+	if changes, err := d.ReadLog(0, 10); err != nil || len(changes) != 2 {
+		t.Errorf("ReadLog(0) = %+v, %v, want 2 changes", changes, err)
+	}
+	replicas, err := d.Replicas()
+	if err != nil {
+		t.Fatalf("Replicas: %v", err)
+	}
+	if want := map[string]uint64{"r1": 2, "r2": 0}; !reflect.DeepEqual(replicas, want) {
+		t.Errorf("Replicas() = %v, want %v", replicas, want)
+	}
+
+	// Once r2 is removed, the changes applied by r1 are dropped.
+	if err := d.SetReplicas([]string{"r1"}); err != nil {
+		t.Fatalf("SetReplicas(r1): %v", err)
+	}
+	if _, err := d.ReadLog(0, 10); !errors.Is(err, db.ErrLogTruncated) {
+		t.Errorf("ReadLog(0) after removing r2: got error %v, want %v", err, db.ErrLogTruncated)
+	}
+}
+
+func TestLoadSnapshot(t *testing.T) {
+	primary := createTempDb(t, false)
+	setKey(t, primary, "a", "1")
+	if err := primary.SetKey("tenant", "b", []byte("2")); err != nil {
+		t.Fatalf("SetKey(tenant, b): %v", err)
+	}
+	if err := primary.SetReplicas([]string{"r1"}); err != nil {
+		t.Fatalf("SetReplicas(r1): %v", err)
+	}
+	if err := primary.AckReplication("r1", 2); err != nil {
+		t.Fatalf("AckReplication(r1, 2): %v", err)
+	}
+
+	replica := createTempDb(t, true)
+	if err := replica.ApplyChanges([]db.Change{
+		{Seq: 1, Namespace: "stale", Key: []byte("c"), Value: []byte("3"), Version: 1},
+	}); err != nil {
+		t.Fatalf("ApplyChanges: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := primary.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("WriteSnapshot: %v", err)
+	}
+	seq, err := replica.LoadSnapshot(&buf)
+	if err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+	if seq != 2 {
+		t.Errorf("LoadSnapshot: got position %d, want 2", seq)
+	}
+	if applied, err := replica.AppliedSequence(); err != nil || applied != 2 {
+		t.Errorf("AppliedSequence() = %d, %v, want 2, nil", applied, err)
+	}
+
+	namespaces, err := replica.Namespaces()
+	if err != nil {
+		t.Fatalf("Namespaces: %v", err)
+	}
+	if want := []string{defaultNS, "tenant"}; !reflect.DeepEqual(namespaces, want) {
+		t.Errorf("Namespaces() = %v, want %v", namespaces, want)
+	}
+
+	// Replication resumes from the position of the snapshot.
+	setKey(t, primary, "a", "4")
+	changes, err := primary.ReadLog(seq, 10)
+	if err != nil {
+		t.Fatalf("ReadLog(%d): %v", seq, err)
+	}
+	if err := replica.ApplyChanges(changes); err != nil {
+		t.Fatalf("ApplyChanges: %v", err)
+	}
+	if value, _, err := replica.GetKey(defaultNS, "a"); err != nil || string(value) != "4" {
+		t.Errorf("GetKey(a) = %q, %v, want %q, nil", value, err, "4")
+	}
+	if value, _, err := replica.GetKey("tenant", "b"); err != nil || string(value) != "2" {
+		t.Errorf("GetKey(tenant, b) = %q, %v, want %q, nil", value, err, "2")
+	}
+}
+
+func TestPromote(t *testing.T) {
+	d := createTempDb(t, true)
+	if err := d.ApplyChanges([]db.Change{
+		{Seq: 1, Namespace: defaultNS, Key: []byte("a"), Value: []byte("1"), Version: 1},
+		{Seq: 2, Namespace: defaultNS, Key: []byte("a"), Value: []byte("2"), Version: 2},
+	}); err != nil {
+		t.Fatalf("ApplyChanges: %v", err)
+	}
+	if err := d.SetKey(defaultNS, "a", []byte("3")); err == nil {
+		t.Errorf("SetKey on a replica: got nil error, want non-nil error")
+	}
+
+	if err := d.Promote(); err != nil {
+		t.Fatalf("Promote: %v", err)
+	}
+	if d.ReadOnly() {
+		t.Errorf("ReadOnly() after Promote: got true, want false")
+	}
+	if err := d.AckReplication("r1", 2); err != nil {
+		t.Fatalf("AckReplication(r1, 2): %v", err)
+	}
+	setKey(t, d, "a", "3")
+
+	// The log continues after the last applied change of the old primary.
+	changes, err := d.ReadLog(2, 10)
+	if err != nil {
+		t.Fatalf("ReadLog(2): %v", err)
+	}
+	if len(changes) != 1 || changes[0].Seq != 3 || string(changes[0].Value) != "3" || changes[0].Version != 3 {
+		t.Errorf("ReadLog(2) = %+v, want the change to %q with sequence number 3 and version 3", changes, "3")
+	}
+	if _, err := d.ReadLog(1, 10); !errors.Is(err, db.ErrLogTruncated) {
+		t.Errorf("ReadLog(1): got %v, want %v", err, db.ErrLogTruncated)
+	}
+	if seq, err := d.LogSequence(); err != nil || seq != 3 {
+		t.Errorf("LogSequence() = %d, %v, want 3, nil", seq, err)
+	}
+}
+
+func TestRaftLog(t *testing.T) {
+	d := createTempDb(t, false)
+
+	entries := []db.RaftEntry{
+		{Index: 1, Term: 1},
+		{Index: 2, Term: 1, Changes: []db.Change{{Namespace: defaultNS, Key: []byte("a"), Value: []byte("1"), Version: 1}}},
+		{Index: 3, Term: 1, Changes: []db.Change{{Namespace: defaultNS, Key: []byte("a"), Value: []byte("2"), Version: 2}}},
+	}
+	if err := d.AppendRaftEntries(entries); err != nil {
+		t.Fatalf("AppendRaftEntries: %v", err)
+	}
+	if err := d.SetRaftTerm(2, "b"); err != nil {
+		t.Fatalf("SetRaftTerm: %v", err)
+	}
+
+	// A new leader replaces the last entry.
+	replaced := db.RaftEntry{Index: 3, Term: 2, Changes: []db.Change{{Namespace: defaultNS, Key: []byte("a"), Deleted: true}}}
+	if err := d.AppendRaftEntries([]db.RaftEntry{replaced}); err != nil {
+		t.Fatalf("AppendRaftEntries: %v", err)
+	}
+
+	st, err := d.RaftState()
+	if err != nil {
+		t.Fatalf("RaftState: %v", err)
+	}
+	if want := (db.RaftState{Term: 2, Vote: "b", LastIndex: 3, LastTerm: 2}); st != want {
+		t.Errorf("RaftState() = %+v, want %+v", st, want)
+	}
+
+	got, err := d.RaftEntries(2, 10)
+	if err != nil {
+		t.Fatalf("RaftEntries: %v", err)
+	}
+	if want := []db.RaftEntry{entries[1], replaced}; !reflect.DeepEqual(got, want) {
+		t.Errorf("RaftEntries(2) = %+v, want %+v", got, want)
+	}
+
+	for _, e := range got[:1] {
+		if err := d.ApplyEntry(&e); err != nil {
+			t.Fatalf("ApplyEntry(%d): %v", e.Index, err)
+		}
+	}
+	if value, _, err := d.GetKey(defaultNS, "a"); err != nil || string(value) != "1" {
+		t.Errorf("GetKey(a) = %q, %v, want %q, nil", value, err, "1")
+	}
+
+	if err := d.CompactRaftLog(3); err == nil {
+		t.Errorf("CompactRaftLog(3) before applying entry 3: got nil error, want non-nil error")
+	}
+	if err := d.CompactRaftLog(2); err != nil {
+		t.Fatalf("CompactRaftLog(2): %v", err)
+	}
+	if term, err := d.RaftTerm(2); err != nil || term != 1 {
+		t.Errorf("RaftTerm(2) after compaction = %d, %v, want 1, nil", term, err)
+	}
+	if got, err := d.RaftEntries(0, 10); err != nil || len(got) != 1 || got[0].Index != 3 {
+		t.Errorf("RaftEntries(0) after compaction = %+v, %v, want entry 3", got, err)
+	}
+}
+
+// applier is a db.Proposer that applies the proposed changes right away.
+type applier struct {
+	d       *db.DB
+	index   uint64
+	leader  bool
+	entries []db.RaftEntry
+}
+
+func (a *applier) IsLeader() bool { return a.leader }
+
+func (a *applier) Propose(changes []db.Change) error {
+	a.index++
+	e := db.RaftEntry{Index: a.index, Term: 1, Changes: changes}
+	a.entries = append(a.entries, e)
+	return a.d.ApplyEntry(&e)
+}
+
+func TestProposer(t *testing.T) {
+	d := createTempDb(t, false)
+	p := &applier{d: d, leader: true}
+	d.SetProposer(p)
+
+	setKey(t, d, "a", "1")
+	if err := d.SetKeyIfAbsent(defaultNS, "a", []byte("2")); !errors.Is(err, db.ErrConflict) {
+		t.Errorf("SetKeyIfAbsent(a): got %v, want %v", err, db.ErrConflict)
+	}
+	if err := d.SetKeyIfVersion(defaultNS, "a", []byte("2"), 1); err != nil {
+		t.Errorf("SetKeyIfVersion(a, 1): %v", err)
+	}
+
+	// Only the writes that passed their conditions were proposed, and they
+	// were applied once.
+	if len(p.entries) != 2 {
+		t.Errorf("Got %d proposals, want 2", len(p.entries))
+	}
+	if value, version, err := d.GetKey(defaultNS, "a"); err != nil || string(value) != "2" || version != 2 {
+		t.Errorf("GetKey(a) = %q, %d, %v, want %q, 2, nil", value, version, err, "2")
+	}
+	if applied, err := d.AppliedSequence(); err != nil || applied != 2 {
+		t.Errorf("AppliedSequence() = %d, %v, want 2, nil", applied, err)
+	}
+
+	p.leader = false
+	if err := d.SetKey(defaultNS, "a", []byte("3")); !errors.Is(err, db.ErrNotLeader) {
+		t.Errorf("SetKey on a follower: got %v, want %v", err, db.ErrNotLeader)
+	}
+}
+
+func TestInstallRaftSnapshot(t *testing.T) {
+	leader := createTempDb(t, false)
+	for i, v := range []string{"1", "2"} {
+		e := db.RaftEntry{Index: uint64(i + 1), Term: 3, Changes: []db.Change{
+			{Namespace: "tenant", Key: []byte("a"), Value: []byte(v), Version: uint64(i + 1)},
+		}}
+		if err := leader.ApplyEntry(&e); err != nil {
+			t.Fatalf("ApplyEntry(%d): %v", e.Index, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := leader.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("WriteSnapshot: %v", err)
+	}
+
+	follower := createTempDb(t, false)
+	if err := follower.AppendRaftEntries([]db.RaftEntry{{Index: 1, Term: 1}}); err != nil {
+		t.Fatalf("AppendRaftEntries: %v", err)
+	}
+	index, term, err := follower.InstallRaftSnapshot(&buf)
+	if err != nil {
+		t.Fatalf("InstallRaftSnapshot: %v", err)
+	}
+	if index != 2 || term != 3 {
+		t.Errorf("InstallRaftSnapshot() = %d, %d, want 2, 3", index, term)
+	}
+
+	st, err := follower.RaftState()
+	if err != nil {
+		t.Fatalf("RaftState: %v", err)
+	}
+	if want := (db.RaftState{SnapshotIndex: 2, SnapshotTerm: 3, LastIndex: 2, LastTerm: 3}); st != want {
+		t.Errorf("RaftState() = %+v, want %+v", st, want)
+	}
+	if value, _, err := follower.GetKey("tenant", "a"); err != nil || string(value) != "2" {
+		t.Errorf("GetKey(tenant, a) = %q, %v, want %q, nil", value, err, "2")
+	}
+}
+
+func TestWaitReplicated(t *testing.T) {
+	d := createTempDb(t, false)
+	if err := d.SetReplicas([]string{"r1", "r2"}); err != nil {
+		t.Fatalf("SetReplicas: %v", err)
+	}
+	setKey(t, d, "a", "1")
+	setKey(t, d, "a", "2")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if n, err := d.WaitReplicated(ctx, 2, 1); !errors.Is(err, context.DeadlineExceeded) || n != 0 {
+		t.Errorf("WaitReplicated(2, 1) without acks = %d, %v, want 0, %v", n, err, context.DeadlineExceeded)
+	}
+
+	done := make(chan int)
+	go func() {
+		n, err := d.WaitReplicated(context.Background(), 2, 2)
+		if err != nil {
+			t.Errorf("WaitReplicated(2, 2): %v", err)
+		}
+		done <- n
+	}()
+
+	for _, r := range []string{"r1", "r2"} {
+		if err := d.AckReplication(r, 2); err != nil {
+			t.Fatalf("AckReplication(%s, 2): %v", r, err)
+		}
+	}
+	if n := <-done; n != 2 {
+		t.Errorf("WaitReplicated(2, 2) = %d, want 2", n)
+	}
+}
+
+func TestMerkleRepair(t *testing.T) {
+	primary := createTempDb(t, false)
+	replica := createTempDb(t, true)
+	pinLog(t, primary)
+	for i := 0; i < 50; i++ {
+		setKey(t, primary, fmt.Sprint("key", i), fmt.Sprint(i))
+	}
+	if err := primary.SetKeyWithTTL(defaultNS, "ttl", []byte("x"), time.Hour); err != nil {
+		t.Fatalf("SetKeyWithTTL: %v", err)
+	}
+	changes, err := primary.ReadLog(0, 100)
+	if err != nil {
+		t.Fatalf("ReadLog: %v", err)
+	}
+	if err := replica.ApplyChanges(changes); err != nil {
+		t.Fatalf("ApplyChanges: %v", err)
+	}
+
+	diff := func() []int {
+		t.Helper()
+		want, err := primary.MerkleTree(defaultNS)
+		if err != nil {
+			t.Fatalf("MerkleTree on the primary: %v", err)
+		}
+		got, err := replica.MerkleTree(defaultNS)
+		if err != nil {
+			t.Fatalf("MerkleTree on the replica: %v", err)
+		}
+		var leaves []int
+		for i := 0; i < db.MerkleLeaves; i++ {
+			if !bytes.Equal(got.Node(db.MerkleLeaves+i), want.Node(db.MerkleLeaves+i)) {
+				leaves = append(leaves, i)
+			}
+		}
+		if (len(leaves) == 0) != bytes.Equal(got.Node(1), want.Node(1)) {
+			t.Fatalf("The roots do not match the leaves")
+		}
+		return leaves
+	}
+	if leaves := diff(); len(leaves) != 0 {
+		t.Fatalf("Leaves %v differ after replicating all changes", leaves)
+	}
+
+	// The replica misses a change, applies a wrong value and keeps a key
+	// that the primary does not have.
+	setKey(t, primary, "key1", "new")
+	seq := uint64(len(changes))
+	if err := replica.ApplyChanges([]db.Change{
+		{Seq: seq + 1, Namespace: defaultNS, Key: []byte("key2"), Value: []byte("wrong"), Version: 3},
+		{Seq: seq + 2, Namespace: defaultNS, Key: []byte("extra"), Value: []byte("x"), Version: 60},
+	}); err != nil {
+		t.Fatalf("ApplyChanges: %v", err)
+	}
+
+	leaves := diff()
+	if len(leaves) == 0 || len(leaves) > 3 {
+		t.Fatalf("Got %d differing leaves, want 1 to 3", len(leaves))
+	}
+	entries, err := primary.MerkleEntries(defaultNS, leaves)
+	if err != nil {
+		t.Fatalf("MerkleEntries: %v", err)
+	}
+	n, err := replica.Repair(defaultNS, leaves, entries)
+	if err != nil {
+		t.Fatalf("Repair: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("Repair repaired %d keys, want 3", n)
+	}
+	if leaves := diff(); len(leaves) != 0 {
+		t.Errorf("Leaves %v differ after the repair", leaves)
+	}
+	for key, want := range map[string]string{"key1": "new", "key2": "2", "extra": ""} {
+		if got, _, err := replica.GetKey(defaultNS, key); err != nil || string(got) != want {
+			t.Errorf("GetKey(%q) after the repair = %q, %v, want %q, nil", key, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Keys move between shards as changes: ExportKeys reads the keys of a
+// namespace as changes that set them, and ImportChanges applies those and
+// the changes of the replication log of another shard as local writes.
+
+// ExportKeys returns up to limit keys of a namespace that follow the key
+// after, or start at the first key if after is nil, and for which keep
+// returns true, as changes that set them. It also returns the last key
+// that was examined, or nil once all keys of the namespace were examined.
+func (d *DB) ExportKeys(ns string, after []byte, limit int, keep func(key string) bool) ([]Change, []byte, error) {
+	var res []Change
+	var last []byte
+	err := d.view(ns, func(tx Tx, n *namespace) error {
+		ttl := tx.Bucket(n.ttl)
+		c := tx.Bucket(n.data).Cursor()
+		k, v := c.First()
+		if after != nil {
+			k, v = c.Seek(after)
+			if k != nil && bytes.Equal(k, after) {
+				k, v = c.Next()
+			}
+		}
+
+		for ; k != nil; k, v = c.Next() {
+			if keep(string(k)) {
+				res = append(res, merkleChange(n.name, k, v, ttl.Get(k)))
+				if len(res) == limit {
+					last = copyByteSlice(k)
+					return nil
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, last, nil
+}
+
+// ImportChanges applies changes exported from another shard or read from
+// its replication log in a single transaction. Unlike ApplyChanges, they
+// are applied as local writes: keys get new local versions and the
+// changes are appended to the local log. Keys whose expiration time has
+// passed are deleted.
+func (d *DB) ImportChanges(changes []Change) error {
+	if d.readOnly.Load() {
+		return errors.New("read-only mode")
+	}
+
+	now := time.Now()
+	return d.commit(func(tx Tx) error {
+		for i := range changes {
+			c := &changes[i]
+			n, err := lookupNamespace(c.Namespace)
+			if err != nil {
+				return err
+			}
+
+			if c.Drop {
+				if n.name == DefaultNamespace || !n.exists(tx) {
+					continue
+				}
+				if err := n.drop(tx); err != nil {
+					return err
+				}
+				if err := appendLog(tx, &Change{Namespace: n.name, Drop: true}); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := n.create(tx); err != nil {
+				return err
+			}
+			var ttl time.Duration
+			if c.ExpiresAt != 0 {
+				ttl = time.Unix(0, c.ExpiresAt).Sub(now)
+			}
+			if c.Deleted || c.ExpiresAt != 0 && ttl <= 0 {
+				err = d.deleteKey(tx, n, c.Key)
+			} else {
+				err = d.setKey(tx, n, c.Key, c.Value, ttl)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AdoptKeys is like ImportChanges for changes exported from a shard that
+// no longer owns their keys, but keeps the keys that already exist, which
+// were written since the keys moved. It returns the number of keys set.
+func (d *DB) AdoptKeys(changes []Change) (int, error) {
+	if d.readOnly.Load() {
+		return 0, errors.New("read-only mode")
+	}
+
+	now := time.Now()
+	var adopted int
+	err := d.commit(func(tx Tx) error {
+		adopted = 0
+		for i := range changes {
+			c := &changes[i]
+			n, err := lookupNamespace(c.Namespace)
+			if err != nil {
+				return err
+			}
+			if c.Drop || c.Deleted {
+				return fmt.Errorf("key %q: only keys that are set can be adopted", c.Key)
+			}
+
+			var ttl time.Duration
+			if c.ExpiresAt != 0 {
+				if ttl = time.Unix(0, c.ExpiresAt).Sub(now); ttl <= 0 {
+					continue
+				}
+			}
+			if err := n.create(tx); err != nil {
+				return err
+			}
+			if version, _ := n.getRecord(tx, c.Key, now); version != 0 {
+				continue
+			}
+			if err := d.setKey(tx, n, c.Key, c.Value, ttl); err != nil {
+				return err
+			}
+			adopted++
+		}
+		return nil
+	})
+	return adopted, err
+}
+
+// DeleteExported deletes the keys exported by ExportKeys once their new
+// owner has them. Keys whose version changed since they were exported are
+// kept. Unlike DeleteExtraKeys, the deletions are added to the replication
+// log. It returns the number of keys deleted.
+func (d *DB) DeleteExported(changes []Change) (int, error) {
+	if d.readOnly.Load() {
+		return 0, errors.New("read-only mode")
+	}
+
+	var deleted int
+	err := d.commit(func(tx Tx) error {
+		deleted = 0
+		for i := range changes {
+			c := &changes[i]
+			n, err := lookupNamespace(c.Namespace)
+			if err != nil {
+				return err
+			}
+			if !n.exists(tx) {
+				continue
+			}
+			if version, _ := decodeRecord(tx.Bucket(n.data).Get(c.Key)); version == 0 || version != c.Version {
+				continue
+			}
+			if err := d.deleteKey(tx, n, c.Key); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	return deleted, err
+}
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"time"
+)
+
+// historyBucket keeps the previous versions of the keys of the default
+// namespace; other namespaces have their own history bucket. Entries are keyed by
+// the length-prefixed key followed by the big-endian version, so that all
+// versions of a key are stored next to each other in ascending order.
+var historyBucket = []byte("history")
+
+// Version is a value of a key at a given version.
+type Version struct {
+	Version uint64
+	Value   []byte
+}
+
+// SetHistoryLimit sets the number of previous versions kept for every key.
+// Zero, the default, disables the history.
+func (d *DB) SetHistoryLimit(n int) {
+	d.historyLimit.Store(int64(n))
+}
+
+// historyPrefix returns the prefix shared by all history entries of key.
+func historyPrefix(key []byte) []byte {
+	res := binary.AppendUvarint(nil, uint64(len(key)))
+	return append(res, key...)
+}
+
+// historyKey returns the key of the history entry for the given version.
+func historyKey(key []byte, version uint64) []byte {
+	return binary.BigEndian.AppendUint64(historyPrefix(key), version)
+}
+
+// archive copies the current value of key into the history and drops the
+// oldest versions beyond the history limit.
+func (d *DB) archive(tx Tx, n *namespace, key []byte) error {
+	limit := int(d.historyLimit.Load())
+	if limit <= 0 {
+		return nil
+	}
+
+	cur := tx.Bucket(n.data).Get(key)
+	if cur == nil {
+		return nil
+	}
+	version, value := decodeRecord(cur)
+
+	b := tx.Bucket(n.history)
+	if err := b.Put(historyKey(key, version), value); err != nil {
+		return err
+	}
+
+	var versions [][]byte
+	prefix := historyPrefix(key)
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		versions = append(versions, copyByteSlice(k))
+	}
+
+	for len(versions) > limit {
+		if err := b.Delete(versions[0]); err != nil {
+			return err
+		}
+		versions = versions[1:]
+	}
+	return nil
+}
+
+// clearHistory deletes all previous versions of key.
+func (n *namespace) clearHistory(tx Tx, key []byte) error {
+	var keys [][]byte
+	b := tx.Bucket(n.history)
+	prefix := historyPrefix(key)
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, copyByteSlice(k))
+	}
+
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetKeyAtVersion gets the value that the key had at the given version,
+// either from the current value or from the history. Returns nil if the
+// version is unknown.
+func (d *DB) GetKeyAtVersion(ns, key string, version uint64) ([]byte, error) {
+	var result []byte
+	err := d.view(ns, func(tx Tx, n *namespace) error {
+		if cur, value := n.getRecord(tx, []byte(key), time.Now()); cur == version {
+			result = value
+			return nil
+		}
+		result = copyByteSlice(tx.Bucket(n.history).Get(historyKey([]byte(key), version)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// History returns the current and the previous versions of the key, newest
+// first.
+func (d *DB) History(ns, key string) ([]Version, error) {
+	var res []Version
+	err := d.view(ns, func(tx Tx, n *namespace) error {
+		prefix := historyPrefix([]byte(key))
+		c := tx.Bucket(n.history).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			res = append(res, Version{
+				Version: binary.BigEndian.Uint64(k[len(prefix):]),
+				Value:   copyByteSlice(v),
+			})
+		}
+		slices.Reverse(res)
+
+		if version, value := n.getRecord(tx, []byte(key), time.Now()); version != 0 {
+			res = append([]Version{{Version: version, Value: value}}, res...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,759 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// LSMOptions configures the LSM storage engine. Zero fields use the
+// defaults.
+type LSMOptions struct {
+	// MemtableSize is the approximate size in bytes at which the memtable
+	// is flushed to a segment file.
+	MemtableSize int
+	// CompactionThreshold is the number of segment files that triggers a
+	// compaction of all of them into a single one.
+	CompactionThreshold int
+	// SyncWrites syncs the write-ahead log to disk on every commit. Without
+	// it, committed writes survive a crash of the process but may be lost
+	// on a crash of the machine.
+	SyncWrites bool
+}
+
+const (
+	defaultMemtableSize        = 4 << 20
+	defaultCompactionThreshold = 4
+
+	lsmManifest = "MANIFEST"
+)
+
+// lsmStorage is a log-structured merge-tree Storage. Commits are appended
+// to a write-ahead log and applied to an in-memory skiplist, the memtable.
+// Full memtables are flushed in the background to immutable sorted segment
+// files, which are eventually compacted into a single file. Reads merge the
+// memtables and the segments, newest first.
+//
+// All buckets share one sorted key space: a bucket named n is stored as
+// the key "b"+n holding its sequence, and its keys k as
+// "d"+uvarint(len(n))+n+k.
+//
+// Like the other engines, writers are serialized and exclude readers, but
+// a commit only costs an append to the log instead of rewriting B+tree
+// pages.
+type lsmStorage struct {
+	dir  string
+	opts LSMOptions
+
+	mu sync.RWMutex
+	// mem receives the writes and is logged to the current wal.
+	mem *memtable
+	// imm are full memtables waiting to be flushed, oldest first.
+	imm []*memtable
+	// segments are ordered from oldest to newest.
+	segments []*segment
+	wal      *os.File
+	// walSize is the size of the wal after the last committed batch.
+	walSize int64
+	// failed is set once the wal may hold a partial batch that could not
+	// be removed. Batches appended after it would be lost on recovery, so
+	// all later commits fail.
+	failed error
+	nextID uint64
+
+	work chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+type memtable struct {
+	list  *skiplist
+	walID uint64
+}
+
+// OpenLSM opens or creates an LSM storage in the directory dir.
+func OpenLSM(dir string, opts LSMOptions) (Storage, error) {
+	if opts.MemtableSize <= 0 {
+		opts.MemtableSize = defaultMemtableSize
+	}
+	if opts.CompactionThreshold <= 1 {
+		opts.CompactionThreshold = defaultCompactionThreshold
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &lsmStorage{
+		dir:  dir,
+		opts: opts,
+		work: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+	if err := s.recover(); err != nil {
+		for _, seg := range s.segments {
+			seg.close()
+		}
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.backgroundLoop()
+	s.signal()
+
+	return s, nil
+}
+
+func (s *lsmStorage) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("seg-%016d.sst", id))
+}
+
+func (s *lsmStorage) walPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("wal-%016d.log", id))
+}
+
+// recover loads the segments listed in the manifest, replays the
+// write-ahead logs into a new segment and starts a new log.
+func (s *lsmStorage) recover() error {
+	names, err := s.readManifest()
+	if err != nil {
+		return err
+	}
+	live := make(map[string]bool)
+	for _, name := range names {
+		seg, err := openSegment(filepath.Join(s.dir, name))
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+		live[name] = true
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	var wals []string
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// Leftover of an interrupted flush or compaction.
+			if err := os.Remove(filepath.Join(s.dir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		id, ok := parseFileID(name, "wal-", ".log")
+		if ok {
+			wals = append(wals, name)
+		} else if id, ok = parseFileID(name, "seg-", ".sst"); ok && !live[name] {
+			// Input of a compaction whose result is in the manifest.
+			if err := os.Remove(filepath.Join(s.dir, name)); err != nil {
+				return err
+			}
+		}
+		if ok && id >= s.nextID {
+			s.nextID = id + 1
+		}
+	}
+	sort.Strings(wals)
+
+	list := newSkiplist()
+	for _, name := range wals {
+		if err := replayWAL(filepath.Join(s.dir, name), list); err != nil {
+			return fmt.Errorf("replaying %q: %w", name, err)
+		}
+	}
+
+	if list.size > 0 {
+		seg, err := writeSegment(s.segmentPath(s.nextID), &skiplistIterator{l: list}, false)
+		if err != nil {
+			return err
+		}
+		s.nextID++
+		s.segments = append(s.segments, seg)
+		if err := s.writeManifest(); err != nil {
+			return err
+		}
+	}
+	for _, name := range wals {
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil {
+			return err
+		}
+	}
+
+	return s.newMemtable()
+}
+
+// parseFileID returns the ID of a segment or log file name.
+func parseFileID(name, prefix, suffix string) (uint64, bool) {
+	name, ok := strings.CutPrefix(name, prefix)
+	if !ok {
+		return 0, false
+	}
+	name, ok = strings.CutSuffix(name, suffix)
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(name, 10, 64)
+	return id, err == nil
+}
+
+// newMemtable starts a new memtable with its own write-ahead log. The
+// previous memtable, if any, is queued for flushing.
+func (s *lsmStorage) newMemtable() error {
+	id := s.nextID
+	f, err := os.OpenFile(s.walPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.nextID++
+
+	if s.mem != nil {
+		if err := s.wal.Close(); err != nil {
+			log.Printf("lsm: closing %q: %v", s.wal.Name(), err)
+		}
+		s.imm = append(s.imm, s.mem)
+		s.signal()
+	}
+	s.wal = f
+	s.walSize = info.Size()
+	s.mem = &memtable{list: newSkiplist(), walID: id}
+	return nil
+}
+
+func (s *lsmStorage) readManifest() ([]string, error) {
+	b, err := os.ReadFile(filepath.Join(s.dir, lsmManifest))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(b)), nil
+}
+
+// writeManifest atomically replaces the list of live segments.
+func (s *lsmStorage) writeManifest() error {
+	var sb strings.Builder
+	for _, seg := range s.segments {
+		sb.WriteString(filepath.Base(seg.path))
+		sb.WriteByte('\n')
+	}
+
+	path := filepath.Join(s.dir, lsmManifest)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(sb.String()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// The write-ahead log is a sequence of committed batches:
+//
+//	batch: uint32 payload length | uint32 CRC-32 of payload | payload
+//	payload: ops, each deleted byte | uvarint key length | key | uvarint value length | value
+//
+// A torn batch at the end of the log is ignored.
+func encodeBatch(ops []lsmOp) []byte {
+	payload := make([]byte, 8)
+	for _, op := range ops {
+		if op.entry.deleted {
+			payload = append(payload, 1)
+		} else {
+			payload = append(payload, 0)
+		}
+		payload = binary.AppendUvarint(payload, uint64(len(op.key)))
+		payload = append(payload, op.key...)
+		payload = binary.AppendUvarint(payload, uint64(len(op.entry.value)))
+		payload = append(payload, op.entry.value...)
+	}
+	binary.BigEndian.PutUint32(payload, uint32(len(payload)-8))
+	binary.BigEndian.PutUint32(payload[4:], crc32.ChecksumIEEE(payload[8:]))
+	return payload
+}
+
+func replayWAL(path string, list *skiplist) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			return nil
+		}
+
+		pr := bufio.NewReader(bytes.NewReader(payload))
+		for {
+			flag, err := pr.ReadByte()
+			if err == io.EOF {
+				break
+			}
+			key, err := readBytes(pr)
+			if err != nil {
+				return errCorruptSegment
+			}
+			value, err := readBytes(pr)
+			if err != nil {
+				return errCorruptSegment
+			}
+			list.set(string(key), lsmEntry{value: value, deleted: flag == 1})
+		}
+	}
+}
+
+func (s *lsmStorage) signal() {
+	select {
+	case s.work <- struct{}{}:
+	default:
+	}
+}
+
+// backgroundLoop flushes full memtables and compacts segments.
+func (s *lsmStorage) backgroundLoop() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.work:
+		}
+
+		for {
+			flushed, err := s.flush()
+			if err != nil {
+				log.Printf("lsm: flush: %v", err)
+			}
+			if !flushed || err != nil {
+				break
+			}
+		}
+
+		if err := s.compact(); err != nil {
+			log.Printf("lsm: compact: %v", err)
+		}
+	}
+}
+
+// flush writes the oldest immutable memtable to a segment file.
+func (s *lsmStorage) flush() (flushed bool, err error) {
+	s.mu.Lock()
+	if len(s.imm) == 0 {
+		s.mu.Unlock()
+		return false, nil
+	}
+	m := s.imm[0]
+	id := s.nextID
+	s.nextID++
+	s.mu.Unlock()
+
+	seg, err := writeSegment(s.segmentPath(id), &skiplistIterator{l: m.list}, false)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	s.segments = append(s.segments, seg)
+	if err := s.writeManifest(); err != nil {
+		s.segments = s.segments[:len(s.segments)-1]
+		s.mu.Unlock()
+		seg.close()
+		os.Remove(seg.path)
+		return false, err
+	}
+	s.imm = s.imm[1:]
+	s.mu.Unlock()
+
+	return true, os.Remove(s.walPath(m.walID))
+}
+
+// compact merges all segments into one once there are enough of them.
+// Because the merged segments include the oldest one, tombstones are
+// dropped.
+func (s *lsmStorage) compact() error {
+	s.mu.Lock()
+	if len(s.segments) < s.opts.CompactionThreshold {
+		s.mu.Unlock()
+		return nil
+	}
+	old := append([]*segment{}, s.segments...)
+	id := s.nextID
+	s.nextID++
+	s.mu.Unlock()
+
+	m := &mergeIterator{}
+	for i := len(old) - 1; i >= 0; i-- {
+		m.its = append(m.its, old[i].iterator())
+	}
+	seg, err := writeSegment(s.segmentPath(id), m, true)
+	if err != nil {
+		return err
+	}
+
+	// Segments flushed in the meantime were appended after the old ones.
+	s.mu.Lock()
+	prev := s.segments
+	s.segments = append([]*segment{seg}, s.segments[len(old):]...)
+	if err := s.writeManifest(); err != nil {
+		s.segments = prev
+		s.mu.Unlock()
+		seg.close()
+		os.Remove(seg.path)
+		return err
+	}
+	s.mu.Unlock()
+
+	for _, seg := range old {
+		seg.close()
+		if err := os.Remove(seg.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *lsmStorage) View(fn func(Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tx := &lsmTx{s: s}
+	err := fn(tx)
+	if tx.err != nil {
+		return tx.err
+	}
+	return err
+}
+
+func (s *lsmStorage) Update(fn func(Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failed != nil {
+		return s.failed
+	}
+
+	tx := &lsmTx{s: s, writable: true}
+	if err := fn(tx); err != nil || tx.err != nil {
+		tx.rollback()
+		if tx.err != nil {
+			return tx.err
+		}
+		return err
+	}
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	batch := encodeBatch(tx.ops)
+	_, err := s.wal.Write(batch)
+	if err == nil && s.opts.SyncWrites {
+		err = s.wal.Sync()
+	}
+	if err != nil {
+		tx.rollback()
+		// Recovery stops at the first torn batch, so the rest of the
+		// batch must go before anything else is appended.
+		if terr := s.wal.Truncate(s.walSize); terr != nil {
+			s.failed = fmt.Errorf("lsm: wal %q may hold a partial batch: %w", s.wal.Name(), terr)
+			log.Print(s.failed)
+		}
+		return err
+	}
+	s.walSize += int64(len(batch))
+
+	// The batch is committed; failing to rotate the memtable only delays
+	// the flush until the next commit.
+	if s.mem.list.size >= s.opts.MemtableSize {
+		if err := s.newMemtable(); err != nil {
+			log.Printf("lsm: rotating memtable: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *lsmStorage) Close() error {
+	close(s.stop)
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.wal.Sync()
+	if cerr := s.wal.Close(); err == nil {
+		err = cerr
+	}
+	for _, seg := range s.segments {
+		if cerr := seg.close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// get returns the newest entry of key. The caller must hold s.mu.
+func (s *lsmStorage) get(key string) (lsmEntry, bool, error) {
+	if e, ok := s.mem.list.get(key); ok {
+		return e, true, nil
+	}
+	for i := len(s.imm) - 1; i >= 0; i-- {
+		if e, ok := s.imm[i].list.get(key); ok {
+			return e, true, nil
+		}
+	}
+	for i := len(s.segments) - 1; i >= 0; i-- {
+		e, ok, err := s.segments[i].get(key)
+		if err != nil {
+			return lsmEntry{}, false, fmt.Errorf("lsm: reading %q: %w", s.segments[i].path, err)
+		}
+		if ok {
+			return e, true, nil
+		}
+	}
+	return lsmEntry{}, false, nil
+}
+
+// iterator returns a merge of all memtables and segments. The caller must
+// hold s.mu.
+func (s *lsmStorage) iterator() *mergeIterator {
+	m := &mergeIterator{its: []lsmIterator{&skiplistIterator{l: s.mem.list}}}
+	for i := len(s.imm) - 1; i >= 0; i-- {
+		m.its = append(m.its, &skiplistIterator{l: s.imm[i].list})
+	}
+	for i := len(s.segments) - 1; i >= 0; i-- {
+		m.its = append(m.its, s.segments[i].iterator())
+	}
+	return m
+}
+
+type lsmOp struct {
+	key   string
+	entry lsmEntry
+}
+
+// lsmTx applies writes directly to the memtable and remembers how to undo
+// them until the batch is committed to the write-ahead log. Buckets cannot
+// return errors from reads, so the first error reading a segment is kept in
+// err and fails the transaction.
+type lsmTx struct {
+	s        *lsmStorage
+	writable bool
+	ops      []lsmOp
+	undo     []func()
+	err      error
+}
+
+func (t *lsmTx) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
+	}
+}
+
+func (t *lsmTx) set(key string, e lsmEntry) error {
+	if !t.writable {
+		return errTxNotWritable
+	}
+
+	list := t.s.mem.list
+	old, existed := list.get(key)
+	list.set(key, e)
+	t.ops = append(t.ops, lsmOp{key: key, entry: e})
+	t.undo = append(t.undo, func() {
+		if existed {
+			list.set(key, old)
+		} else {
+			list.remove(key)
+		}
+	})
+	return nil
+}
+
+// fail records the first read error of the transaction.
+func (t *lsmTx) fail(err error) {
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+func (t *lsmTx) get(key string) ([]byte, bool) {
+	e, ok, err := t.s.get(key)
+	if err != nil {
+		t.fail(err)
+		return nil, false
+	}
+	if !ok || e.deleted {
+		return nil, false
+	}
+	return e.value, true
+}
+
+func lsmBucketKey(name []byte) string {
+	return "b" + string(name)
+}
+
+func lsmDataPrefix(name []byte) string {
+	return "d" + string(binary.AppendUvarint(nil, uint64(len(name)))) + string(name)
+}
+
+func (t *lsmTx) Bucket(name []byte) Bucket {
+	if _, ok := t.get(lsmBucketKey(name)); !ok {
+		return nil
+	}
+	return &lsmBucket{tx: t, key: lsmBucketKey(name), prefix: lsmDataPrefix(name)}
+}
+
+func (t *lsmTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if b := t.Bucket(name); b != nil {
+		return b, nil
+	}
+	if err := t.set(lsmBucketKey(name), lsmEntry{value: make([]byte, 8)}); err != nil {
+		return nil, err
+	}
+	return t.Bucket(name), nil
+}
+
+func (t *lsmTx) DeleteBucket(name []byte) error {
+	if !t.writable {
+		return errTxNotWritable
+	}
+	b := t.Bucket(name)
+	if b == nil {
+		return errBucketNotFound
+	}
+
+	var keys [][]byte
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return t.set(lsmBucketKey(name), lsmEntry{deleted: true})
+}
+
+type lsmBucket struct {
+	tx *lsmTx
+	// key is the key holding the bucket's sequence and prefix the prefix
+	// of the bucket's keys.
+	key    string
+	prefix string
+}
+
+func (b *lsmBucket) Get(key []byte) []byte {
+	v, _ := b.tx.get(b.prefix + string(key))
+	return v
+}
+
+func (b *lsmBucket) Put(key, value []byte) error {
+	return b.tx.set(b.prefix+string(key), lsmEntry{value: append([]byte{}, value...)})
+}
+
+func (b *lsmBucket) Delete(key []byte) error {
+	return b.tx.set(b.prefix+string(key), lsmEntry{deleted: true})
+}
+
+func (b *lsmBucket) Cursor() Cursor {
+	return &lsmCursor{tx: b.tx, m: b.tx.s.iterator(), prefix: b.prefix}
+}
+
+func (b *lsmBucket) Sequence() uint64 {
+	v, _ := b.tx.get(b.key)
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func (b *lsmBucket) SetSequence(v uint64) error {
+	return b.tx.set(b.key, lsmEntry{value: binary.BigEndian.AppendUint64(nil, v)})
+}
+
+func (b *lsmBucket) NextSequence() (uint64, error) {
+	seq := b.Sequence() + 1
+	if err := b.SetSequence(seq); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// lsmCursor iterates over the live keys of a bucket.
+type lsmCursor struct {
+	tx     *lsmTx
+	m      *mergeIterator
+	prefix string
+}
+
+// current skips tombstones and returns the current key unless the
+// iterator left the bucket.
+func (c *lsmCursor) current() (key, value []byte) {
+	for c.m.valid() && strings.HasPrefix(c.m.key(), c.prefix) && c.m.entry().deleted {
+		c.m.next()
+	}
+	if err := c.m.err(); err != nil {
+		c.tx.fail(fmt.Errorf("lsm: cursor: %w", err))
+	}
+	if !c.m.valid() || !strings.HasPrefix(c.m.key(), c.prefix) {
+		return nil, nil
+	}
+	return []byte(c.m.key()[len(c.prefix):]), c.m.entry().value
+}
+
+func (c *lsmCursor) First() (key, value []byte) {
+	c.m.seek(c.prefix)
+	return c.current()
+}
+
+func (c *lsmCursor) Seek(seek []byte) (key, value []byte) {
+	c.m.seek(c.prefix + string(seek))
+	return c.current()
+}
+
+func (c *lsmCursor) Next() (key, value []byte) {
+	if c.m.valid() {
+		c.m.next()
+	}
+	return c.current()
+}
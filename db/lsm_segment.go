@@ -0,0 +1,326 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// A segment is an immutable file of sorted entries written by the LSM
+// engine when a memtable is flushed or segments are compacted. It consists
+// of the records, a sparse index with the key and offset of every
+// segmentIndexInterval-th record and a footer:
+//
+//	record: deleted byte | uvarint key length | key | uvarint value length | value
+//	index:  uvarint count | count * (uvarint key length | key | uvarint offset)
+//	footer: index offset uint64 | segmentMagic uint64
+const (
+	segmentIndexInterval = 16
+	segmentFooterSize    = 16
+	segmentMagic         = 0x6a6462676f4c534d // "jdbgoLSM"
+)
+
+var errCorruptSegment = errors.New("corrupt segment")
+
+type segmentIndexEntry struct {
+	key    string
+	offset int64
+}
+
+type segment struct {
+	path    string
+	f       *os.File
+	index   []segmentIndexEntry
+	dataEnd int64
+}
+
+// lsmIterator iterates over the entries of a memtable, a segment or a
+// merge of them in key order.
+type lsmIterator interface {
+	// seek moves to the first entry whose key is not less than key.
+	seek(key string)
+	valid() bool
+	key() string
+	entry() lsmEntry
+	next()
+	// err returns the I/O error that invalidated the iterator, if any.
+	err() error
+}
+
+// writeSegment writes all entries of it to a new segment file at path and
+// opens it. Tombstones are skipped if dropDeleted is set, which is only
+// correct if there is no older data that they could shadow.
+func writeSegment(path string, it lsmIterator, dropDeleted bool) (*segment, error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	var offset int64
+	var index []segmentIndexEntry
+	var buf []byte
+	count := 0
+
+	for it.seek(""); it.valid(); it.next() {
+		e := it.entry()
+		if e.deleted && dropDeleted {
+			continue
+		}
+		if count%segmentIndexInterval == 0 {
+			index = append(index, segmentIndexEntry{key: it.key(), offset: offset})
+		}
+		count++
+
+		buf = buf[:0]
+		if e.deleted {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(it.key())))
+		buf = append(buf, it.key()...)
+		buf = binary.AppendUvarint(buf, uint64(len(e.value)))
+		buf = append(buf, e.value...)
+		if _, err := w.Write(buf); err != nil {
+			return nil, err
+		}
+		offset += int64(len(buf))
+	}
+	if err := it.err(); err != nil {
+		return nil, err
+	}
+
+	buf = binary.AppendUvarint(buf[:0], uint64(len(index)))
+	for _, e := range index {
+		buf = binary.AppendUvarint(buf, uint64(len(e.key)))
+		buf = append(buf, e.key...)
+		buf = binary.AppendUvarint(buf, uint64(e.offset))
+	}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(offset))
+	buf = binary.BigEndian.AppendUint64(buf, segmentMagic)
+	if _, err := w.Write(buf); err != nil {
+		return nil, err
+	}
+
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	return openSegment(path)
+}
+
+// openSegment opens a segment file and loads its index.
+func openSegment(path string) (*segment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := loadSegment(path, f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("segment %q: %w", path, err)
+	}
+	return s, nil
+}
+
+func loadSegment(path string, f *os.File) (*segment, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := st.Size()
+	if size < segmentFooterSize {
+		return nil, errCorruptSegment
+	}
+
+	footer := make([]byte, segmentFooterSize)
+	if _, err := f.ReadAt(footer, size-segmentFooterSize); err != nil {
+		return nil, err
+	}
+	dataEnd := int64(binary.BigEndian.Uint64(footer))
+	if binary.BigEndian.Uint64(footer[8:]) != segmentMagic || dataEnd > size-segmentFooterSize {
+		return nil, errCorruptSegment
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(f, dataEnd, size-segmentFooterSize-dataEnd))
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errCorruptSegment
+	}
+
+	index := make([]segmentIndexEntry, 0, count)
+	for i := uint64(0); i < count; i++ {
+		key, err := readBytes(r)
+		if err != nil {
+			return nil, errCorruptSegment
+		}
+		offset, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, errCorruptSegment
+		}
+		index = append(index, segmentIndexEntry{key: string(key), offset: int64(offset)})
+	}
+
+	return &segment{path: path, f: f, index: index, dataEnd: dataEnd}, nil
+}
+
+// readBytes reads a uvarint length followed by that many bytes.
+func readBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (s *segment) close() error {
+	return s.f.Close()
+}
+
+func (s *segment) iterator() *segmentIterator {
+	return &segmentIterator{s: s}
+}
+
+// get returns the entry of key, if the segment contains it.
+func (s *segment) get(key string) (lsmEntry, bool, error) {
+	it := s.iterator()
+	it.seek(key)
+	if it.err() != nil {
+		return lsmEntry{}, false, it.err()
+	}
+	if !it.valid() || it.key() != key {
+		return lsmEntry{}, false, nil
+	}
+	return it.entry(), true, nil
+}
+
+// segmentIterator reads the records of a segment sequentially, starting
+// from the closest index entry.
+type segmentIterator struct {
+	s     *segment
+	r     *bufio.Reader
+	k     string
+	e     lsmEntry
+	ok    bool
+	ioErr error
+}
+
+func (it *segmentIterator) seek(key string) {
+	it.ok = false
+	if len(it.s.index) == 0 {
+		return
+	}
+
+	i := sort.Search(len(it.s.index), func(i int) bool { return it.s.index[i].key > key }) - 1
+	if i < 0 {
+		i = 0
+	}
+	off := it.s.index[i].offset
+	it.r = bufio.NewReader(io.NewSectionReader(it.s.f, off, it.s.dataEnd-off))
+	for it.next(); it.ok && it.k < key; it.next() {
+	}
+}
+
+func (it *segmentIterator) next() {
+	it.ok = false
+	if it.r == nil {
+		return
+	}
+
+	flag, err := it.r.ReadByte()
+	if err == io.EOF {
+		it.r = nil
+		return
+	}
+	if err != nil {
+		it.ioErr = err
+		return
+	}
+	key, err := readBytes(it.r)
+	if err != nil {
+		it.ioErr = err
+		return
+	}
+	value, err := readBytes(it.r)
+	if err != nil {
+		it.ioErr = err
+		return
+	}
+
+	it.k = string(key)
+	it.e = lsmEntry{value: value, deleted: flag == 1}
+	it.ok = true
+}
+
+func (it *segmentIterator) valid() bool     { return it.ok }
+func (it *segmentIterator) key() string     { return it.k }
+func (it *segmentIterator) entry() lsmEntry { return it.e }
+func (it *segmentIterator) err() error      { return it.ioErr }
+
+// mergeIterator merges several iterators. Its iterators are ordered from
+// newest to oldest: if several of them contain the same key, the entry of
+// the newest one wins.
+type mergeIterator struct {
+	its []lsmIterator
+	cur int
+}
+
+func (m *mergeIterator) settle() {
+	m.cur = -1
+	for i, it := range m.its {
+		if it.valid() && (m.cur < 0 || it.key() < m.its[m.cur].key()) {
+			m.cur = i
+		}
+	}
+}
+
+func (m *mergeIterator) seek(key string) {
+	for _, it := range m.its {
+		it.seek(key)
+	}
+	m.settle()
+}
+
+func (m *mergeIterator) next() {
+	k := m.key()
+	for _, it := range m.its {
+		if it.valid() && it.key() == k {
+			it.next()
+		}
+	}
+	m.settle()
+}
+
+func (m *mergeIterator) valid() bool     { return m.cur >= 0 }
+func (m *mergeIterator) key() string     { return m.its[m.cur].key() }
+func (m *mergeIterator) entry() lsmEntry { return m.its[m.cur].entry() }
+
+func (m *mergeIterator) err() error {
+	for _, it := range m.its {
+		if err := it.err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package db_test
+
+import (
+	"distributed-db/db"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLSMRecovery(t *testing.T) {
+	dir := t.TempDir()
+	bucket := []byte("bucket")
+	opts := db.LSMOptions{MemtableSize: 256, CompactionThreshold: 2}
+
+	s, err := db.OpenLSM(dir, opts)
+	if err != nil {
+		t.Fatalf("OpenLSM(%q): %v", dir, err)
+	}
+
+	// Enough writes to flush many memtables and trigger compactions.
+	for i := 0; i < 500; i++ {
+		err := s.Update(func(tx db.Tx) error {
+			b, err := tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(fmt.Sprintf("key-%03d", i%100)), []byte(fmt.Sprintf("value-%d", i))); err != nil {
+				return err
+			}
+			if i%100 >= 90 {
+				return b.Delete([]byte(fmt.Sprintf("key-%03d", i%100)))
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Update %d: %v", i, err)
+		}
+	}
+
+	// Give the background flushes and compactions a chance to run.
+	time.Sleep(100 * time.Millisecond)
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "seg-*.sst"))
+	if len(segments) == 0 {
+		t.Errorf("No segment files in %q after many writes", dir)
+	}
+
+	s, err = db.OpenLSM(dir, opts)
+	if err != nil {
+		t.Fatalf("OpenLSM(%q) after close: %v", dir, err)
+	}
+	defer s.Close()
+
+	err = s.View(func(tx db.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			t.Fatalf("Bucket %q missing after reopening", bucket)
+		}
+
+		n := 0
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var i int
+			fmt.Sscanf(string(k), "key-%03d", &i)
+			if want := fmt.Sprintf("value-%d", 400+i); string(v) != want {
+				t.Errorf("Unexpected value for %q: got %q, want %q", k, v, want)
+			}
+			n++
+		}
+		if n != 90 {
+			t.Errorf("Unexpected number of keys: got %d, want 90", n)
+		}
+
+		if v := b.Get([]byte("key-095")); v != nil {
+			t.Errorf("Get(%q) of deleted key: got %q, want nil", "key-095", v)
+		}
+		if v := b.Get([]byte("key-042")); string(v) != "value-442" {
+			t.Errorf("Get(%q): got %q, want %q", "key-042", v, "value-442")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "MANIFEST")); err != nil {
+		t.Errorf("Stat(MANIFEST): %v", err)
+	}
+}
+
+func TestLSMReadError(t *testing.T) {
+	dir := t.TempDir()
+	bucket := []byte("bucket")
+	opts := db.LSMOptions{MemtableSize: 64}
+
+	s, err := db.OpenLSM(dir, opts)
+	if err != nil {
+		t.Fatalf("OpenLSM(%q): %v", dir, err)
+	}
+	err = s.Update(func(tx db.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("a"), make([]byte, 100))
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	// Give the background flush a chance to run.
+	time.Sleep(100 * time.Millisecond)
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Overwrite the length of the first key with a varint that overflows.
+	segments, _ := filepath.Glob(filepath.Join(dir, "seg-*.sst"))
+	if len(segments) == 0 {
+		t.Fatalf("No segment files in %q after a flush", dir)
+	}
+	f, err := os.OpenFile(segments[0], os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 1)
+	f.Close()
+	if err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+
+	s, err = db.OpenLSM(dir, opts)
+	if err != nil {
+		t.Fatalf("OpenLSM(%q) after close: %v", dir, err)
+	}
+	defer s.Close()
+
+	// The error fails the transaction instead of reading as a missing key.
+	err = s.View(func(tx db.Tx) error {
+		if b := tx.Bucket(bucket); b != nil {
+			b.Get([]byte("a"))
+		}
+		return nil
+	})
+	if err == nil {
+		t.Errorf("View of a corrupt segment: got nil error")
+	}
+	err = s.Update(func(tx db.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+	if err == nil {
+		t.Errorf("Update of a corrupt segment: got nil error")
+	}
+}
@@ -0,0 +1,231 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var (
+	errTxNotWritable  = errors.New("tx not writable")
+	errBucketNotFound = errors.New("bucket not found")
+)
+
+// memoryStorage is a Storage that keeps everything in memory. It is meant
+// for tests and for evaluating the rest of the system without disk I/O.
+// Writers are serialized and exclude readers; an Update that fails is
+// rolled back using an undo log.
+type memoryStorage struct {
+	mu      sync.RWMutex
+	buckets map[string]*memBucket
+}
+
+// NewMemoryStorage returns an empty in-memory Storage.
+func NewMemoryStorage() Storage {
+	return &memoryStorage{buckets: make(map[string]*memBucket)}
+}
+
+func (s *memoryStorage) View(fn func(Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return fn(&memTx{s: s})
+}
+
+func (s *memoryStorage) Update(fn func(Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &memTx{s: s, writable: true}
+	if err := fn(tx); err != nil {
+		tx.rollback()
+		return err
+	}
+	return nil
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
+
+// memBucket is a sorted map from keys to values.
+type memBucket struct {
+	keys   []string
+	values map[string][]byte
+	seq    uint64
+}
+
+func newMemBucket() *memBucket {
+	return &memBucket{values: make(map[string][]byte)}
+}
+
+// search returns the index of the first key that is not less than key.
+func (b *memBucket) search(key string) int {
+	return sort.SearchStrings(b.keys, key)
+}
+
+func (b *memBucket) put(key string, value []byte) {
+	if _, ok := b.values[key]; !ok {
+		i := b.search(key)
+		b.keys = append(b.keys, "")
+		copy(b.keys[i+1:], b.keys[i:])
+		b.keys[i] = key
+	}
+	b.values[key] = value
+}
+
+func (b *memBucket) delete(key string) {
+	if _, ok := b.values[key]; !ok {
+		return
+	}
+	i := b.search(key)
+	b.keys = append(b.keys[:i], b.keys[i+1:]...)
+	delete(b.values, key)
+}
+
+type memTx struct {
+	s        *memoryStorage
+	writable bool
+	undo     []func()
+}
+
+func (t *memTx) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
+	}
+}
+
+func (t *memTx) Bucket(name []byte) Bucket {
+	b, ok := t.s.buckets[string(name)]
+	if !ok {
+		return nil
+	}
+	return &memTxBucket{tx: t, b: b}
+}
+
+func (t *memTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if b := t.Bucket(name); b != nil {
+		return b, nil
+	}
+	if !t.writable {
+		return nil, errTxNotWritable
+	}
+
+	n := string(name)
+	b := newMemBucket()
+	t.s.buckets[n] = b
+	t.undo = append(t.undo, func() { delete(t.s.buckets, n) })
+	return &memTxBucket{tx: t, b: b}, nil
+}
+
+func (t *memTx) DeleteBucket(name []byte) error {
+	if !t.writable {
+		return errTxNotWritable
+	}
+
+	n := string(name)
+	b, ok := t.s.buckets[n]
+	if !ok {
+		return errBucketNotFound
+	}
+	delete(t.s.buckets, n)
+	t.undo = append(t.undo, func() { t.s.buckets[n] = b })
+	return nil
+}
+
+// memTxBucket is a bucket as seen from a transaction.
+type memTxBucket struct {
+	tx *memTx
+	b  *memBucket
+}
+
+func (b *memTxBucket) Get(key []byte) []byte {
+	return b.b.values[string(key)]
+}
+
+func (b *memTxBucket) Put(key, value []byte) error {
+	if !b.tx.writable {
+		return errTxNotWritable
+	}
+
+	k := string(key)
+	old, existed := b.b.values[k]
+	b.b.put(k, append([]byte{}, value...))
+	b.tx.undo = append(b.tx.undo, func() {
+		if existed {
+			b.b.put(k, old)
+		} else {
+			b.b.delete(k)
+		}
+	})
+	return nil
+}
+
+func (b *memTxBucket) Delete(key []byte) error {
+	if !b.tx.writable {
+		return errTxNotWritable
+	}
+
+	k := string(key)
+	old, existed := b.b.values[k]
+	if !existed {
+		return nil
+	}
+	b.b.delete(k)
+	b.tx.undo = append(b.tx.undo, func() { b.b.put(k, old) })
+	return nil
+}
+
+func (b *memTxBucket) Cursor() Cursor {
+	return &memCursor{b: b.b}
+}
+
+func (b *memTxBucket) Sequence() uint64 {
+	return b.b.seq
+}
+
+func (b *memTxBucket) SetSequence(v uint64) error {
+	if !b.tx.writable {
+		return errTxNotWritable
+	}
+
+	old := b.b.seq
+	b.b.seq = v
+	b.tx.undo = append(b.tx.undo, func() { b.b.seq = old })
+	return nil
+}
+
+func (b *memTxBucket) NextSequence() (uint64, error) {
+	if err := b.SetSequence(b.b.seq + 1); err != nil {
+		return 0, err
+	}
+	return b.b.seq, nil
+}
+
+// memCursor remembers the index of the current key in the sorted keys of
+// the bucket.
+type memCursor struct {
+	b *memBucket
+	i int
+}
+
+func (c *memCursor) at(i int) (key, value []byte) {
+	c.i = i
+	if i >= len(c.b.keys) {
+		return nil, nil
+	}
+	k := c.b.keys[i]
+	return []byte(k), c.b.values[k]
+}
+
+func (c *memCursor) First() (key, value []byte) {
+	return c.at(0)
+}
+
+func (c *memCursor) Seek(seek []byte) (key, value []byte) {
+	return c.at(c.b.search(string(seek)))
+}
+
+func (c *memCursor) Next() (key, value []byte) {
+	return c.at(c.i + 1)
+}
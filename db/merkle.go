@@ -0,0 +1,187 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Anti-entropy compares the keys of a namespace on a primary and on a
+// replica with hash trees. Every key belongs to one of MerkleLeaves leaves,
+// chosen by the hash of the key. The hash of a leaf combines the hashes of
+// the keys in it with their records and expiration times, independently of
+// their order, and every other node hashes its two children. Namespaces
+// with the same root hold the same keys; otherwise descending into the
+// children that differ finds the leaves whose keys need to be repaired.
+
+// merkleDepth is the number of levels of a MerkleTree below its root.
+const merkleDepth = 8
+
+// MerkleLeaves is the number of leaves of a MerkleTree.
+const MerkleLeaves = 1 << merkleDepth
+
+// MerkleTree is a hash tree over the keys of a namespace. Node 1 is the
+// root, the children of node i are the nodes 2i and 2i+1 and leaf i is the
+// node MerkleLeaves+i.
+type MerkleTree [2 * MerkleLeaves][sha256.Size]byte
+
+// Node returns the hash of a node of the tree.
+func (t *MerkleTree) Node(i int) []byte {
+	return t[i][:]
+}
+
+// merkleLeaf returns the leaf of a key.
+func merkleLeaf(key []byte) int {
+	h := sha256.Sum256(key)
+	return int(binary.BigEndian.Uint32(h[:]) >> (32 - merkleDepth))
+}
+
+// merkleHash returns the hash of a key with its record and the value of
+// its entry in the TTL bucket, which may be nil.
+func merkleHash(key, record, ttl []byte) [sha256.Size]byte {
+	h := sha256.New()
+	var buf []byte
+	for _, field := range [][]byte{key, record, ttl} {
+		buf = binary.AppendUvarint(buf[:0], uint64(len(field)))
+		h.Write(buf)
+		h.Write(field)
+	}
+	var res [sha256.Size]byte
+	h.Sum(res[:0])
+	return res
+}
+
+// MerkleTree returns the hash tree over the keys of a namespace. Keys that
+// expired but were not deleted yet are included.
+func (d *DB) MerkleTree(ns string) (*MerkleTree, error) {
+	t := &MerkleTree{}
+	err := d.view(ns, func(tx Tx, n *namespace) error {
+		ttl := tx.Bucket(n.ttl)
+		c := tx.Bucket(n.data).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			leaf := &t[MerkleLeaves+merkleLeaf(k)]
+			h := merkleHash(k, v, ttl.Get(k))
+			for i := range leaf {
+				leaf[i] ^= h[i]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := MerkleLeaves - 1; i >= 1; i-- {
+		t[i] = sha256.Sum256(append(t[2*i][:], t[2*i+1][:]...))
+	}
+	return t, nil
+}
+
+// leafSet returns the set of the given leaves.
+func leafSet(leaves []int) (map[int]bool, error) {
+	res := make(map[int]bool, len(leaves))
+	for _, l := range leaves {
+		if l < 0 || l >= MerkleLeaves {
+			return nil, fmt.Errorf("invalid leaf %d", l)
+		}
+		res[l] = true
+	}
+	return res, nil
+}
+
+// merkleChange returns the key of the data bucket with its record and TTL
+// entry as a change that sets it.
+func merkleChange(ns string, k, v, ttl []byte) Change {
+	c := Change{Namespace: ns, Key: copyByteSlice(k)}
+	c.Version, c.Value = decodeRecord(v)
+	if len(ttl) == 8 {
+		c.ExpiresAt = int64(binary.BigEndian.Uint64(ttl))
+	}
+	return c
+}
+
+// MerkleEntries returns the keys of a namespace that belong to the given
+// leaves as changes that set them.
+func (d *DB) MerkleEntries(ns string, leaves []int) ([]Change, error) {
+	set, err := leafSet(leaves)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Change
+	err = d.view(ns, func(tx Tx, n *namespace) error {
+		ttl := tx.Bucket(n.ttl)
+		c := tx.Bucket(n.data).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if set[merkleLeaf(k)] {
+				res = append(res, merkleChange(n.name, k, v, ttl.Get(k)))
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+// Repair makes the keys of a namespace that belong to the given leaves
+// match entries, the result of MerkleEntries on the primary. Keys with a
+// higher version than on the primary were changed since and are kept. The
+// changes are not added to the replication log. It returns the number of
+// keys that were set or deleted.
+func (d *DB) Repair(ns string, leaves []int, entries []Change) (int, error) {
+	set, err := leafSet(leaves)
+	if err != nil {
+		return 0, err
+	}
+	n, err := lookupNamespace(ns)
+	if err != nil {
+		return 0, err
+	}
+
+	repaired := 0
+	err = d.store.Update(func(tx Tx) error {
+		local := make(map[string]Change)
+		if n.exists(tx) {
+			ttl := tx.Bucket(n.ttl)
+			c := tx.Bucket(n.data).Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				if set[merkleLeaf(k)] {
+					local[string(k)] = merkleChange(n.name, k, v, ttl.Get(k))
+				}
+			}
+		}
+
+		for i := range entries {
+			e := &entries[i]
+			e.Namespace = n.name
+			if !set[merkleLeaf(e.Key)] {
+				return fmt.Errorf("key %q is not in the repaired leaves", e.Key)
+			}
+
+			l, ok := local[string(e.Key)]
+			delete(local, string(e.Key))
+			if ok && (l.Version > e.Version || sameEntry(&l, e)) {
+				continue
+			}
+			if err := d.applyChange(tx, e); err != nil {
+				return err
+			}
+			repaired++
+		}
+
+		// The remaining keys are not on the primary.
+		for key := range local {
+			if err := d.applyChange(tx, &Change{Namespace: n.name, Key: []byte(key), Deleted: true}); err != nil {
+				return err
+			}
+			repaired++
+		}
+		return nil
+	})
+	return repaired, err
+}
+
+// sameEntry reports whether two changes set a key to the same record.
+func sameEntry(a, b *Change) bool {
+	return a.Version == b.Version && a.ExpiresAt == b.ExpiresAt && bytes.Equal(a.Value, b.Value)
+}
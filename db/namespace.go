@@ -0,0 +1,167 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultNamespace is the namespace used when none is given. Its keys live
+// in the buckets that predate namespaces.
+const DefaultNamespace = "default"
+
+// maxNamespaceLength is the maximum length of a namespace name.
+const maxNamespaceLength = 64
+
+// namespacesBucket lists the names of all namespaces.
+var namespacesBucket = []byte("namespaces")
+
+// namespace holds the names of the buckets that store the keys of a
+// namespace, their expiration times and their history.
+type namespace struct {
+	name    string
+	data    []byte
+	ttl     []byte
+	expiry  []byte
+	history []byte
+}
+
+// lookupNamespace validates a namespace name and returns its buckets. An
+// empty name refers to the default namespace.
+func lookupNamespace(name string) (*namespace, error) {
+	if name == "" || name == DefaultNamespace {
+		return &namespace{
+			name:    DefaultNamespace,
+			data:    defaultBucket,
+			ttl:     ttlBucket,
+			expiry:  expiryBucket,
+			history: historyBucket,
+		}, nil
+	}
+
+	if len(name) > maxNamespaceLength {
+		return nil, fmt.Errorf("namespace %q is longer than %d characters", name, maxNamespaceLength)
+	}
+	for _, c := range name {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return nil, fmt.Errorf("invalid character %q in namespace %q", c, name)
+		}
+	}
+
+	prefix := "ns:" + name
+	return &namespace{
+		name:    name,
+		data:    []byte(prefix),
+		ttl:     []byte(prefix + ":ttl"),
+		expiry:  []byte(prefix + ":expiry"),
+		history: []byte(prefix + ":history"),
+	}, nil
+}
+
+// exists reports whether the buckets of the namespace have been created.
+func (n *namespace) exists(tx Tx) bool {
+	return tx.Bucket(n.data) != nil
+}
+
+// create creates the buckets of the namespace if needed.
+func (n *namespace) create(tx Tx) error {
+	if n.exists(tx) {
+		return nil
+	}
+
+	for _, name := range [][]byte{n.data, n.ttl, n.expiry, n.history} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(namespacesBucket).Put([]byte(n.name), nil)
+}
+
+// drop deletes the buckets of the namespace and all of its keys.
+func (n *namespace) drop(tx Tx) error {
+	if !n.exists(tx) {
+		return nil
+	}
+
+	for _, name := range [][]byte{n.data, n.ttl, n.expiry, n.history} {
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(namespacesBucket).Delete([]byte(n.name))
+}
+
+// namespaces returns all existing namespaces.
+func namespaces(tx Tx) ([]*namespace, error) {
+	var res []*namespace
+	c := tx.Bucket(namespacesBucket).Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n, err := lookupNamespace(string(k))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+// Namespaces returns the names of all namespaces in ascending order.
+func (d *DB) Namespaces() ([]string, error) {
+	var res []string
+	err := d.store.View(func(tx Tx) error {
+		ns, err := namespaces(tx)
+		for _, n := range ns {
+			res = append(res, n.name)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// CreateNamespace creates an empty namespace. Namespaces are also created
+// on demand by the first write to them, so creating an existing namespace
+// is not an error.
+func (d *DB) CreateNamespace(name string) error {
+	if d.readOnly.Load() {
+		return errors.New("read-only mode")
+	}
+
+	n, err := lookupNamespace(name)
+	if err != nil {
+		return err
+	}
+
+	return d.store.Update(func(tx Tx) error {
+		return n.create(tx)
+	})
+}
+
+// DropNamespace deletes a namespace and all of its keys. The drop is
+// replicated. Dropping a missing namespace is not an error, but the default
+// namespace cannot be dropped.
+func (d *DB) DropNamespace(name string) error {
+	if d.readOnly.Load() {
+		return errors.New("read-only mode")
+	}
+
+	n, err := lookupNamespace(name)
+	if err != nil {
+		return err
+	}
+	if n.name == DefaultNamespace {
+		return errors.New("cannot drop the default namespace")
+	}
+
+	return d.commit(func(tx Tx) error {
+		if !n.exists(tx) {
+			return nil
+		}
+		if err := n.drop(tx); err != nil {
+			return err
+		}
+
+		return appendLog(tx, &Change{Namespace: n.name, Drop: true})
+	})
+}
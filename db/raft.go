@@ -0,0 +1,370 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Shards that use consensus replication keep a Raft log next to the data.
+// Writes are not applied directly: the changes they would make are proposed
+// to the shard's Raft group and applied by ApplyEntry on every member once
+// a majority stored them. The applied index is stored with the data, so the
+// database file itself is the snapshot of the Raft state machine.
+var (
+	// raftLogBucket maps the big-endian index of every entry of the Raft
+	// log to its term followed by its changes. Its sequence is the index of
+	// the last entry.
+	raftLogBucket = []byte("raft-log")
+	// raftStateBucket holds the current term and vote of the member, and
+	// the index and term of the last entry removed from the log.
+	raftStateBucket = []byte("raft-state")
+)
+
+var (
+	termKey          = []byte("term")
+	voteKey          = []byte("vote")
+	snapshotIndexKey = []byte("snapshot-index")
+	snapshotTermKey  = []byte("snapshot-term")
+	// appliedTermKey is the term of the last applied entry, stored next to
+	// the appliedKey so that it is part of every snapshot.
+	appliedTermKey = []byte("applied-term")
+)
+
+// ErrNotLeader is returned by writes on a member of a Raft group that is
+// not its leader.
+var ErrNotLeader = errors.New("not the leader of the shard")
+
+// errRollback discards the transaction of a proposed write.
+var errRollback = errors.New("rollback")
+
+// Proposer replicates the changes of writes before they are applied.
+type Proposer interface {
+	// Propose returns once the changes were committed and applied to the
+	// database with ApplyEntry, or returns ErrNotLeader if this member
+	// cannot accept writes. If it fails otherwise, the changes may still be
+	// committed later, and the proposer must not accept writes again until
+	// they were either applied or dropped.
+	Propose(changes []Change) error
+	// IsLeader reports whether Propose currently accepts writes.
+	IsLeader() bool
+}
+
+// RaftEntry is an entry of the Raft log. The changes of an entry are
+// applied in a single transaction; entries without changes only mark the
+// start of a term.
+type RaftEntry struct {
+	Index   uint64
+	Term    uint64
+	Changes []Change
+}
+
+// RaftState is the persistent state of a member of a Raft group.
+// SnapshotIndex and SnapshotTerm identify the last entry removed from the
+// log, whose changes are all in the database.
+type RaftState struct {
+	Term          uint64
+	Vote          string
+	SnapshotIndex uint64
+	SnapshotTerm  uint64
+	LastIndex     uint64
+	LastTerm      uint64
+}
+
+// SetProposer routes all writes through p. It must be called before the
+// database is used.
+func (d *DB) SetProposer(p Proposer) {
+	d.proposer.Store(&p)
+}
+
+// leader reports whether the database accepts writes from the reaper.
+func (d *DB) leader() bool {
+	p := d.proposer.Load()
+	return p == nil || (*p).IsLeader()
+}
+
+// propose runs fn in a transaction that is rolled back and proposes the
+// changes that it appended to the replication log. Proposals are
+// serialized, so that every write sees the changes of the previous one. A
+// proposal that failed may still be committed, which is why the proposer
+// stops accepting writes until it is resolved.
+func (d *DB) propose(p Proposer, fn func(Tx) error) error {
+	if !p.IsLeader() {
+		return ErrNotLeader
+	}
+
+	d.proposeMu.Lock()
+	defer d.proposeMu.Unlock()
+
+	var changes []Change
+	err := d.store.Update(func(tx Tx) error {
+		b := tx.Bucket(logBucket)
+		start := b.Sequence()
+		if err := fn(tx); err != nil {
+			return err
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(seqKey(start + 1)); k != nil; k, v = c.Next() {
+			change, err := decodeChange(0, v)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, *change)
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return p.Propose(changes)
+}
+
+// createRaftBuckets creates the buckets of the Raft log.
+func createRaftBuckets(tx Tx) error {
+	for _, name := range [][]byte{raftLogBucket, raftStateBucket} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeRaftEntry returns the representation of an entry as stored in the
+// Raft log: the term followed by the length-prefixed changes.
+func encodeRaftEntry(e *RaftEntry) []byte {
+	res := binary.BigEndian.AppendUint64(nil, e.Term)
+	for i := range e.Changes {
+		c := encodeChange(&e.Changes[i])
+		res = binary.AppendUvarint(res, uint64(len(c)))
+		res = append(res, c...)
+	}
+	return res
+}
+
+// decodeRaftEntry parses an entry of the Raft log.
+func decodeRaftEntry(index uint64, v []byte) (*RaftEntry, error) {
+	malformed := fmt.Errorf("malformed raft log entry %d", index)
+	if len(v) < 8 {
+		return nil, malformed
+	}
+	e := &RaftEntry{Index: index, Term: binary.BigEndian.Uint64(v)}
+
+	for rest := v[8:]; len(rest) > 0; {
+		n, size := binary.Uvarint(rest)
+		if size <= 0 || uint64(len(rest)-size) < n {
+			return nil, malformed
+		}
+		c, err := decodeChange(0, rest[size:size+int(n)])
+		if err != nil {
+			return nil, err
+		}
+		e.Changes = append(e.Changes, *c)
+		rest = rest[size+int(n):]
+	}
+	return e, nil
+}
+
+// RaftState returns the persistent Raft state of the member.
+func (d *DB) RaftState() (st RaftState, err error) {
+	err = d.store.View(func(tx Tx) error {
+		state := tx.Bucket(raftStateBucket)
+		st.Term = getUint64(state, termKey)
+		st.Vote = string(state.Get(voteKey))
+		st.SnapshotIndex = getUint64(state, snapshotIndexKey)
+		st.SnapshotTerm = getUint64(state, snapshotTermKey)
+		st.LastIndex, st.LastTerm = st.SnapshotIndex, st.SnapshotTerm
+
+		b := tx.Bucket(raftLogBucket)
+		if last := b.Sequence(); last > st.SnapshotIndex {
+			v := b.Get(seqKey(last))
+			if len(v) < 8 {
+				return fmt.Errorf("raft log entry %d not found", last)
+			}
+			st.LastIndex, st.LastTerm = last, binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	return st, err
+}
+
+// SetRaftTerm stores the current term of the member and the member it
+// voted for in that term.
+func (d *DB) SetRaftTerm(term uint64, vote string) error {
+	return d.store.Update(func(tx Tx) error {
+		state := tx.Bucket(raftStateBucket)
+		if err := state.Put(termKey, seqKey(term)); err != nil {
+			return err
+		}
+		return state.Put(voteKey, []byte(vote))
+	})
+}
+
+// AppendRaftEntries stores consecutive entries in the Raft log, replacing
+// the entry at the index of the first one and all entries after it.
+func (d *DB) AppendRaftEntries(entries []RaftEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return d.store.Update(func(tx Tx) error {
+		b := tx.Bucket(raftLogBucket)
+
+		var stale [][]byte
+		c := b.Cursor()
+		for k, _ := c.Seek(seqKey(entries[0].Index)); k != nil; k, _ = c.Next() {
+			stale = append(stale, copyByteSlice(k))
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		for i := range entries {
+			if err := b.Put(seqKey(entries[i].Index), encodeRaftEntry(&entries[i])); err != nil {
+				return err
+			}
+		}
+		return b.SetSequence(entries[len(entries)-1].Index)
+	})
+}
+
+// RaftEntries returns up to limit entries of the Raft log starting at the
+// given index.
+func (d *DB) RaftEntries(from uint64, limit int) ([]RaftEntry, error) {
+	var res []RaftEntry
+	err := d.store.View(func(tx Tx) error {
+		c := tx.Bucket(raftLogBucket).Cursor()
+		for k, v := c.Seek(seqKey(from)); k != nil && len(res) < limit; k, v = c.Next() {
+			e, err := decodeRaftEntry(binary.BigEndian.Uint64(k), v)
+			if err != nil {
+				return err
+			}
+			res = append(res, *e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// RaftTerm returns the term of the entry at index, which must not have
+// been removed from the log before the last snapshot.
+func (d *DB) RaftTerm(index uint64) (term uint64, err error) {
+	err = d.store.View(func(tx Tx) error {
+		state := tx.Bucket(raftStateBucket)
+		if index == getUint64(state, snapshotIndexKey) {
+			term = getUint64(state, snapshotTermKey)
+			return nil
+		}
+
+		v := tx.Bucket(raftLogBucket).Get(seqKey(index))
+		if v == nil {
+			return fmt.Errorf("raft log entry %d not found", index)
+		}
+		term = binary.BigEndian.Uint64(v)
+		return nil
+	})
+	return term, err
+}
+
+// CompactRaftLog removes the entries up to index from the Raft log. Their
+// changes must have been applied.
+func (d *DB) CompactRaftLog(index uint64) error {
+	return d.store.Update(func(tx Tx) error {
+		if applied := getUint64(tx.Bucket(replicationStateBucket), appliedKey); index > applied {
+			return fmt.Errorf("cannot compact the raft log up to %d, only %d is applied", index, applied)
+		}
+
+		b := tx.Bucket(raftLogBucket)
+		v := b.Get(seqKey(index))
+		if v == nil {
+			return nil
+		}
+		term := binary.BigEndian.Uint64(v)
+
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= index; k, _ = c.Next() {
+			keys = append(keys, copyByteSlice(k))
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return setRaftSnapshot(tx, index, term)
+	})
+}
+
+// InstallRaftSnapshot replaces all namespaces of the database with those
+// of a snapshot of the leader of the Raft group, like LoadSnapshot, and
+// empties the Raft log. It returns the index and the term of the last entry
+// whose changes are in the snapshot.
+func (d *DB) InstallRaftSnapshot(r io.Reader) (index, term uint64, err error) {
+	index, err = d.loadSnapshot(r, func(src, tx Tx, seq uint64) error {
+		term = getUint64(src.Bucket(replicationStateBucket), appliedTermKey)
+		if err := tx.Bucket(replicationStateBucket).Put(appliedTermKey, seqKey(term)); err != nil {
+			return err
+		}
+
+		if err := tx.DeleteBucket(raftLogBucket); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucketIfNotExists(raftLogBucket)
+		if err != nil {
+			return err
+		}
+		if err := b.SetSequence(seq); err != nil {
+			return err
+		}
+		return setRaftSnapshot(tx, seq, term)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return index, term, nil
+}
+
+// setRaftSnapshot records the last entry removed from the Raft log.
+func setRaftSnapshot(tx Tx, index, term uint64) error {
+	state := tx.Bucket(raftStateBucket)
+	if err := state.Put(snapshotIndexKey, seqKey(index)); err != nil {
+		return err
+	}
+	return state.Put(snapshotTermKey, seqKey(term))
+}
+
+// ApplyEntry applies the changes of a committed entry of the Raft log in a
+// single transaction and records its index as the applied position. The
+// sequence of the replication log follows the index, so that a snapshot of
+// the database loaded with LoadSnapshot resumes after the entry. Entries
+// that were already applied are skipped.
+func (d *DB) ApplyEntry(e *RaftEntry) error {
+	return d.store.Update(func(tx Tx) error {
+		state := tx.Bucket(replicationStateBucket)
+		if e.Index <= getUint64(state, appliedKey) {
+			return nil
+		}
+
+		for i := range e.Changes {
+			if err := d.applyChange(tx, &e.Changes[i]); err != nil {
+				return fmt.Errorf("applying raft log entry %d: %w", e.Index, err)
+			}
+		}
+
+		if err := tx.Bucket(logBucket).SetSequence(e.Index); err != nil {
+			return err
+		}
+		if err := state.Put(appliedTermKey, seqKey(e.Term)); err != nil {
+			return err
+		}
+		return state.Put(appliedKey, seqKey(e.Index))
+	})
+}
@@ -0,0 +1,587 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The replication log is an append-only list of changes keyed by their
+// big-endian sequence number, taken from the sequence of the log bucket.
+// Replicas apply the changes in order and record the sequence number of the
+// last applied change in the same transaction, so a restarted replica
+// resumes exactly where it stopped. The primary keeps the sequence number
+// acknowledged by every replica and drops the changes that all of them have
+// applied.
+var (
+	logBucket = []byte("replication-log")
+	// replicasBucket maps the ID of every known replica to the sequence
+	// number of the last change it acknowledged.
+	replicasBucket = []byte("replicas")
+	// logPinsBucket maps the name of every other reader of the log, such
+	// as a migration of keys to other shards, to the sequence number of
+	// the last change it read. Pins keep the log like replicas do, but do
+	// not count as replicas.
+	logPinsBucket = []byte("log-pins")
+	// replicationStateBucket holds the appliedKey of a replica and the
+	// truncatedKey of a primary.
+	replicationStateBucket = []byte("replication-state")
+
+	// legacyReplicationBucket is the last-value-per-key queue of the
+	// default namespace that the log replaced. Its entries cannot be
+	// ordered, so the keys it lists are logged with their current state
+	// and the bucket is dropped.
+	legacyReplicationBucket = []byte("replication")
+)
+
+var (
+	// appliedKey is the sequence number of the last change applied by a
+	// replica.
+	appliedKey = []byte("applied")
+	// truncatedKey is the sequence number of the last change removed from
+	// the log.
+	truncatedKey = []byte("truncated")
+)
+
+// Operations stored as the first byte of every entry in the replication
+// log.
+const (
+	opSet    byte = 's'
+	opSetTTL byte = 't'
+	opDelete byte = 'd'
+	opDrop   byte = 'x'
+)
+
+// ErrLogTruncated is returned when reading changes that have already been
+// removed from the replication log. The reader needs a full copy of the
+// database to catch up.
+var ErrLogTruncated = errors.New("replication log truncated")
+
+// Change is a modification recorded in the replication log. Seq is its
+// position in the log. A change with Deleted set is a tombstone and Version
+// is the version of the key after a set. ExpiresAt is the expiration time
+// of the key in Unix nanoseconds after a set with a TTL, or zero. A change
+// with Drop set drops the whole namespace and has no key.
+type Change struct {
+	Seq       uint64
+	Namespace string
+	Key       []byte
+	Value     []byte
+	Version   uint64
+	ExpiresAt int64
+	Deleted   bool
+	Drop      bool
+}
+
+// encodeChange returns the representation of a change as stored in the
+// replication log: the operation, the length-prefixed namespace and key
+// and, for sets, the version, the expiration time if any and the value.
+func encodeChange(c *Change) []byte {
+	op := opSet
+	switch {
+	case c.Drop:
+		op = opDrop
+	case c.Deleted:
+		op = opDelete
+	case c.ExpiresAt != 0:
+		op = opSetTTL
+	}
+
+	res := []byte{op}
+	res = binary.AppendUvarint(res, uint64(len(c.Namespace)))
+	res = append(res, c.Namespace...)
+	res = binary.AppendUvarint(res, uint64(len(c.Key)))
+	res = append(res, c.Key...)
+	if op == opSet || op == opSetTTL {
+		res = binary.BigEndian.AppendUint64(res, c.Version)
+		if op == opSetTTL {
+			res = binary.BigEndian.AppendUint64(res, uint64(c.ExpiresAt))
+		}
+		res = append(res, c.Value...)
+	}
+	return res
+}
+
+// decodeChange parses an entry of the replication log.
+func decodeChange(seq uint64, entry []byte) (*Change, error) {
+	malformed := fmt.Errorf("malformed replication log entry %d", seq)
+	if len(entry) == 0 {
+		return nil, malformed
+	}
+	c := &Change{Seq: seq}
+	op, rest := entry[0], entry[1:]
+
+	var fields [2][]byte
+	for i := range fields {
+		n, size := binary.Uvarint(rest)
+		if size <= 0 || uint64(len(rest)-size) < n {
+			return nil, malformed
+		}
+		fields[i] = rest[size : size+int(n)]
+		rest = rest[size+int(n):]
+	}
+	c.Namespace, c.Key = string(fields[0]), copyByteSlice(fields[1])
+
+	switch op {
+	case opSet:
+		if len(rest) < 8 {
+			return nil, malformed
+		}
+		c.Version = binary.BigEndian.Uint64(rest)
+		c.Value = copyByteSlice(rest[8:])
+	case opSetTTL:
+		if len(rest) < 16 {
+			return nil, malformed
+		}
+		c.Version = binary.BigEndian.Uint64(rest)
+		c.ExpiresAt = int64(binary.BigEndian.Uint64(rest[8:]))
+		c.Value = copyByteSlice(rest[16:])
+	case opDelete:
+		c.Deleted = true
+	case opDrop:
+		c.Drop = true
+	default:
+		return nil, fmt.Errorf("unknown replication operation %q in log entry %d", op, seq)
+	}
+	return c, nil
+}
+
+// seqKey returns the key of the log entry with the given sequence number.
+func seqKey(seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, seq)
+}
+
+// getUint64 returns the big-endian integer stored at key, or zero.
+func getUint64(b Bucket, key []byte) uint64 {
+	v := b.Get(key)
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+// createReplicationBuckets creates the buckets of the replication log and
+// moves the pending changes of the legacy queue to it.
+func createReplicationBuckets(tx Tx) error {
+	for _, name := range [][]byte{logBucket, replicasBucket, logPinsBucket, replicationStateBucket} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+
+	legacy := tx.Bucket(legacyReplicationBucket)
+	if legacy == nil {
+		return nil
+	}
+	var keys [][]byte
+	c := legacy.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		keys = append(keys, copyByteSlice(k))
+	}
+	for _, k := range keys {
+		if err := appendLog(tx, legacyChange(tx, k)); err != nil {
+			return err
+		}
+	}
+	return tx.DeleteBucket(legacyReplicationBucket)
+}
+
+// legacyChange returns a change that brings a key of the default namespace
+// listed in the legacy queue to its current state.
+func legacyChange(tx Tx, key []byte) *Change {
+	var v, ttl []byte
+	if b := tx.Bucket(defaultBucket); b != nil {
+		v = b.Get(key)
+	}
+	if v == nil {
+		return &Change{Namespace: DefaultNamespace, Key: key, Deleted: true}
+	}
+	if b := tx.Bucket(ttlBucket); b != nil {
+		ttl = b.Get(key)
+	}
+	c := merkleChange(DefaultNamespace, key, v, ttl)
+	return &c
+}
+
+// appendLog appends the change to the replication log.
+func appendLog(tx Tx, c *Change) error {
+	b := tx.Bucket(logBucket)
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	return b.Put(seqKey(seq), encodeChange(c))
+}
+
+// commit runs fn in a read-write transaction that may append to the
+// replication log, truncates the log if nothing reads it and wakes up the
+// readers waiting for new changes. With a
+// proposer, the changes are proposed instead and applied once committed.
+func (d *DB) commit(fn func(Tx) error) error {
+	if p := d.proposer.Load(); p != nil {
+		return d.propose(*p, fn)
+	}
+
+	err := d.store.Update(func(tx Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return truncateLog(tx)
+	})
+	if err != nil {
+		return err
+	}
+
+	d.logMu.Lock()
+	close(d.logChanged)
+	d.logChanged = make(chan struct{})
+	d.logMu.Unlock()
+	return nil
+}
+
+// LogChanged returns a channel that is closed once new changes may have
+// been appended to the replication log. Get the channel before reading the
+// log so that no change is missed.
+func (d *DB) LogChanged() <-chan struct{} {
+	d.logMu.Lock()
+	defer d.logMu.Unlock()
+	return d.logChanged
+}
+
+// ReadLog returns up to limit changes that follow the change with sequence
+// number after, in order. It returns ErrLogTruncated if some of those
+// changes have already been removed from the log.
+func (d *DB) ReadLog(after uint64, limit int) ([]Change, error) {
+	var res []Change
+	err := d.store.View(func(tx Tx) error {
+		if after < getUint64(tx.Bucket(replicationStateBucket), truncatedKey) {
+			return ErrLogTruncated
+		}
+
+		c := tx.Bucket(logBucket).Cursor()
+		for k, v := c.Seek(seqKey(after + 1)); k != nil && len(res) < limit; k, v = c.Next() {
+			change, err := decodeChange(binary.BigEndian.Uint64(k), v)
+			if err != nil {
+				return err
+			}
+			res = append(res, *change)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// AckReplication records that the replica has applied all changes up to
+// seq and removes the changes that every registered replica has applied
+// from the log. Replicas that are not registered yet are registered by
+// their first acknowledgement.
+func (d *DB) AckReplication(replica string, seq uint64) error {
+	err := d.store.Update(func(tx Tx) error {
+		if last := tx.Bucket(logBucket).Sequence(); seq > last {
+			return fmt.Errorf("replica %q acknowledged change %d, but the log ends at %d", replica, seq, last)
+		}
+
+		if err := tx.Bucket(replicasBucket).Put([]byte(replica), seqKey(seq)); err != nil {
+			return err
+		}
+		return truncateLog(tx)
+	})
+	if err != nil {
+		return err
+	}
+
+	d.logMu.Lock()
+	close(d.ackChanged)
+	d.ackChanged = make(chan struct{})
+	d.logMu.Unlock()
+	return nil
+}
+
+// WaitReplicated blocks until at least n registered replicas acknowledged
+// all changes up to seq, or until ctx is done. It returns the number of
+// replicas that acknowledged them.
+func (d *DB) WaitReplicated(ctx context.Context, seq uint64, n int) (int, error) {
+	for {
+		d.logMu.Lock()
+		changed := d.ackChanged
+		d.logMu.Unlock()
+
+		replicas, err := d.Replicas()
+		if err != nil {
+			return 0, err
+		}
+		count := 0
+		for _, acked := range replicas {
+			if acked >= seq {
+				count++
+			}
+		}
+		if count >= n {
+			return count, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return count, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// SetReplicas registers the given replicas and forgets all others, so that
+// the log keeps the changes that the configured replicas have not applied
+// yet but not those only needed by replicas that were removed. Newly
+// registered replicas start at the oldest change still in the log.
+func (d *DB) SetReplicas(replicas []string) error {
+	return d.store.Update(func(tx Tx) error {
+		b := tx.Bucket(replicasBucket)
+		configured := make(map[string]bool)
+		for _, r := range replicas {
+			configured[r] = true
+		}
+
+		var removed [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if configured[string(k)] {
+				delete(configured, string(k))
+			} else {
+				removed = append(removed, copyByteSlice(k))
+			}
+		}
+		for _, k := range removed {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		truncated := seqKey(getUint64(tx.Bucket(replicationStateBucket), truncatedKey))
+		for r := range configured {
+			if err := b.Put([]byte(r), truncated); err != nil {
+				return err
+			}
+		}
+		return truncateLog(tx)
+	})
+}
+
+// PinLog keeps the changes after seq in the log for a reader that is not a
+// replica and removes the changes that every replica and pin has read.
+func (d *DB) PinLog(name string, seq uint64) error {
+	return d.store.Update(func(tx Tx) error {
+		if last := tx.Bucket(logBucket).Sequence(); seq > last {
+			return fmt.Errorf("pin %q read change %d, but the log ends at %d", name, seq, last)
+		}
+
+		if err := tx.Bucket(logPinsBucket).Put([]byte(name), seqKey(seq)); err != nil {
+			return err
+		}
+		return truncateLog(tx)
+	})
+}
+
+// UnpinLog removes a pin set by PinLog.
+func (d *DB) UnpinLog(name string) error {
+	return d.store.Update(func(tx Tx) error {
+		if err := tx.Bucket(logPinsBucket).Delete([]byte(name)); err != nil {
+			return err
+		}
+		return truncateLog(tx)
+	})
+}
+
+// Replicas returns the registered replicas and the sequence number of the
+// last change that each of them acknowledged.
+func (d *DB) Replicas() (map[string]uint64, error) {
+	res := make(map[string]uint64)
+	err := d.store.View(func(tx Tx) error {
+		c := tx.Bucket(replicasBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			res[string(k)] = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// truncateLog removes the changes that every registered replica and pin
+// has read from the log. Without registered replicas or pins, nothing reads
+// the log and it is emptied; replicas that register later catch up from a
+// snapshot.
+func truncateLog(tx Tx) error {
+	var seq uint64
+	found := false
+	for _, name := range [][]byte{replicasBucket, logPinsBucket} {
+		c := tx.Bucket(name).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if acked := binary.BigEndian.Uint64(v); !found || acked < seq {
+				seq = acked
+			}
+			found = true
+		}
+	}
+	if !found {
+		seq = tx.Bucket(logBucket).Sequence()
+	}
+
+	state := tx.Bucket(replicationStateBucket)
+	if seq <= getUint64(state, truncatedKey) {
+		return nil
+	}
+
+	b := tx.Bucket(logBucket)
+	var keys [][]byte
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= seq; k, _ = c.Next() {
+		keys = append(keys, copyByteSlice(k))
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return state.Put(truncatedKey, seqKey(seq))
+}
+
+// AppliedSequence returns the sequence number of the last change applied
+// by ApplyChanges.
+func (d *DB) AppliedSequence() (seq uint64, err error) {
+	err = d.store.View(func(tx Tx) error {
+		seq = getUint64(tx.Bucket(replicationStateBucket), appliedKey)
+		return nil
+	})
+	return seq, err
+}
+
+// ApplyChanges applies changes read from the log of the primary in a single
+// transaction and records the sequence number of the last one. Changes
+// that were already applied are skipped, so a batch can safely be applied
+// twice. Applied changes are not added to the local log.
+// This method is only intended to be used on replicas.
+func (d *DB) ApplyChanges(changes []Change) error {
+	return d.store.Update(func(tx Tx) error {
+		state := tx.Bucket(replicationStateBucket)
+		applied := getUint64(state, appliedKey)
+
+		for i := range changes {
+			c := &changes[i]
+			if c.Seq <= applied {
+				continue
+			}
+			if err := d.applyChange(tx, c); err != nil {
+				return fmt.Errorf("applying change %d: %w", c.Seq, err)
+			}
+			applied = c.Seq
+		}
+		return state.Put(appliedKey, seqKey(applied))
+	})
+}
+
+// applyChange applies a single change of the primary's log.
+func (d *DB) applyChange(tx Tx, c *Change) error {
+	n, err := lookupNamespace(c.Namespace)
+	if err != nil {
+		return err
+	}
+	if c.Drop {
+		return n.drop(tx)
+	}
+	if err := n.create(tx); err != nil {
+		return err
+	}
+
+	if err := d.archive(tx, n, c.Key); err != nil {
+		return err
+	}
+
+	if err := n.clearTTL(tx, c.Key); err != nil {
+		return err
+	}
+
+	b := tx.Bucket(n.data)
+	if c.Deleted {
+		return b.Delete(c.Key)
+	}
+	if c.ExpiresAt != 0 {
+		if err := n.setTTL(tx, c.Key, time.Unix(0, c.ExpiresAt)); err != nil {
+			return err
+		}
+	}
+
+	// Keep the sequence ahead of the replicated versions so that versions
+	// keep increasing if the replica ever accepts writes.
+	if c.Version > b.Sequence() {
+		if err := b.SetSequence(c.Version); err != nil {
+			return err
+		}
+	}
+	return b.Put(c.Key, encodeRecord(c.Version, c.Value))
+}
+
+// ReadOnly reports whether the database rejects writes because it is a
+// replica.
+func (d *DB) ReadOnly() bool {
+	return d.readOnly.Load()
+}
+
+// LogSequence returns the sequence number of the last change appended to
+// the replication log.
+func (d *DB) LogSequence() (seq uint64, err error) {
+	err = d.store.View(func(tx Tx) error {
+		seq = tx.Bucket(logBucket).Sequence()
+		return nil
+	})
+	return seq, err
+}
+
+// Promote turns a replica into a primary that accepts writes. The log of
+// the new primary continues the numbering of the old primary's log after
+// the last applied change, so replicas that applied the same changes keep
+// streaming from it. Replicas that are behind find the changes they miss
+// truncated and need a snapshot to catch up.
+func (d *DB) Promote() error {
+	err := d.store.Update(func(tx Tx) error {
+		state := tx.Bucket(replicationStateBucket)
+		applied := getUint64(state, appliedKey)
+
+		if err := tx.DeleteBucket(logBucket); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucketIfNotExists(logBucket)
+		if err != nil {
+			return err
+		}
+		if err := b.SetSequence(applied); err != nil {
+			return err
+		}
+		return state.Put(truncatedKey, seqKey(applied))
+	})
+	if err != nil {
+		return err
+	}
+
+	d.readOnly.Store(false)
+	return nil
+}
+
+// Demote turns a primary into a replica after another replica of its
+// shard was promoted. The writes that it accepted since then are not on
+// the new primary, so it forgets its position in the log of the old
+// primary and catches up from a snapshot of the new one. Returns an error
+// if the database is already read-only.
+func (d *DB) Demote() error {
+	if !d.readOnly.CompareAndSwap(false, true) {
+		return errors.New("read-only mode")
+	}
+	return d.store.Update(func(tx Tx) error {
+		return tx.Bucket(replicationStateBucket).Put(appliedKey, seqKey(0))
+	})
+}
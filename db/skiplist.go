@@ -0,0 +1,114 @@
+package db
+
+import (
+	"math/rand"
+)
+
+const skiplistMaxLevel = 20
+
+// lsmEntry is a value or a deletion marker (tombstone) in the LSM engine.
+// Tombstones shadow older values of the same key in older segments.
+type lsmEntry struct {
+	value   []byte
+	deleted bool
+}
+
+type skipNode struct {
+	key   string
+	entry lsmEntry
+	next  []*skipNode
+}
+
+// skiplist is a sorted map used as the memtable of the LSM engine. It is
+// not safe for concurrent use.
+type skiplist struct {
+	head  *skipNode
+	level int
+	// size is the approximate number of bytes held by the list.
+	size int
+	rnd  *rand.Rand
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  &skipNode{next: make([]*skipNode, skiplistMaxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(1)),
+	}
+}
+
+// seek returns the first node whose key is not less than key. If prev is
+// not nil, it is filled with the last node before that key on every level.
+func (l *skiplist) seek(key string, prev []*skipNode) *skipNode {
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if prev != nil {
+			prev[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+func (l *skiplist) get(key string) (lsmEntry, bool) {
+	n := l.seek(key, nil)
+	if n == nil || n.key != key {
+		return lsmEntry{}, false
+	}
+	return n.entry, true
+}
+
+func (l *skiplist) set(key string, e lsmEntry) {
+	prev := make([]*skipNode, skiplistMaxLevel)
+	n := l.seek(key, prev)
+	if n != nil && n.key == key {
+		l.size += len(e.value) - len(n.entry.value)
+		n.entry = e
+		return
+	}
+
+	level := 1
+	for level < skiplistMaxLevel && l.rnd.Intn(4) == 0 {
+		level++
+	}
+	for i := l.level; i < level; i++ {
+		prev[i] = l.head
+	}
+	if level > l.level {
+		l.level = level
+	}
+
+	n = &skipNode{key: key, entry: e, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = prev[i].next[i]
+		prev[i].next[i] = n
+	}
+	l.size += len(key) + len(e.value)
+}
+
+func (l *skiplist) remove(key string) {
+	prev := make([]*skipNode, skiplistMaxLevel)
+	n := l.seek(key, prev)
+	if n == nil || n.key != key {
+		return
+	}
+	for i := range n.next {
+		prev[i].next[i] = n.next[i]
+	}
+	l.size -= len(key) + len(n.entry.value)
+}
+
+// skiplistIterator iterates over a skiplist in key order.
+type skiplistIterator struct {
+	l *skiplist
+	n *skipNode
+}
+
+func (it *skiplistIterator) seek(key string) { it.n = it.l.seek(key, nil) }
+func (it *skiplistIterator) valid() bool     { return it.n != nil }
+func (it *skiplistIterator) key() string     { return it.n.key }
+func (it *skiplistIterator) entry() lsmEntry { return it.n.entry }
+func (it *skiplistIterator) next()           { it.n = it.n.next[0] }
+func (it *skiplistIterator) err() error      { return nil }
@@ -0,0 +1,64 @@
+package db
+
+// Storage is a transactional key-value store with named buckets of sorted
+// keys. DB keeps all of its state in a Storage: the values, expiration
+// times, history and the replication log each live in their own bucket,
+// so an engine only has to provide gets, puts, deletes and ordered scans.
+//
+// Keys and values returned by an engine are only valid for the lifetime of
+// the transaction and must not be modified.
+type Storage interface {
+	// View runs fn in a read-only transaction.
+	View(fn func(Tx) error) error
+	// Update runs fn in a read-write transaction. The transaction is
+	// committed if fn returns nil and rolled back otherwise.
+	Update(fn func(Tx) error) error
+	// Close releases all resources held by the storage.
+	Close() error
+}
+
+// Tx is a transaction of a Storage.
+type Tx interface {
+	// Bucket returns the bucket with the given name, or nil if it does not
+	// exist.
+	Bucket(name []byte) Bucket
+	// CreateBucketIfNotExists returns the bucket with the given name,
+	// creating it if needed.
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	// DeleteBucket deletes the bucket with the given name and all of its
+	// keys.
+	DeleteBucket(name []byte) error
+}
+
+// Bucket is a collection of sorted keys within a transaction.
+type Bucket interface {
+	// Get returns the value of key, or nil if the key does not exist.
+	Get(key []byte) []byte
+	// Put sets the value of key.
+	Put(key, value []byte) error
+	// Delete deletes key. Deleting a missing key is not an error.
+	Delete(key []byte) error
+	// Cursor returns a cursor over the keys of the bucket in ascending
+	// order.
+	Cursor() Cursor
+	// Sequence returns the current value of the bucket's sequence.
+	Sequence() uint64
+	// SetSequence sets the bucket's sequence.
+	SetSequence(v uint64) error
+	// NextSequence increments the bucket's sequence and returns the new
+	// value.
+	NextSequence() (uint64, error)
+}
+
+// Cursor iterates over the keys of a bucket in ascending order. All methods
+// return a nil key once the cursor is past the last key. Modifying the
+// bucket while iterating is not supported.
+type Cursor interface {
+	// First moves the cursor to the first key.
+	First() (key, value []byte)
+	// Seek moves the cursor to the first key that is greater than or equal
+	// to seek.
+	Seek(seek []byte) (key, value []byte)
+	// Next moves the cursor to the next key.
+	Next() (key, value []byte)
+}
@@ -0,0 +1,141 @@
+package db_test
+
+import (
+	"distributed-db/db"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// storageEngines returns a fresh instance of every storage engine.
+func storageEngines(t *testing.T) map[string]db.Storage {
+	t.Helper()
+
+	f, err := os.CreateTemp(os.TempDir(), "storagetest")
+	if err != nil {
+		t.Fatalf("Could not create a temp file: %v", err)
+	}
+	name := f.Name()
+	f.Close()
+	t.Cleanup(func() { os.Remove(name) })
+
+	bolt, err := db.OpenBolt(name)
+	if err != nil {
+		t.Fatalf("OpenBolt(%q): %v", name, err)
+	}
+
+	lsm, err := db.OpenLSM(t.TempDir(), db.LSMOptions{MemtableSize: 64})
+	if err != nil {
+		t.Fatalf("OpenLSM: %v", err)
+	}
+
+	engines := map[string]db.Storage{
+		"bolt":   bolt,
+		"memory": db.NewMemoryStorage(),
+		"lsm":    lsm,
+	}
+	for _, s := range engines {
+		t.Cleanup(func() { s.Close() })
+	}
+	return engines
+}
+
+func TestStorage(t *testing.T) {
+	bucket := []byte("bucket")
+	errAbort := errors.New("abort")
+
+	for name, s := range storageEngines(t) {
+		t.Run(name, func(t *testing.T) {
+			err := s.Update(func(tx db.Tx) error {
+				b, err := tx.CreateBucketIfNotExists(bucket)
+				if err != nil {
+					return err
+				}
+				for _, k := range []string{"c", "a", "b", "d"} {
+					if err := b.Put([]byte(k), []byte("value-"+k)); err != nil {
+						return err
+					}
+				}
+				if err := b.Delete([]byte("d")); err != nil {
+					return err
+				}
+				_, err = b.NextSequence()
+				return err
+			})
+			if err != nil {
+				t.Fatalf("Update: got error %v, want nil", err)
+			}
+
+			// A failed update must not change anything.
+			err = s.Update(func(tx db.Tx) error {
+				b := tx.Bucket(bucket)
+				b.Put([]byte("a"), []byte("changed"))
+				b.Put([]byte("e"), []byte("new"))
+				b.Delete([]byte("b"))
+				b.NextSequence()
+				tx.CreateBucketIfNotExists([]byte("other"))
+				return errAbort
+			})
+			if !errors.Is(err, errAbort) {
+				t.Fatalf("Update: got error %v, want %v", err, errAbort)
+			}
+
+			err = s.View(func(tx db.Tx) error {
+				if tx.Bucket([]byte("other")) != nil {
+					t.Errorf("Bucket %q exists after rollback", "other")
+				}
+
+				b := tx.Bucket(bucket)
+				if got := string(b.Get([]byte("a"))); got != "value-a" {
+					t.Errorf("Get(%q): got %q, want %q", "a", got, "value-a")
+				}
+				if got := b.Get([]byte("d")); got != nil {
+					t.Errorf("Get(%q): got %q, want nil", "d", got)
+				}
+				if got := b.Sequence(); got != 1 {
+					t.Errorf("Sequence: got %d, want 1", got)
+				}
+				if err := b.Put([]byte("x"), nil); err == nil {
+					t.Errorf("Put in read-only transaction: got nil error, want non-nil error")
+				}
+
+				var keys []string
+				c := b.Cursor()
+				for k, v := c.First(); k != nil; k, v = c.Next() {
+					if string(v) != "value-"+string(k) {
+						t.Errorf("Unexpected value for key %q: got %q", k, v)
+					}
+					keys = append(keys, string(k))
+				}
+				if want := []string{"a", "b", "c"}; !reflect.DeepEqual(keys, want) {
+					t.Errorf("Cursor: got keys %q, want %q", keys, want)
+				}
+
+				if k, _ := c.Seek([]byte("bb")); string(k) != "c" {
+					t.Errorf("Seek(%q): got %q, want %q", "bb", k, "c")
+				}
+				if k, _ := c.Next(); k != nil {
+					t.Errorf("Next after last key: got %q, want nil", k)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("View: got error %v, want nil", err)
+			}
+
+			err = s.Update(func(tx db.Tx) error {
+				return tx.DeleteBucket(bucket)
+			})
+			if err != nil {
+				t.Fatalf("DeleteBucket: got error %v, want nil", err)
+			}
+			s.View(func(tx db.Tx) error {
+				if tx.Bucket(bucket) != nil {
+					t.Errorf("Bucket %q exists after DeleteBucket", bucket)
+				}
+				return nil
+			})
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"encoding/binary"
+	"log"
+	"time"
+)
+
+// The ttl bucket of a namespace maps keys to their expiration time and the
+// expiry bucket indexes the same information by expiration time so that
+// the reaper can find expired keys without scanning all of them.
+var ttlBucket = []byte("ttl")
+var expiryBucket = []byte("expiry")
+
+const (
+	// reapInterval is how often the reaper looks for expired keys.
+	reapInterval = time.Second
+	// reapBatchSize is the maximum number of keys deleted in a single
+	// transaction by the reaper.
+	reapBatchSize = 1000
+)
+
+// expiryKey returns the key of the expiry bucket entry for the given key and
+// expiration time. Big-endian timestamps keep the bucket sorted by time.
+func expiryKey(key []byte, expiresAt uint64) []byte {
+	res := make([]byte, 8, 8+len(key))
+	binary.BigEndian.PutUint64(res, expiresAt)
+	return append(res, key...)
+}
+
+// setTTL records that the key expires at the given time.
+func (n *namespace) setTTL(tx Tx, key []byte, expiresAt time.Time) error {
+	ts := uint64(expiresAt.UnixNano())
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, ts)
+
+	if err := tx.Bucket(n.ttl).Put(key, v); err != nil {
+		return err
+	}
+	return tx.Bucket(n.expiry).Put(expiryKey(key, ts), nil)
+}
+
+// clearTTL removes the expiration time of the key, if any.
+func (n *namespace) clearTTL(tx Tx, key []byte) error {
+	b := tx.Bucket(n.ttl)
+	v := b.Get(key)
+	if v == nil {
+		return nil
+	}
+
+	if err := tx.Bucket(n.expiry).Delete(expiryKey(key, binary.BigEndian.Uint64(v))); err != nil {
+		return err
+	}
+	return b.Delete(key)
+}
+
+// expired reports whether the key has an expiration time that is not after
+// now.
+func (n *namespace) expired(tx Tx, key []byte, now time.Time) bool {
+	b := tx.Bucket(n.ttl)
+	if b == nil {
+		return false
+	}
+	v := b.Get(key)
+	return v != nil && binary.BigEndian.Uint64(v) <= uint64(now.UnixNano())
+}
+
+// reapLoop periodically deletes expired keys until stop is closed.
+// Replicas receive the deletions of expired keys through the replication
+// log, so the reaper only runs while the database accepts writes. On a
+// shard that uses consensus replication, only the leader runs it.
+func (d *DB) reapLoop(stop <-chan struct{}) {
+	t := time.NewTicker(reapInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		if d.readOnly.Load() || !d.leader() {
+			continue
+		}
+
+		for {
+			n, err := d.reapExpired(time.Now(), reapBatchSize)
+			if err != nil {
+				log.Printf("reapExpired: %v", err)
+				break
+			}
+			if n < reapBatchSize {
+				break
+			}
+		}
+	}
+}
+
+// reapExpired deletes at most limit keys that expired before or at now and
+// returns the number of deleted keys. The deletions are replicated like
+// any other deletion.
+func (d *DB) reapExpired(now time.Time, limit int) (n int, err error) {
+	err = d.commit(func(tx Tx) error {
+		all, err := namespaces(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, ns := range all {
+			var keys [][]byte
+			c := tx.Bucket(ns.expiry).Cursor()
+			for k, _ := c.First(); k != nil && n+len(keys) < limit; k, _ = c.Next() {
+				if binary.BigEndian.Uint64(k[:8]) > uint64(now.UnixNano()) {
+					break
+				}
+				keys = append(keys, copyByteSlice(k[8:]))
+			}
+
+			for _, k := range keys {
+				if err := d.deleteKey(tx, ns, k); err != nil {
+					return err
+				}
+			}
+			n += len(keys)
+		}
+		return nil
+	})
+	return n, err
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
 	"distributed-db/config"
 	"distributed-db/db"
+	"distributed-db/raft"
 	"distributed-db/replication"
 	"distributed-db/server"
 
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
 )
 
 var (
@@ -17,6 +21,9 @@ var (
 	configFile  = flag.String("configFile", "", "Config file for static sharding")
 	shard       = flag.String("shard", "", "Shard name to use")
 	replica     = flag.Bool("replica", false, "Whether this server is a read-only replica")
+	history     = flag.Int("history", 0, "Number of previous versions to keep for every key")
+	engine      = flag.String("engine", "bolt", "Storage engine to use: bolt, lsm or memory")
+	lsmSync     = flag.Bool("lsm-sync", true, "Sync the LSM engine's write-ahead log on every write; without it, acknowledged writes may be lost on a machine crash")
 )
 
 func parseFlags() {
@@ -27,7 +34,7 @@ func parseFlags() {
 			"Please provide a host and port using the -http-address flag.")
 	}
 
-	if *dbLocation == "" {
+	if *dbLocation == "" && *engine != "memory" {
 		log.Fatalf("db-location flag is missing. " +
 			"Pleae provide a path to the database file using the -db-location flag.")
 	}
@@ -40,7 +47,57 @@ func parseFlags() {
 	log.Printf("Connected to db at %s\n", *dbLocation)
 }
 
+// openStorage opens the storage engine selected with the -engine flag.
+func openStorage() (db.Storage, error) {
+	switch *engine {
+	case "bolt":
+		return db.OpenBolt(*dbLocation)
+	case "lsm":
+		return db.OpenLSM(*dbLocation, db.LSMOptions{SyncWrites: *lsmSync})
+	case "memory":
+		return db.NewMemoryStorage(), nil
+	}
+	return nil, fmt.Errorf("unknown storage engine %q", *engine)
+}
+
+// raftPeers returns the other members of the Raft group of the current
+// shard: its primary and its replicas, without self.
+func raftPeers(shards *config.Shards, self string) []string {
+	members := append([]string{shards.Addrs[shards.CurID]}, shards.Replicas[shards.CurID]...)
+
+	var peers []string
+	found := false
+	for _, m := range members {
+		if m == self {
+			found = true
+			continue
+		}
+		peers = append(peers, m)
+	}
+	if !found {
+		log.Fatalf("%s is not a member of shard %d", self, shards.CurID)
+	}
+	return peers
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backup":
+			runBackup(os.Args[2:])
+			return
+		case "restore":
+			runRestore(os.Args[2:])
+			return
+		case "split":
+			runSplit(os.Args[2:])
+			return
+		case "merge":
+			runMerge(os.Args[2:])
+			return
+		}
+	}
+
 	parseFlags()
 
 	c, err := config.ParseFile(*configFile)
@@ -48,33 +105,112 @@ func main() {
 		log.Fatalf("ParseFile: error parsing file %q: %v", *configFile, err)
 	}
 
-	shards, err := config.ParseShards(c.Shards, *shard)
+	shards, err := config.ParseConfig(c, *shard)
 	if err != nil {
-		log.Fatalf("ParseShards: %v", err)
+		log.Fatalf("ParseConfig: %v", err)
 	}
 
-	db, close, err := db.NewDB(*dbLocation, *replica)
+	// Every member of a Raft group accepts writes once it is elected.
+	useRaft := shards.Raft[shards.CurID]
+	if useRaft {
+		*replica = false
+	}
+
+	// A primary that was replaced while it was down rejoins its shard as a
+	// replica of the new primary.
+	if !*replica && !useRaft {
+		if addr, ok := replication.FindPrimary(shards.Replicas[shards.CurID]); ok {
+			log.Printf("Shard %d failed over to %s, starting as a replica", shards.CurID, addr)
+			shards = shards.WithPrimary(shards.CurID, addr)
+			*replica = true
+		}
+	}
+
+	store, err := openStorage()
+	if err != nil {
+		log.Fatalf("openStorage(%q, %q): %v", *engine, *dbLocation, err) // TODO: exposes db location
+	}
+
+	db, close, err := db.NewDBWithStorage(store, *replica)
 	if err != nil {
-		log.Fatalf("NewDB(%q): %v", *dbLocation, err) // TODO: exposes db location
+		log.Fatalf("NewDBWithStorage: %v", err)
 	}
 	defer close()
+	db.SetHistoryLimit(*history)
 
-	// TODO: add replication package
-	if *replica {
-		addr, ok := shards.Addrs[shards.CurID]
-		if !ok {
-			log.Fatalf("Could not find a main address for shard %d", shards.CurID)
+	// The primary keeps the changes of its log until all configured
+	// replicas have applied them.
+	if !*replica && !useRaft {
+		if err := db.SetReplicas(shards.Replicas[shards.CurID]); err != nil {
+			log.Fatalf("SetReplicas: %v", err)
 		}
-		go replication.ClientLoop(db, addr)
 	}
 
 	server := server.NewServer(db, shards)
 
+	if useRaft {
+		node, err := raft.NewNode(db, *httpAddress, raftPeers(shards, *httpAddress))
+		if err != nil {
+			log.Fatalf("raft.NewNode: %v", err)
+		}
+		db.SetProposer(node)
+		server.UseRaft(node)
+		go node.Run(context.Background())
+		go server.WatchLeader(context.Background())
+	}
+
+	// Changes of the config file that do not move keys between shards
+	// apply without a restart.
+	go config.Watch(context.Background(), *configFile, c, func(c config.Config) {
+		shards, err := config.ParseConfig(c, *shard)
+		if err == nil {
+			_, err = server.Reload(shards)
+		}
+		if err != nil {
+			log.Printf("Could not reload %q: %v", *configFile, err)
+		}
+	})
+
+	// Replicas follow the primary of their shard and take over when it
+	// fails.
+	if *replica {
+		go server.Follow(context.Background(), *httpAddress)
+	}
+
 	http.HandleFunc("/get", server.GetHandler)
 	http.HandleFunc("/set", server.SetHandler)
+	http.HandleFunc("/delete", server.DeleteHandler)
+	http.HandleFunc("/cas", server.CompareAndSwapHandler)
+	http.HandleFunc("/history", server.HistoryHandler)
+	http.HandleFunc("/namespaces", server.NamespacesHandler)
+	http.HandleFunc("/namespaces/create", server.CreateNamespaceHandler)
+	http.HandleFunc("/namespaces/drop", server.DropNamespaceHandler)
+	http.HandleFunc("/scan", server.ScanHandler)
+	http.HandleFunc("/mget", server.MultiGetHandler)
+	http.HandleFunc("/mset", server.MultiSetHandler)
 	http.HandleFunc("/purge", server.DeleteExtraKeysHandler)
-	http.HandleFunc("/next-replication-key", server.GetNextKeyForReplication)
-	http.HandleFunc("/delete-replication-key", server.DeleteReplicationKey)
+	http.HandleFunc("/purge/apply", server.PurgeApplyHandler)
+	http.HandleFunc("/backup", server.BackupHandler)
+	http.HandleFunc("/replication/log", server.ReplicationLogHandler)
+	http.HandleFunc("/replication/stream", server.ReplicationStreamHandler)
+	http.HandleFunc("/replication/position", server.PositionHandler)
+	http.HandleFunc("/replication/primary", server.PrimaryHandler)
+	http.HandleFunc("/replication/status", server.ReplicationStatusHandler)
+	http.HandleFunc("/replication/tree", server.MerkleTreeHandler)
+	http.HandleFunc("/replication/entries", server.MerkleEntriesHandler)
+	http.HandleFunc("/repair", server.RepairHandler)
+	http.HandleFunc("/routes", server.RoutesHandler)
+	http.HandleFunc("/reshard", server.ReshardHandler)
+	http.HandleFunc("/reshard/start", server.ReshardStartHandler)
+	http.HandleFunc("/reshard/status", server.ReshardStatusHandler)
+	http.HandleFunc("/reshard/freeze", server.ReshardFreezeHandler)
+	http.HandleFunc("/reshard/prepare", server.ReshardPrepareHandler)
+	http.HandleFunc("/reshard/commit", server.ReshardCommitHandler)
+	http.HandleFunc("/reshard/abort", server.ReshardAbortHandler)
+	http.HandleFunc("/reshard/apply", server.ReshardApplyHandler)
+	http.HandleFunc("/raft/vote", server.RaftVoteHandler)
+	http.HandleFunc("/raft/append", server.RaftAppendHandler)
+	http.HandleFunc("/raft/snapshot", server.RaftSnapshotHandler)
 
 	log.Fatal(server.ListenAndServe(httpAddress))
 }
@@ -0,0 +1,555 @@
+// Package raft replicates the writes of a shard to its replica group with
+// the Raft consensus algorithm. A write only succeeds once a majority of the
+// group stored it, so a shard survives the loss of a minority of its
+// members without losing acknowledged writes.
+//
+// The members of a group are the primary and the replicas of the shard in
+// the config file, identified by their addresses. The leader is elected by
+// the members and may be any of them.
+package raft
+
+import (
+	"context"
+	"distributed-db/db"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// HeartbeatInterval is how often the leader contacts every follower,
+	// even if there are no new entries.
+	HeartbeatInterval = 100 * time.Millisecond
+	// ElectionTimeout is the minimum time a follower waits for the leader
+	// before it starts an election. The actual timeout is randomized
+	// between one and two times this value to avoid split votes.
+	ElectionTimeout = 10 * HeartbeatInterval
+	// ProposeTimeout is how long a write waits for a majority of the group.
+	ProposeTimeout = 5 * time.Second
+
+	// maxEntries is the maximum number of entries sent in a single
+	// AppendEntries request.
+	maxEntries = 100
+	// compactThreshold is the number of applied entries kept in the log
+	// before it is compacted. Followers that fall further behind receive a
+	// snapshot of the database instead.
+	compactThreshold = 1000
+)
+
+var (
+	// ErrTimeout is returned by Propose if the entry was not committed in
+	// time. The write may still be applied later, so the leader steps down
+	// and leaves it to the next leader to commit or drop it.
+	ErrTimeout = errors.New("timed out waiting for a majority of the shard")
+	// ErrLeadershipLost is returned by Propose if the entry was replaced by
+	// the entry of a new leader.
+	ErrLeadershipLost = errors.New("lost the leadership before the write was committed")
+)
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+// waiter is a proposal waiting to be applied.
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+// Node is a member of the Raft group of a shard. It implements
+// db.Proposer, so that the writes to the database are replicated to the
+// group before they are applied.
+type Node struct {
+	db    *db.DB
+	id    string
+	peers []string
+
+	mu   sync.Mutex
+	role role
+	// term and vote are persisted before they are used.
+	term   uint64
+	vote   string
+	leader string
+	// heard is the last time the member heard from a leader or granted
+	// its vote, and timeout the randomized election timeout.
+	heard   time.Time
+	timeout time.Duration
+
+	lastIndex, lastTerm uint64
+	snapshotIndex       uint64
+	commitIndex         uint64
+	lastApplied         uint64
+	// readyIndex is the index of the first entry of the leader's term.
+	// The leader only accepts writes once it is applied, so that writes
+	// see the changes of all previous terms.
+	readyIndex uint64
+
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	waiters    map[uint64]*waiter
+
+	// commitCh wakes up the applier and replicateCh the goroutine that
+	// replicates the log to each peer.
+	commitCh    chan struct{}
+	replicateCh map[string]chan struct{}
+	// leaderChanged is closed and replaced when the known leader changes.
+	leaderChanged chan struct{}
+}
+
+// NewNode returns a member of a Raft group that stores its state in d. id
+// is the address of the member and peers the addresses of the other
+// members.
+func NewNode(d *db.DB, id string, peers []string) (*Node, error) {
+	st, err := d.RaftState()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := d.AppliedSequence()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		db:            d,
+		id:            id,
+		peers:         peers,
+		term:          st.Term,
+		vote:          st.Vote,
+		lastIndex:     st.LastIndex,
+		lastTerm:      st.LastTerm,
+		snapshotIndex: st.SnapshotIndex,
+		commitIndex:   applied,
+		lastApplied:   applied,
+		nextIndex:     make(map[string]uint64),
+		matchIndex:    make(map[string]uint64),
+		waiters:       make(map[uint64]*waiter),
+		commitCh:      make(chan struct{}, 1),
+		replicateCh:   make(map[string]chan struct{}),
+		leaderChanged: make(chan struct{}),
+	}
+	for _, p := range peers {
+		n.replicateCh[p] = make(chan struct{}, 1)
+	}
+	n.resetTimer()
+	return n, nil
+}
+
+// ID returns the address of the member.
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Leader returns the address of the current leader, or an empty string if
+// it is not known.
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+// LeaderChanged returns a channel that is closed once the known leader
+// changes.
+func (n *Node) LeaderChanged() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leaderChanged
+}
+
+// IsLeader reports whether the member is the leader and accepts writes.
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == leader && n.lastApplied >= n.readyIndex
+}
+
+// Run takes part in the elections and the replication of the group until
+// ctx is done.
+func (n *Node) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		n.applyLoop(ctx)
+	}()
+
+	t := time.NewTicker(HeartbeatInterval / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case <-t.C:
+		}
+
+		n.mu.Lock()
+		if n.role != leader && time.Since(n.heard) > n.timeout {
+			n.startElection(ctx)
+		}
+		n.mu.Unlock()
+	}
+}
+
+// Propose appends the changes to the log and returns once they were
+// committed and applied, or returns db.ErrNotLeader if the member is not
+// the leader. After ErrTimeout, the member is no longer the leader: the
+// next write must not be computed before the entry is resolved, which only
+// a new election guarantees.
+func (n *Node) Propose(changes []db.Change) error {
+	n.mu.Lock()
+	if n.role != leader || n.lastApplied < n.readyIndex {
+		n.mu.Unlock()
+		return db.ErrNotLeader
+	}
+
+	index, err := n.appendEntry(changes)
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	w := &waiter{term: n.term, done: make(chan error, 1)}
+	n.waiters[index] = w
+	n.mu.Unlock()
+
+	select {
+	case err := <-w.done:
+		return err
+	case <-time.After(ProposeTimeout):
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.waiters, index)
+		select {
+		case err := <-w.done:
+			return err
+		default:
+		}
+		if n.role == leader && n.term == w.term {
+			if err := n.becomeFollower(n.term); err != nil {
+				log.Printf("raft: %v", err)
+			}
+			n.setLeader("")
+		}
+		return ErrTimeout
+	}
+}
+
+// appendEntry appends an entry of the current term to the log of the
+// leader and starts replicating it.
+func (n *Node) appendEntry(changes []db.Change) (uint64, error) {
+	e := db.RaftEntry{Index: n.lastIndex + 1, Term: n.term, Changes: changes}
+	if err := n.db.AppendRaftEntries([]db.RaftEntry{e}); err != nil {
+		return 0, err
+	}
+	n.lastIndex, n.lastTerm = e.Index, e.Term
+
+	n.advanceCommit()
+	for _, ch := range n.replicateCh {
+		notify(ch)
+	}
+	return e.Index, nil
+}
+
+// notify wakes up the goroutine waiting on ch without blocking.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// resetTimer records that the member heard from a leader and picks a new
+// election timeout.
+func (n *Node) resetTimer() {
+	n.heard = time.Now()
+	n.timeout = ElectionTimeout + time.Duration(rand.Int63n(int64(ElectionTimeout)))
+}
+
+// setLeader records the address of the current leader.
+func (n *Node) setLeader(addr string) {
+	if n.leader == addr {
+		return
+	}
+	n.leader = addr
+	close(n.leaderChanged)
+	n.leaderChanged = make(chan struct{})
+}
+
+// setTerm persists the term and the vote of the member.
+func (n *Node) setTerm(term uint64, vote string) error {
+	if err := n.db.SetRaftTerm(term, vote); err != nil {
+		return err
+	}
+	n.term, n.vote = term, vote
+	return nil
+}
+
+// becomeFollower steps down after learning about a newer term.
+func (n *Node) becomeFollower(term uint64) error {
+	if term > n.term {
+		if err := n.setTerm(term, ""); err != nil {
+			return err
+		}
+		n.setLeader("")
+	}
+	if n.role == leader {
+		log.Printf("raft: %s stepped down in term %d", n.id, n.term)
+	}
+	n.role = follower
+	return nil
+}
+
+// majority returns the number of members that form a majority.
+func (n *Node) majority() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+// startElection votes for the member itself in a new term and asks the
+// peers for their votes.
+func (n *Node) startElection(ctx context.Context) {
+	if err := n.setTerm(n.term+1, n.id); err != nil {
+		log.Printf("raft: %v", err)
+		return
+	}
+	n.role = candidate
+	n.setLeader("")
+	n.resetTimer()
+
+	term := n.term
+	req := &VoteRequest{Term: term, Candidate: n.id, LastIndex: n.lastIndex, LastTerm: n.lastTerm}
+	votes := 1
+	if votes >= n.majority() {
+		n.becomeLeader(ctx)
+		return
+	}
+
+	for _, p := range n.peers {
+		go func(p string) {
+			resp, err := requestVote(ctx, p, req)
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				if err := n.becomeFollower(resp.Term); err != nil {
+					log.Printf("raft: %v", err)
+				}
+				return
+			}
+			if n.role != candidate || n.term != term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes == n.majority() {
+				n.becomeLeader(ctx)
+			}
+		}(p)
+	}
+}
+
+// becomeLeader starts replicating the log to the peers after winning an
+// election. The leader appends an empty entry to commit the entries of
+// previous terms.
+func (n *Node) becomeLeader(ctx context.Context) {
+	n.role = leader
+	n.setLeader(n.id)
+	for _, p := range n.peers {
+		n.nextIndex[p] = n.lastIndex + 1
+		n.matchIndex[p] = 0
+	}
+	log.Printf("raft: %s is the leader in term %d", n.id, n.term)
+
+	index, err := n.appendEntry(nil)
+	if err != nil {
+		log.Printf("raft: %v", err)
+		n.becomeFollower(n.term)
+		return
+	}
+	n.readyIndex = index
+
+	for _, p := range n.peers {
+		go n.replicate(ctx, p, n.term)
+	}
+}
+
+// advanceCommit commits the entries of the current term that a majority of
+// the group stored.
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex; index > n.commitIndex && index >= n.readyIndex; index-- {
+		count := 1
+		for _, p := range n.peers {
+			if n.matchIndex[p] >= index {
+				count++
+			}
+		}
+		if count >= n.majority() {
+			n.commitIndex = index
+			notify(n.commitCh)
+			return
+		}
+	}
+}
+
+// replicate sends the entries of the log to the peer while the member is
+// the leader of the given term.
+func (n *Node) replicate(ctx context.Context, peer string, term uint64) {
+	for ctx.Err() == nil {
+		n.mu.Lock()
+		if n.role != leader || n.term != term {
+			n.mu.Unlock()
+			return
+		}
+
+		var resp *AppendResponse
+		var err error
+		next := n.nextIndex[peer]
+		if next <= n.snapshotIndex {
+			n.mu.Unlock()
+			resp, err = installSnapshot(ctx, peer, term, n.id, n.db)
+		} else {
+			var req *AppendRequest
+			req, err = n.appendRequest(next)
+			n.mu.Unlock()
+			if err == nil {
+				resp, err = appendEntries(ctx, peer, req)
+			}
+		}
+
+		more := false
+		if err == nil {
+			n.mu.Lock()
+			more = n.handleAppendResponse(peer, term, resp)
+			n.mu.Unlock()
+		}
+
+		if !more {
+			select {
+			case <-ctx.Done():
+			case <-n.replicateCh[peer]:
+			case <-time.After(HeartbeatInterval):
+			}
+		}
+	}
+}
+
+// appendRequest returns the request that sends the entries starting at
+// next to a follower.
+func (n *Node) appendRequest(next uint64) (*AppendRequest, error) {
+	req := &AppendRequest{Term: n.term, Leader: n.id, PrevIndex: next - 1, Commit: n.commitIndex}
+	if req.PrevIndex > 0 {
+		term, err := n.db.RaftTerm(req.PrevIndex)
+		if err != nil {
+			return nil, err
+		}
+		req.PrevTerm = term
+	}
+
+	entries, err := n.db.RaftEntries(next, maxEntries)
+	if err != nil {
+		return nil, err
+	}
+	req.Entries = entries
+	return req, nil
+}
+
+// handleAppendResponse updates the progress of the peer and reports whether
+// there are more entries to send right away.
+func (n *Node) handleAppendResponse(peer string, term uint64, resp *AppendResponse) bool {
+	if resp.Term > n.term {
+		if err := n.becomeFollower(resp.Term); err != nil {
+			log.Printf("raft: %v", err)
+		}
+		return false
+	}
+	if n.role != leader || n.term != term {
+		return false
+	}
+
+	if !resp.Success {
+		n.nextIndex[peer] = max(1, min(n.nextIndex[peer]-1, resp.LastIndex+1))
+		return true
+	}
+	if resp.LastIndex > n.matchIndex[peer] {
+		n.matchIndex[peer] = resp.LastIndex
+		n.advanceCommit()
+	}
+	n.nextIndex[peer] = resp.LastIndex + 1
+	return n.nextIndex[peer] <= n.lastIndex
+}
+
+// applyLoop applies the committed entries to the database in order until
+// ctx is done.
+func (n *Node) applyLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.commitCh:
+		}
+
+		for {
+			n.mu.Lock()
+			from, to := n.lastApplied+1, n.commitIndex
+			n.mu.Unlock()
+			if from > to {
+				break
+			}
+
+			entries, err := n.db.RaftEntries(from, int(min(to-from+1, maxEntries)))
+			if err == nil && (len(entries) == 0 || entries[0].Index != from) {
+				// The entries were replaced by a snapshot.
+				break
+			}
+			for i := 0; err == nil && i < len(entries); i++ {
+				err = n.apply(&entries[i])
+			}
+			if err != nil {
+				log.Printf("raft: applying entries: %v", err)
+				break
+			}
+		}
+		n.compact()
+	}
+}
+
+// apply applies a committed entry and completes the proposal waiting for it.
+func (n *Node) apply(e *db.RaftEntry) error {
+	if err := n.db.ApplyEntry(e); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lastApplied = max(n.lastApplied, e.Index)
+	if w, ok := n.waiters[e.Index]; ok {
+		delete(n.waiters, e.Index)
+		if w.term == e.Term {
+			w.done <- nil
+		} else {
+			w.done <- ErrLeadershipLost
+		}
+	}
+	return nil
+}
+
+// compact removes applied entries from the log once there are enough of
+// them. The database holds their changes.
+func (n *Node) compact() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.lastApplied-n.snapshotIndex <= compactThreshold {
+		return
+	}
+	if err := n.db.CompactRaftLog(n.lastApplied); err != nil {
+		log.Printf("raft: compacting the log: %v", err)
+		return
+	}
+	n.snapshotIndex = n.lastApplied
+}
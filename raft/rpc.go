@@ -0,0 +1,259 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"distributed-db/db"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// The members of a group call each other over HTTP: RequestVote and
+// AppendEntries send and receive JSON on /raft/vote and /raft/append, and
+// InstallSnapshot sends a snapshot of the database on /raft/snapshot.
+
+// VoteRequest asks a member to vote for the candidate in the given term.
+// LastIndex and LastTerm identify the last entry of the candidate's log.
+type VoteRequest struct {
+	Term      uint64
+	Candidate string
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+// VoteResponse is the answer to a VoteRequest.
+type VoteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+// AppendRequest sends the entries that follow the entry at PrevIndex to a
+// follower. Commit is the commit index of the leader.
+type AppendRequest struct {
+	Term      uint64
+	Leader    string
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []db.RaftEntry
+	Commit    uint64
+}
+
+// AppendResponse is the answer to an AppendRequest and to a snapshot.
+// LastIndex is the index of the last entry that matches the leader's log
+// after a success, or a hint for the next attempt after a failure.
+type AppendResponse struct {
+	Term      uint64
+	Success   bool
+	LastIndex uint64
+}
+
+// rpcClient is used for votes and entries. Snapshots can take longer and
+// are only bounded by the context.
+var rpcClient = &http.Client{Timeout: ElectionTimeout / 2}
+
+// call posts req as JSON to the member at addr and decodes the response.
+func call(ctx context.Context, addr, path string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+addr+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	return do(rpcClient, r, resp)
+}
+
+// do sends the request and decodes the JSON response.
+func do(client *http.Client, r *http.Request, resp any) error {
+	res, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%s: status %s: %s", r.URL.Path, res.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+func requestVote(ctx context.Context, addr string, req *VoteRequest) (*VoteResponse, error) {
+	var resp VoteResponse
+	if err := call(ctx, addr, "/raft/vote", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func appendEntries(ctx context.Context, addr string, req *AppendRequest) (*AppendResponse, error) {
+	var resp AppendResponse
+	if err := call(ctx, addr, "/raft/append", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// installSnapshot streams a snapshot of the leader's database to the
+// follower at addr.
+func installSnapshot(ctx context.Context, addr string, term uint64, leader string, d *db.DB) (*AppendResponse, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := d.WriteSnapshot(pw)
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+
+	u := url.Values{}
+	u.Set("term", strconv.FormatUint(term, 10))
+	u.Set("leader", leader)
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+addr+"/raft/snapshot?"+u.Encode(), pr)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/octet-stream")
+
+	var resp AppendResponse
+	if err := do(http.DefaultClient, r, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// HandleVote answers a VoteRequest. The vote is persisted before the
+// answer is sent.
+func (n *Node) HandleVote(req *VoteRequest) (*VoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term > n.term {
+		if err := n.becomeFollower(req.Term); err != nil {
+			return nil, err
+		}
+	}
+
+	resp := &VoteResponse{Term: n.term}
+	upToDate := req.LastTerm > n.lastTerm || req.LastTerm == n.lastTerm && req.LastIndex >= n.lastIndex
+	if req.Term == n.term && (n.vote == "" || n.vote == req.Candidate) && upToDate {
+		if err := n.setTerm(n.term, req.Candidate); err != nil {
+			return nil, err
+		}
+		n.resetTimer()
+		resp.Granted = true
+	}
+	return resp, nil
+}
+
+// follow accepts the sender of a request of the given term as the leader.
+// It reports false if the request is from an older term.
+func (n *Node) follow(term uint64, addr string) (bool, error) {
+	if term < n.term {
+		return false, nil
+	}
+	if term > n.term || n.role != follower {
+		if err := n.becomeFollower(term); err != nil {
+			return false, err
+		}
+	}
+	n.setLeader(addr)
+	n.resetTimer()
+	return true, nil
+}
+
+// HandleAppend stores the entries of an AppendRequest that are not in the
+// log yet, replacing conflicting ones, and commits the entries that the
+// leader committed. The entries are persisted before the answer is sent.
+func (n *Node) HandleAppend(req *AppendRequest) (*AppendResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	ok, err := n.follow(req.Term, req.Leader)
+	if err != nil {
+		return nil, err
+	}
+	resp := &AppendResponse{Term: n.term, LastIndex: n.lastIndex}
+	if !ok || req.PrevIndex > n.lastIndex {
+		return resp, nil
+	}
+
+	// Entries up to the snapshot are committed, so they match the log of
+	// every leader.
+	if req.PrevIndex > n.snapshotIndex {
+		term, err := n.db.RaftTerm(req.PrevIndex)
+		if err != nil {
+			return nil, err
+		}
+		if term != req.PrevTerm {
+			resp.LastIndex = req.PrevIndex - 1
+			return resp, nil
+		}
+	}
+
+	for i, e := range req.Entries {
+		if e.Index <= n.snapshotIndex {
+			continue
+		}
+		if e.Index <= n.lastIndex {
+			term, err := n.db.RaftTerm(e.Index)
+			if err != nil {
+				return nil, err
+			}
+			if term == e.Term {
+				continue
+			}
+		}
+
+		// The entry is new or conflicts with the leader's log.
+		if err := n.db.AppendRaftEntries(req.Entries[i:]); err != nil {
+			return nil, err
+		}
+		last := req.Entries[len(req.Entries)-1]
+		n.lastIndex, n.lastTerm = last.Index, last.Term
+		break
+	}
+
+	matched := req.PrevIndex + uint64(len(req.Entries))
+	if commit := min(req.Commit, matched); commit > n.commitIndex {
+		n.commitIndex = commit
+		notify(n.commitCh)
+	}
+
+	resp.Success, resp.LastIndex = true, matched
+	return resp, nil
+}
+
+// HandleSnapshot replaces the database of a follower that is too far
+// behind the leader with the snapshot read from r.
+func (n *Node) HandleSnapshot(term uint64, leader string, r io.Reader) (*AppendResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	ok, err := n.follow(term, leader)
+	if err != nil {
+		return nil, err
+	}
+	resp := &AppendResponse{Term: n.term, LastIndex: n.lastIndex}
+	if !ok {
+		return resp, nil
+	}
+
+	index, lastTerm, err := n.db.InstallRaftSnapshot(r)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("raft: %s installed a snapshot of %s at %d", n.id, leader, index)
+
+	n.snapshotIndex, n.lastIndex, n.lastTerm = index, index, lastTerm
+	n.commitIndex, n.lastApplied = index, index
+	n.resetTimer()
+
+	resp.Success, resp.LastIndex = true, index
+	return resp, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"distributed-db/config"
+
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// findShard returns the named shard of the config.
+func findShard(c config.Config, name string) (config.Shard, error) {
+	for _, s := range c.Shards {
+		if s.Name == name {
+			return s, nil
+		}
+	}
+	return config.Shard{}, fmt.Errorf("shard %q not found in config file", name)
+}
+
+// runSplit splits the range of a shard at a key and moves the keys from
+// that key on to a new shard.
+func runSplit(args []string) {
+	fs := flag.NewFlagSet("split", flag.ExitOnError)
+	configFile := fs.String("configFile", "", "Config file for range sharding")
+	shard := fs.String("shard", "", "Shard name whose range to split")
+	at := fs.String("at", "", "First key of the new shard")
+	name := fs.String("name", "", "Shard name of the new shard")
+	address := fs.String("address", "", "HTTP host and port of the new shard")
+	replicas := fs.String("replicas", "", "Comma-separated addresses of the replicas of the new shard")
+	dryRun := fs.Bool("dry-run", false, "Print the new config instead of applying it")
+	fs.Parse(args)
+
+	if *configFile == "" || *shard == "" || *at == "" || *name == "" || *address == "" {
+		log.Fatalf("split needs the -configFile, -shard, -at, -name and -address flags")
+	}
+
+	c, err := config.ParseFile(*configFile)
+	if err != nil {
+		log.Fatalf("ParseFile: error parsing file %q: %v", *configFile, err)
+	}
+	cur, err := findShard(c, *shard)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := config.Shard{Name: *name, Address: *address}
+	if *replicas != "" {
+		s.Replicas = strings.Split(*replicas, ",")
+	}
+	next, err := config.SplitRange(c, cur.ShardID, *at, s)
+	if err != nil {
+		log.Fatalf("SplitRange: %v", err)
+	}
+	applyConfig(*configFile, next, cur.Address, *dryRun)
+}
+
+// runMerge merges the range of a shard into the range before it and moves
+// the keys of the shard to the shard that owns that range.
+func runMerge(args []string) {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	configFile := fs.String("configFile", "", "Config file for range sharding")
+	shard := fs.String("shard", "", "Shard name whose range to merge into the range before it")
+	dryRun := fs.Bool("dry-run", false, "Print the new config instead of applying it")
+	fs.Parse(args)
+
+	if *configFile == "" || *shard == "" {
+		log.Fatalf("merge needs the -configFile and -shard flags")
+	}
+
+	c, err := config.ParseFile(*configFile)
+	if err != nil {
+		log.Fatalf("ParseFile: error parsing file %q: %v", *configFile, err)
+	}
+	cur, err := findShard(c, *shard)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	next, err := config.MergeRange(c, cur.ShardID)
+	if err != nil {
+		log.Fatalf("MergeRange: %v", err)
+	}
+	applyConfig(*configFile, next, cur.Address, *dryRun)
+}
+
+// applyConfig reshards the cluster to the config c through the server at
+// addr and then replaces the config file with it. With dryRun, it only
+// prints c.
+func applyConfig(configFile string, c config.Config, addr string, dryRun bool) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(c); err != nil {
+		log.Fatalf("Could not encode the new config: %v", err)
+	}
+	if _, err := config.ParseConfig(c, c.Shards[0].Name); err != nil {
+		log.Fatalf("Invalid new config: %v", err)
+	}
+	if dryRun {
+		os.Stdout.Write(buf.Bytes())
+		return
+	}
+
+	resp, err := http.Post("http://"+addr+"/reshard", "application/toml", bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		log.Fatalf("Resharding failed: %v", err)
+	}
+	msg, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	// With 202 Accepted, the cluster switched to the new config, but some
+	// servers did not yet.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		log.Fatalf("Resharding failed: status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	log.Printf("%s", bytes.TrimSpace(msg))
+
+	// The file is replaced at once so that no server reads a partial
+	// config.
+	tmp, err := os.CreateTemp(filepath.Dir(configFile), filepath.Base(configFile)+".*")
+	if err != nil {
+		log.Fatalf("Could not write the new config: %v", err)
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), configFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Fatalf("The cluster was resharded, but the config file could not be replaced: %v", err)
+	}
+	log.Printf("Wrote the new config to %s", configFile)
+}
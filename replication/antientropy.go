@@ -0,0 +1,163 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"distributed-db/db"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AntiEntropyInterval is how often a replica compares its keys with those
+// of the primary to repair changes that it missed.
+const AntiEntropyInterval = time.Minute
+
+// RepairResult describes the repair of a namespace of a replica. Leaves is
+// the number of leaves of the hash trees that differed from the primary
+// and Repaired the number of keys that were set or deleted.
+type RepairResult struct {
+	Namespace string
+	Leaves    int
+	Repaired  int
+}
+
+// AntiEntropy repairs the keys of the replica that differ from the primary
+// at addr every AntiEntropyInterval until ctx is done.
+func AntiEntropy(ctx context.Context, db *db.DB, addr string) {
+	t := time.NewTicker(AntiEntropyInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		results, err := Repair(ctx, db, addr)
+		if err != nil {
+			log.Printf("AntiEntropy: %s: %v", addr, err)
+			continue
+		}
+		for _, res := range results {
+			if res.Repaired > 0 {
+				log.Printf("AntiEntropy: repaired %d keys of namespace %q in %d leaves", res.Repaired, res.Namespace, res.Leaves)
+			}
+		}
+	}
+}
+
+// Repair compares the hash trees of all namespaces of the replica and of
+// the primary at addr and copies the keys of the leaves that differ from
+// the primary. Keys that are only on the replica are deleted.
+func Repair(ctx context.Context, d *db.DB, addr string) ([]RepairResult, error) {
+	var remote []string
+	if err := getJSON(ctx, addr, "/namespaces", url.Values{"local": {"true"}}, &remote); err != nil {
+		return nil, err
+	}
+	local, err := d.Namespaces()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for _, ns := range append(remote, local...) {
+		seen[ns] = true
+	}
+	names := make([]string, 0, len(seen))
+	for ns := range seen {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+
+	var results []RepairResult
+	for _, ns := range names {
+		res, err := repairNamespace(ctx, d, addr, ns)
+		if err != nil {
+			return results, fmt.Errorf("namespace %q: %w", ns, err)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// repairNamespace descends the hash trees of a namespace from the root to
+// find the leaves that differ from the primary and repairs their keys.
+func repairNamespace(ctx context.Context, d *db.DB, addr, ns string) (RepairResult, error) {
+	res := RepairResult{Namespace: ns}
+	tree, err := d.MerkleTree(ns)
+	if err != nil {
+		return res, err
+	}
+
+	var leaves []int
+	for nodes := []int{1}; len(nodes) > 0; {
+		var hashes [][]byte
+		if err := getJSON(ctx, addr, "/replication/tree", url.Values{"ns": {ns}, "nodes": {joinInts(nodes)}}, &hashes); err != nil {
+			return res, err
+		}
+		if len(hashes) != len(nodes) {
+			return res, fmt.Errorf("got %d hashes for %d nodes", len(hashes), len(nodes))
+		}
+
+		var next []int
+		for i, node := range nodes {
+			switch {
+			case bytes.Equal(hashes[i], tree.Node(node)):
+			case node >= db.MerkleLeaves:
+				leaves = append(leaves, node-db.MerkleLeaves)
+			default:
+				next = append(next, 2*node, 2*node+1)
+			}
+		}
+		nodes = next
+	}
+	res.Leaves = len(leaves)
+	if len(leaves) == 0 {
+		return res, nil
+	}
+
+	var entries []db.Change
+	if err := getJSON(ctx, addr, "/replication/entries", url.Values{"ns": {ns}, "leaves": {joinInts(leaves)}}, &entries); err != nil {
+		return res, err
+	}
+	res.Repaired, err = d.Repair(ns, leaves, entries)
+	return res, err
+}
+
+// joinInts returns the numbers as a comma-separated list.
+func joinInts(nums []int) string {
+	s := make([]string, len(nums))
+	for i, n := range nums {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ",")
+}
+
+// getJSON requests path on the server at addr and decodes the JSON
+// response into v.
+func getJSON(ctx context.Context, addr, path string, params url.Values, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: status %s: %s", path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -1,101 +1,247 @@
 package replication
 
 import (
-	"bytes"
+	"bufio"
+	"context"
 	"distributed-db/db"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 )
 
-// NextKeyValue is a struct to hold the next key-value pair for replication.
-type NextKeyValue struct {
-	Key   string
-	Value string
-	Err   error
+// Protocol is the name of the protocol that a replica asks the primary to
+// switch to on /replication/stream. After the switch, the primary writes
+// JSON arrays of changes to the connection as soon as they are committed,
+// and the replica answers every batch with an Ack once it has applied it.
+// An empty batch is a heartbeat and is acknowledged as well.
+const Protocol = "jdbgo-replication"
+
+// HeartbeatInterval is how often the primary sends an empty batch on an
+// idle stream. Both sides drop a stream that stays silent for much longer.
+const HeartbeatInterval = time.Second
+
+// StreamTimeout is how long either side of a stream waits for the other
+// before it considers the stream broken.
+const StreamTimeout = 5 * HeartbeatInterval
+
+// MaxBatchSize is the largest number of changes the primary sends in a
+// single batch. A smaller batch holds all changes the primary had, so the
+// replica is up to date once it applied it.
+const MaxBatchSize = 1000
+
+// Ack is sent by a replica after applying a batch. Applied is the sequence
+// number of the last change the replica has applied.
+type Ack struct {
+	Applied uint64
 }
 
+// Position is reported by every server of a shard on /replication/position.
+// Primary is set if the server accepts writes. Applied is the sequence
+// number of the last change in the log of a primary, or of the last change
+// applied by a replica. Lag is how far behind the primary the server may
+// be; see Status.Lag.
+type Position struct {
+	Primary bool
+	Applied uint64
+	Lag     time.Duration
+}
+
+// positionClient is used for health checks, which must not hang on a
+// server that stopped responding.
+var positionClient = &http.Client{Timeout: HeartbeatInterval}
+
+// FetchPosition returns the position of the server at addr. An error means
+// that the server is not healthy.
+func FetchPosition(addr string) (*Position, error) {
+	resp, err := positionClient.Get("http://" + addr + "/replication/position")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("status %s: %s", resp.Status, msg)
+	}
+
+	var pos Position
+	if err := json.NewDecoder(resp.Body).Decode(&pos); err != nil {
+		return nil, err
+	}
+	return &pos, nil
+}
+
+// FindPrimary returns the address of the first of the given servers that
+// reports being a primary. Servers that cannot be reached are skipped.
+func FindPrimary(addrs []string) (string, bool) {
+	for _, addr := range addrs {
+		if pos, err := FetchPosition(addr); err == nil && pos.Primary {
+			return addr, true
+		}
+	}
+	return "", false
+}
+
+// errLogTruncated is returned when the primary no longer has the changes
+// that follow the replica's position.
+var errLogTruncated = errors.New("the primary truncated its log past our position")
+
 type client struct {
 	db       *db.DB
 	mainAddr string
+	// id identifies the replica to the primary, which keeps the changes
+	// that the replica has not applied yet.
+	id     string
+	status *Status
 }
 
-// ClientLoop continuously polls the server for new key-value pairs to replicate.
-func ClientLoop(db *db.DB, addr string) {
-	c := &client{db: db, mainAddr: addr}
-	for {
-		present, err := c.loop()
+// ClientLoop continuously replicates the changes of the server at addr.
+// id identifies this replica to the server.
+func ClientLoop(db *db.DB, addr, id string) {
+	Run(context.Background(), db, addr, id, nil)
+}
 
+// Run replicates the changes of the server at addr until ctx is done,
+// reconnecting whenever the stream breaks. When the primary no longer has
+// the changes that follow the replica's position, for example for a new
+// replica that joins after the log was truncated, the replica bootstraps
+// from a snapshot of the primary and catches up from the log. The state of
+// the replication is kept in st, which may be nil.
+func Run(ctx context.Context, db *db.DB, addr, id string, st *Status) {
+	if st == nil {
+		st = &Status{}
+	}
+	c := &client{db: db, mainAddr: addr, id: id, status: st}
+	st.start(addr)
+	for ctx.Err() == nil {
+		err := c.stream(ctx)
+		if errors.Is(err, errLogTruncated) {
+			log.Printf("ClientLoop: %v, bootstrapping from a snapshot\n", err)
+			st.bootstrapped()
+			err = c.bootstrap(ctx)
+			if err == nil {
+				continue
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
 		if err != nil {
 			log.Printf("ClientLoop: %v\n", err)
-			time.Sleep(time.Second)
-			continue
 		}
 
-		if !present {
-			time.Sleep(time.Millisecond * 100)
+		select {
+		case <-ctx.Done():
+		case <-time.After(st.failed(err)):
 		}
 	}
+	st.stop()
 }
 
-func (c *client) loop() (present bool, err error) {
-	resp, err := http.Get("http://" + c.mainAddr + "/next-replication-key")
+// stream opens a replication stream to the primary and applies the batches
+// it receives until the stream breaks.
+func (c *client) stream(ctx context.Context) error {
+	applied, err := c.db.AppliedSequence()
 	if err != nil {
-		return false, err
+		return err
 	}
 
-	var res NextKeyValue
-	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
-		return false, err
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.mainAddr)
+	if err != nil {
+		return err
 	}
+	defer conn.Close()
 
-	defer resp.Body.Close()
+	// Unblock reads and writes when the context is canceled.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
 
-	if res.Err != nil {
-		return false, res.Err
-	}
+	u := url.Values{}
+	u.Set("replica", c.id)
+	u.Set("after", strconv.FormatUint(applied, 10))
 
-	if res.Key == "" {
-		return false, nil
+	req, err := http.NewRequest(http.MethodGet, "http://"+c.mainAddr+"/replication/stream?"+u.Encode(), nil)
+	if err != nil {
+		return err
 	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", Protocol)
 
-	if err := c.db.SetKeyOnReplica(res.Key, []byte(res.Value)); err != nil {
-		return false, err
+	conn.SetDeadline(time.Now().Add(StreamTimeout))
+	if err := req.Write(conn); err != nil {
+		return err
 	}
 
-	if err := c.deleteFromReplicationQueue(res.Key, res.Value); err != nil {
-		log.Printf("DeleteKeyFromReplication failed: %v", err)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		msg, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusGone {
+			return fmt.Errorf("after change %d: %w", applied, errLogTruncated)
+		}
+		return fmt.Errorf("status %s: %s", resp.Status, msg)
 	}
 
-	return true, nil
-}
+	dec := json.NewDecoder(r)
+	enc := json.NewEncoder(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(StreamTimeout))
 
-func (c *client) deleteFromReplicationQueue(key, value string) error {
-	u := url.Values{}
-	u.Set("key", key)
-	u.Set("value", value)
+		var changes []db.Change
+		if err := dec.Decode(&changes); err != nil {
+			return err
+		}
+		received := time.Now()
 
-	log.Printf("Deleting key=%q, value=%q, from replication queue on %q", key, value, c.mainAddr)
+		if len(changes) > 0 {
+			if err := c.db.ApplyChanges(changes); err != nil {
+				return err
+			}
+			applied = changes[len(changes)-1].Seq
+		}
+		c.status.received(received, applied, len(changes) < MaxBatchSize)
+
+		if err := enc.Encode(&Ack{Applied: applied}); err != nil {
+			return err
+		}
+	}
+}
 
-	resp, err := http.Get("http://" + c.mainAddr + "/delete-replication-key?" + u.Encode())
+// bootstrap replaces the data of the replica with a snapshot of the primary
+// and records the position of the primary's log that the snapshot
+// corresponds to, so that the next stream resumes from there.
+func (c *client) bootstrap(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+c.mainAddr+"/backup", nil)
 	if err != nil {
 		return err
 	}
-
-	defer resp.Body.Close()
-
-	res, err := io.ReadAll(resp.Body)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
-	res = bytes.TrimSpace(res)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("bootstrap: status %s: %s", resp.Status, msg)
+	}
 
-	if !bytes.Equal(res, []byte("ok")) {
-		return errors.New(string(res))
+	seq, err := c.db.LoadSnapshot(resp.Body)
+	if err != nil {
+		return fmt.Errorf("bootstrap: %w", err)
 	}
+	log.Printf("ClientLoop: loaded a snapshot of %s at change %d\n", c.mainAddr, seq)
 	return nil
 }
@@ -0,0 +1,127 @@
+package replication
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// minRetryInterval is how long a replica waits before it reconnects
+	// after the first failure.
+	minRetryInterval = time.Second
+	// maxRetryInterval bounds the wait after consecutive failures, which
+	// doubles with every failure.
+	maxRetryInterval = 10 * time.Second
+)
+
+// Status is the state of the replication of a replica. It is safe for
+// concurrent use.
+type Status struct {
+	mu       sync.Mutex
+	report   Report
+	syncedAt time.Time
+}
+
+// Report is a snapshot of the Status of a replica. Primary is the address
+// of the server it replicates and Applied the sequence number of the last
+// change that it applied from the stream. LastContact is the time it last
+// received a batch and LagSeconds is its Lag in seconds, or -1 if it never
+// caught up. Errors counts the broken streams and ConsecutiveErrors those
+// since the last batch; BackoffSeconds is how long the replica waits
+// before it reconnects, or zero while it is connected.
+type Report struct {
+	Primary           string
+	Connected         bool
+	Applied           uint64
+	LastContact       time.Time
+	LagSeconds        float64
+	Errors            int
+	ConsecutiveErrors int
+	LastError         string
+	Bootstraps        int
+	BackoffSeconds    float64
+}
+
+// Lag returns how long ago the replica last had all changes of the
+// primary, which bounds the staleness of its reads. A replica that never
+// caught up is infinitely stale.
+func (st *Status) Lag() time.Duration {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return time.Since(st.syncedAt)
+}
+
+// Report returns a snapshot of the status.
+func (st *Status) Report() Report {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	r := st.report
+	r.LagSeconds = -1
+	if !st.syncedAt.IsZero() {
+		r.LagSeconds = time.Since(st.syncedAt).Seconds()
+	}
+	return r
+}
+
+// start records that the replica replicates the primary at addr.
+func (st *Status) start(addr string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.report.Primary = addr
+	st.report.ConsecutiveErrors = 0
+	st.report.BackoffSeconds = 0
+}
+
+// stop records that the replica stopped replicating.
+func (st *Status) stop() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.report.Connected = false
+	st.report.BackoffSeconds = 0
+}
+
+// received records a batch received at t, after which the replica applied
+// the changes up to applied. caughtUp is set if the batch held all changes
+// of the primary.
+func (st *Status) received(t time.Time, applied uint64, caughtUp bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.report.Connected = true
+	st.report.Applied = applied
+	st.report.LastContact = t
+	st.report.ConsecutiveErrors = 0
+	st.report.BackoffSeconds = 0
+	if caughtUp {
+		st.syncedAt = t
+	}
+}
+
+// bootstrapped records that the replica loads a snapshot of the primary.
+func (st *Status) bootstrapped() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.report.Bootstraps++
+}
+
+// failed records that the stream broke with err and returns how long to
+// wait before reconnecting.
+func (st *Status) failed(err error) time.Duration {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.report.Connected = false
+	st.report.Errors++
+	st.report.ConsecutiveErrors++
+	if err != nil {
+		st.report.LastError = err.Error()
+	}
+
+	backoff := minRetryInterval
+	for i := 1; i < st.report.ConsecutiveErrors && backoff < maxRetryInterval; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, maxRetryInterval)
+	st.report.BackoffSeconds = backoff.Seconds()
+	return backoff
+}
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"context"
+	"distributed-db/replication"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// healthInterval is how often a replica checks that the primary of its
+	// shard is up.
+	healthInterval = time.Second
+	// failureThreshold is the number of consecutive failed health checks
+	// after which the replicas of a shard elect a new primary.
+	failureThreshold = 3
+)
+
+// announceClient does not wait for long on servers that are down.
+var announceClient = &http.Client{Timeout: 5 * time.Second}
+
+// PositionHandler reports whether the server is the primary of its shard,
+// its position in the replication log and its replication lag as a
+// replication.Position. Replicas use it to check the health of their
+// primary and to find the most up-to-date replica when the primary fails,
+// and all servers to route reads to replicas that are recent enough.
+func (s *Server) PositionHandler(w http.ResponseWriter, r *http.Request) {
+	pos := replication.Position{Primary: s.primary(), Lag: s.lag()}
+	var err error
+	if pos.Primary {
+		pos.Applied, err = s.db.LogSequence()
+	} else {
+		pos.Applied, err = s.db.AppliedSequence()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+	json.NewEncoder(w).Encode(&pos)
+}
+
+// PrimaryHandler updates the routing table after the server at the addr
+// parameter became the primary of the shard given by the shard parameter.
+// Only servers of the cluster may announce a primary, and only a server of
+// the shard may become its primary. A primary of that shard that is still
+// up steps down and follows the new primary, so that it stops accepting
+// writes that the new primary would never see, once the new primary
+// confirms that it has all changes of this one. A Raft leader responds
+// with 409 Conflict instead, since Raft elects the leaders of its shard.
+func (s *Server) PrimaryHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.peersOnly(w, r) {
+		return
+	}
+	r.ParseForm()
+	addr := r.Form.Get("addr")
+	shards := s.shards()
+
+	shard, err := strconv.Atoi(r.Form.Get("shard"))
+	if _, ok := shards.Addrs[shard]; err != nil || !ok || addr == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: invalid shard %q or addr %q\n", r.Form.Get("shard"), addr)
+		return
+	}
+	if addr != shards.Addrs[shard] && !slices.Contains(shards.Replicas[shard], addr) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: %s is not a server of shard %d\n", addr, shard)
+		return
+	}
+
+	if shard == shards.CurID && s.primary() && addr != shards.Addrs[shard] {
+		if s.raft != nil {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "error: %s is the primary of shard %d\n", shards.Addrs[shard], shard)
+			return
+		}
+		if err := s.stepDown(addr); err != nil {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "error: %v\n", err)
+			return
+		}
+		fmt.Fprintf(w, "ok\n")
+		return
+	}
+
+	s.setPrimary(shard, addr)
+	fmt.Fprintf(w, "ok\n")
+}
+
+// stepDown turns this primary into a replica of the primary at addr that
+// replaced it while it was still up, like a primary that restarts after
+// being replaced. It fails unless addr reports being a primary with all
+// changes of this server's log.
+func (s *Server) stepDown(addr string) error {
+	seq, err := s.db.LogSequence()
+	if err != nil {
+		return err
+	}
+	pos, err := replication.FetchPosition(addr)
+	if err != nil {
+		return fmt.Errorf("checking the position of %s: %w", addr, err)
+	}
+	if !pos.Primary || pos.Applied < seq {
+		return fmt.Errorf("%s is not a primary at change %d or later", addr, seq)
+	}
+
+	shards := s.shards()
+	self := shards.Addrs[shards.CurID]
+	if err := s.db.Demote(); err != nil {
+		return err
+	}
+	s.setPrimary(shards.CurID, addr)
+	log.Printf("Stepped down as primary of shard %d, following %s", shards.CurID, addr)
+
+	go s.Follow(s.ctx, self)
+	return nil
+}
+
+// setPrimary routes the requests for the shard to the primary at addr.
+func (s *Server) setPrimary(shard int, addr string) {
+	for {
+		old := s.routes.Load()
+		if old.Addrs[shard] == addr {
+			return
+		}
+		if s.routes.CompareAndSwap(old, old.WithPrimary(shard, addr)) {
+			log.Printf("Shard %d: new primary %s (was %s)", shard, addr, old.Addrs[shard])
+			return
+		}
+	}
+}
+
+// discoverPrimary asks the replicas of the shard whether one of them was
+// promoted, for servers that missed the announcement of the new primary.
+// It reports whether the routing table changed.
+func (s *Server) discoverPrimary(shard int) bool {
+	shards := s.shards()
+	addr, ok := replication.FindPrimary(shards.Replicas[shard])
+	if !ok || addr == shards.Addrs[shard] {
+		return false
+	}
+	s.setPrimary(shard, addr)
+	return true
+}
+
+// Follow replicates the primary of the server's shard until ctx is done
+// and periodically repairs the keys that differ from the primary. self is
+// the address of this replica. When the primary fails its health
+// checks, the replicas of the shard promote the most up-to-date one among
+// them, which announces itself to all other servers. Follow returns once
+// this replica has been promoted.
+func (s *Server) Follow(ctx context.Context, self string) {
+	for ctx.Err() == nil {
+		primary := s.shards().Addrs[s.shards().CurID]
+
+		rctx, cancel := context.WithCancel(ctx)
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			replication.Run(rctx, s.db, primary, self, &s.status)
+		}()
+		go func() {
+			defer wg.Done()
+			replication.AntiEntropy(rctx, s.db, primary)
+		}()
+		elected := s.watchPrimary(ctx, self, primary)
+		cancel()
+		wg.Wait()
+
+		if elected {
+			if err := s.promote(self); err != nil {
+				log.Printf("Follow: promoting %s: %v", self, err)
+				continue
+			}
+			return
+		}
+	}
+}
+
+// watchPrimary checks the health of the primary at addr until ctx is done,
+// the routing table names another primary or this replica is elected to
+// replace it. It reports whether this replica was elected.
+func (s *Server) watchPrimary(ctx context.Context, self, addr string) bool {
+	t := time.NewTicker(healthInterval)
+	defer t.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-t.C:
+		}
+
+		if s.shards().Addrs[s.shards().CurID] != addr {
+			return false
+		}
+		if _, err := replication.FetchPosition(addr); err == nil {
+			failures = 0
+			continue
+		}
+
+		failures++
+		if failures == failureThreshold {
+			log.Printf("Follow: primary %s failed %d health checks", addr, failures)
+		}
+		if failures >= failureThreshold && s.elect(self) {
+			return true
+		}
+	}
+}
+
+// elect compares the position of this replica with the other replicas of
+// the shard and reports whether this one should become the primary: the
+// replica that applied the most changes wins and ties go to the smallest
+// address. Replicas that cannot be reached do not take part. If another
+// replica already took over, the routing table is updated instead.
+func (s *Server) elect(self string) bool {
+	shards := s.shards()
+	best, err := s.db.AppliedSequence()
+	if err != nil {
+		log.Printf("Follow: %v", err)
+		return false
+	}
+
+	winner := self
+	for _, addr := range shards.Replicas[shards.CurID] {
+		if addr == self {
+			continue
+		}
+		pos, err := replication.FetchPosition(addr)
+		if err != nil {
+			continue
+		}
+		if pos.Primary {
+			s.setPrimary(shards.CurID, addr)
+			return false
+		}
+		if pos.Applied > best || pos.Applied == best && addr < winner {
+			best, winner = pos.Applied, addr
+		}
+	}
+	return winner == self
+}
+
+// promote makes this replica the primary of its shard and announces it to
+// the other servers.
+func (s *Server) promote(self string) error {
+	if err := s.db.Promote(); err != nil {
+		return err
+	}
+	s.setPrimary(s.shards().CurID, self)
+
+	// The log keeps the changes for the other replicas, including the old
+	// primary once it rejoins as a replica.
+	shards := s.shards()
+	if err := s.db.SetReplicas(shards.Replicas[shards.CurID]); err != nil {
+		log.Printf("Follow: SetReplicas: %v", err)
+	}
+	log.Printf("Promoted %s to primary of shard %d", self, shards.CurID)
+
+	s.announcePrimary(self)
+	return nil
+}
+
+// announcePrimary tells the primaries and the replicas of all shards that
+// self is the new primary of this server's shard. Servers that miss the
+// announcement find the new primary when they fail to reach the old one.
+func (s *Server) announcePrimary(self string) {
+	shards := s.shards()
+	var addrs []string
+	for _, addr := range shards.Addrs {
+		addrs = append(addrs, addr)
+	}
+	for _, replicas := range shards.Replicas {
+		addrs = append(addrs, replicas...)
+	}
+
+	form := url.Values{"shard": {strconv.Itoa(shards.CurID)}, "addr": {self}}
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		if addr == self {
+			continue
+		}
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+
+			req, err := http.NewRequest(http.MethodPost, "http://"+addr+"/replication/primary", strings.NewReader(form.Encode()))
+			if err != nil {
+				log.Printf("announcePrimary: %s: %v", addr, err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set(peerHeader, "true")
+			resp, err := announceClient.Do(req)
+			if err != nil {
+				log.Printf("announcePrimary: %s: %v", addr, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				log.Printf("announcePrimary: %s: status %s", addr, resp.Status)
+			}
+		}(addr)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"distributed-db/config"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// peerHeader marks the requests that a server sends to another server of
+// the cluster, such as requests it forwards to be served locally. It is
+// only trusted on requests from the hosts of the servers in the config, so
+// clients on other hosts cannot skip the routing of their requests or call
+// the endpoints that only servers use.
+//
+// Trusting the source address is not authentication: any client on the
+// host of a server, or that can spoof its address, passes as a peer. With
+// all servers on one host, every local client does.
+const peerHeader = "X-Peer"
+
+// peerSet is the set of IP addresses of the servers of the cluster.
+type peerSet map[string]bool
+
+// resolvePeers resolves the addresses of the servers in the routing
+// tables, so that fromPeer does not look them up on every request. It is
+// called whenever the server switches to another config, with the config
+// that a resharding moves to while one is in progress. Addresses that
+// cannot be resolved are logged and skipped.
+func (s *Server) resolvePeers(tables ...*config.Shards) {
+	peers := make(peerSet)
+	add := func(addr string) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			log.Printf("resolvePeers: %v", err)
+			return
+		}
+		// Addresses without a host listen on all interfaces of the
+		// local machine.
+		if host == "" {
+			peers[net.IPv4(127, 0, 0, 1).String()] = true
+			peers[net.IPv6loopback.String()] = true
+			return
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			peers[ip.String()] = true
+			return
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			log.Printf("resolvePeers: %v", err)
+			return
+		}
+		for _, ip := range ips {
+			peers[ip.String()] = true
+		}
+	}
+	for _, shards := range tables {
+		for id, addr := range shards.Addrs {
+			add(addr)
+			for _, replica := range shards.Replicas[id] {
+				add(replica)
+			}
+		}
+	}
+	s.peers.Store(&peers)
+}
+
+// forwarded reports whether r was routed to this server by another server
+// of the cluster with local=true.
+func (s *Server) forwarded(r *http.Request) bool {
+	return r.Form.Get("local") == "true" && s.fromPeer(r)
+}
+
+// fromPeer reports whether r carries peerHeader and comes from the host of
+// one of the servers in the config.
+func (s *Server) fromPeer(r *http.Request) bool {
+	if r.Header.Get(peerHeader) == "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (*s.peers.Load())[ip.String()]
+}
+
+// peersOnly responds with 403 Forbidden and reports false if r does not
+// come from another server of the cluster.
+func (s *Server) peersOnly(w http.ResponseWriter, r *http.Request) bool {
+	if s.fromPeer(r) {
+		return true
+	}
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, "error: only servers of the cluster may call %s\n", r.URL.Path)
+	return false
+}
+
+// peerGet is http.Get for requests forwarded to another server.
+func peerGet(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(peerHeader, "true")
+	return http.DefaultClient.Do(req)
+}
+
+// peerPostForm is http.PostForm for requests forwarded to another server.
+func peerPostForm(url string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(peerHeader, "true")
+	return http.DefaultClient.Do(req)
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"distributed-db/config"
+	"distributed-db/db"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Modes of /purge.
+const (
+	// purgeRebalance moves the keys that belong to other shards to their
+	// owners before it deletes them.
+	purgeRebalance = "rebalance"
+	// purgeDelete deletes the keys that belong to other shards right away.
+	purgeDelete = "delete"
+)
+
+const (
+	// purgeBatch is the number of keys sent to their owner in a single
+	// request.
+	purgeBatch = 100
+	// purgeAttempts is how often a batch is sent before the purge gives up.
+	purgeAttempts = 5
+	// purgeRetry is how long the purge waits before it sends a batch
+	// again. It doubles with every attempt.
+	purgeRetry = time.Second
+)
+
+// flush sends what was written to w so far to the client.
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// DeleteExtraKeysHandler deletes the keys that do not belong to the
+// current shard. By default, or with mode=rebalance, it first sends them
+// in batches to the shards that own them and only deletes a key once its
+// owner confirmed that it has it, reporting the progress after every
+// batch. Keys that changed in the meantime are kept for the next purge.
+// With mode=delete, it deletes them without moving them. With
+// dry_run=true, it only reports how many keys would move to every shard.
+func (s *Server) DeleteExtraKeysHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	shards := s.shards()
+	dryRun := r.Form.Get("dry_run") == "true"
+
+	switch mode := r.Form.Get("mode"); mode {
+	case "", purgeRebalance:
+	case purgeDelete:
+		if !dryRun {
+			fmt.Fprintf(w, "Error: %v\n", s.db.DeleteExtraKeys(func(key string) bool {
+				return shards.Id(key) != shards.CurID
+			}))
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: invalid mode %q\n", mode)
+		return
+	}
+
+	if dryRun {
+		counts, err := s.countExtraKeys(shards)
+		ids := make([]int, 0, len(counts))
+		total := 0
+		for id, n := range counts {
+			ids = append(ids, id)
+			total += n
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			fmt.Fprintf(w, "Shard : %d, Keys : %d\n", id, counts[id])
+		}
+		fmt.Fprintf(w, "Total : %d, Error : %v\n", total, err)
+		return
+	}
+
+	if !s.primary() {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: keys move from the primary of the shard, whose replicas follow its deletions\n")
+		return
+	}
+	s.reshardMu.Lock()
+	resharding := s.migration != nil
+	s.reshardMu.Unlock()
+	if resharding {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "error: a resharding is in progress\n")
+		return
+	}
+
+	moved, kept, err := s.rebalance(r.Context(), shards, w)
+	fmt.Fprintf(w, "Moved : %d, Kept : %d, Error : %v\n", moved, kept, err)
+}
+
+// countExtraKeys returns the number of keys of all namespaces that belong
+// to other shards, by shard.
+func (s *Server) countExtraKeys(shards *config.Shards) (map[int]int, error) {
+	counts, err := s.db.CountKeys(shards.Id)
+	if err != nil {
+		return nil, err
+	}
+	delete(counts, shards.CurID)
+	return counts, nil
+}
+
+// rebalance moves the keys of all namespaces that belong to other shards
+// to their owners, writing a line to w after every batch. It returns the
+// number of keys that were moved and of those that changed while they
+// were moved and were kept.
+func (s *Server) rebalance(ctx context.Context, shards *config.Shards, w http.ResponseWriter) (moved, kept int, err error) {
+	names, err := s.db.Namespaces()
+	if err != nil {
+		return 0, 0, err
+	}
+	extra := func(key string) bool { return shards.Id(key) != shards.CurID }
+
+	for _, ns := range names {
+		var after []byte
+		for {
+			changes, last, err := s.db.ExportKeys(ns, after, purgeBatch, extra)
+			if err != nil {
+				return moved, kept, fmt.Errorf("namespace %q: %w", ns, err)
+			}
+
+			batches := make(map[int][]db.Change)
+			for _, c := range changes {
+				id := shards.Id(string(c.Key))
+				batches[id] = append(batches[id], c)
+			}
+			ids := make([]int, 0, len(batches))
+			for id := range batches {
+				ids = append(ids, id)
+			}
+			sort.Ints(ids)
+
+			for _, id := range ids {
+				batch := batches[id]
+				if err := sendMisplaced(ctx, shards.Addrs[id], batch); err != nil {
+					return moved, kept, fmt.Errorf("shard %d: %w", id, err)
+				}
+				n, err := s.db.DeleteExported(batch)
+				if err != nil {
+					return moved, kept, err
+				}
+				moved += n
+				kept += len(batch) - n
+				fmt.Fprintf(w, "Namespace : %q, Shard : %d, Moved : %d, Kept : %d\n", ns, id, n, len(batch)-n)
+				flush(w)
+			}
+
+			if last == nil {
+				break
+			}
+			after = last
+		}
+	}
+	return moved, kept, nil
+}
+
+// sendMisplaced sends keys to the primary at addr of the shard that owns
+// them, trying up to purgeAttempts times.
+func sendMisplaced(ctx context.Context, addr string, changes []db.Change) error {
+	wait := purgeRetry
+	for attempt := 1; ; attempt++ {
+		err := postJSON(ctx, addr, "/purge/apply", changes, nil)
+		if err == nil || attempt == purgeAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// PurgeApplyHandler adopts the keys sent as a JSON array of db.Change by a
+// shard that purges them. Keys that already exist were written since they
+// moved and are kept. Deletions leave no trace, so a key that was deleted
+// here since it moved comes back with the value it had before the move.
+// Responds with 409 Conflict if a key does not belong to the current shard.
+// Only other servers of the cluster may call it.
+func (s *Server) PurgeApplyHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.peersOnly(w, r) {
+		return
+	}
+
+	var changes []db.Change
+	if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+
+	shards := s.shards()
+	for _, c := range changes {
+		if id := shards.Id(string(c.Key)); id != shards.CurID {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "error: key %q belongs to shard %d\n", c.Key, id)
+			return
+		}
+	}
+
+	if _, err := s.db.AdoptKeys(changes); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "ok\n")
+}
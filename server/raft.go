@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"distributed-db/raft"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// UseRaft makes the server a member of the Raft group of its shard. It
+// must be called before the server handles requests.
+func (s *Server) UseRaft(n *raft.Node) {
+	s.raft = n
+}
+
+// primary reports whether the server accepts writes for its shard.
+func (s *Server) primary() bool {
+	if s.raft != nil {
+		return s.raft.IsLeader()
+	}
+	return !s.db.ReadOnly()
+}
+
+// WatchLeader routes the requests for the server's shard to the leader of
+// its Raft group until ctx is done. A member that becomes the leader
+// announces itself to all other servers, like a promoted replica.
+func (s *Server) WatchLeader(ctx context.Context) {
+	for {
+		changed := s.raft.LeaderChanged()
+		if leader := s.raft.Leader(); leader != "" {
+			s.setPrimary(s.shards().CurID, leader)
+			if leader == s.raft.ID() {
+				s.announcePrimary(leader)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+// RaftVoteHandler answers the vote requests of candidates of the shard's
+// Raft group.
+func (s *Server) RaftVoteHandler(w http.ResponseWriter, r *http.Request) {
+	var req raft.VoteRequest
+	if !s.decodeRaftRequest(w, r, &req) {
+		return
+	}
+	resp, err := s.raft.HandleVote(&req)
+	s.writeRaftResponse(w, resp, err)
+}
+
+// RaftAppendHandler stores the entries sent by the leader of the shard's
+// Raft group.
+func (s *Server) RaftAppendHandler(w http.ResponseWriter, r *http.Request) {
+	var req raft.AppendRequest
+	if !s.decodeRaftRequest(w, r, &req) {
+		return
+	}
+	resp, err := s.raft.HandleAppend(&req)
+	s.writeRaftResponse(w, resp, err)
+}
+
+// RaftSnapshotHandler replaces the database with the snapshot sent by the
+// leader of the shard's Raft group in the request body. Parameters: term
+// and leader identify the sender.
+func (s *Server) RaftSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if s.raft == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "error: shard %d does not use raft replication\n", s.shards().CurID)
+		return
+	}
+
+	term, err := strconv.ParseUint(r.URL.Query().Get("term"), 10, 64)
+	leader := r.URL.Query().Get("leader")
+	if err != nil || leader == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: invalid term %q or leader %q\n", r.URL.Query().Get("term"), leader)
+		return
+	}
+
+	resp, err := s.raft.HandleSnapshot(term, leader, r.Body)
+	s.writeRaftResponse(w, resp, err)
+}
+
+// decodeRaftRequest decodes the JSON request of a member of the shard's
+// Raft group and reports whether it succeeded.
+func (s *Server) decodeRaftRequest(w http.ResponseWriter, r *http.Request, req any) bool {
+	if s.raft == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "error: shard %d does not use raft replication\n", s.shards().CurID)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: %v\n", err)
+		return false
+	}
+	return true
+}
+
+// writeRaftResponse writes the JSON response to a member of the shard's
+// Raft group.
+func (s *Server) writeRaftResponse(w http.ResponseWriter, resp any, err error) {
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
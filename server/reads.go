@@ -0,0 +1,137 @@
+package server
+
+import (
+	"distributed-db/replication"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// lagTTL is how long the replication lag reported by a replica is used to
+// route reads before it is fetched again.
+const lagTTL = replication.HeartbeatInterval
+
+// lagSample is the replication lag of a replica as fetched at a point in
+// time. err is set if the replica could not be reached.
+type lagSample struct {
+	lag time.Duration
+	at  time.Time
+	err error
+}
+
+// parseStaleness parses the consistency and max_staleness parameters of a
+// read. consistency is "strong" (the default) to read from the primary of
+// the shard or "eventual" to allow reading from any of its replicas.
+// max_staleness allows reading from replicas that are at most that far
+// behind the primary and implies eventual consistency. It reports whether
+// the read may be served by a replica and the lag that is acceptable.
+func parseStaleness(form url.Values) (time.Duration, bool, error) {
+	bound, ok := time.Duration(math.MaxInt64), false
+	switch c := form.Get("consistency"); c {
+	case "", "strong":
+	case "eventual":
+		ok = true
+	default:
+		return 0, false, fmt.Errorf("invalid consistency %q", c)
+	}
+
+	if m := form.Get("max_staleness"); m != "" {
+		var err error
+		if bound, err = time.ParseDuration(m); err != nil || bound <= 0 {
+			return 0, false, fmt.Errorf("invalid max_staleness %q", m)
+		}
+		ok = true
+	}
+	return bound, ok, nil
+}
+
+// lag returns how far behind the primary of its shard the server may be.
+func (s *Server) lag() time.Duration {
+	if s.primary() {
+		return 0
+	}
+	return s.status.Lag()
+}
+
+// replicaLag returns the replication lag of the replica at addr, as
+// reported on /replication/position at most lagTTL ago. The time since
+// the lag was fetched is added to it.
+func (s *Server) replicaLag(addr string) (time.Duration, error) {
+	s.lagsMu.Lock()
+	sample, ok := s.lags[addr]
+	s.lagsMu.Unlock()
+
+	if !ok || time.Since(sample.at) > lagTTL {
+		sample = lagSample{at: time.Now()}
+		if pos, err := replication.FetchPosition(addr); err != nil {
+			sample.err = err
+		} else {
+			sample.lag = pos.Lag
+		}
+
+		s.lagsMu.Lock()
+		s.lags[addr] = sample
+		s.lagsMu.Unlock()
+	}
+
+	if sample.err != nil {
+		return 0, sample.err
+	}
+	if sample.lag > math.MaxInt64-time.Since(sample.at) {
+		return math.MaxInt64, nil
+	}
+	return sample.lag + time.Since(sample.at), nil
+}
+
+// localRead reports whether a read of a key of the shard that accepts a
+// lag of up to bound is handled by this server, and forwards it otherwise.
+// Members of the shard that are recent enough serve the read themselves.
+// Other servers forward it to the replicas of the shard in turn, skipping
+// those that are too far behind, and to the primary if none is recent
+// enough. Shards that use Raft replication always read from the leader.
+func (s *Server) localRead(shard int, bound time.Duration, w http.ResponseWriter, r *http.Request) bool {
+	// The read was routed to this server by another one.
+	if s.forwarded(r) {
+		return true
+	}
+
+	shards := s.shards()
+	if shards.Raft[shard] {
+		return s.local(shard, w, r)
+	}
+	if shard == shards.CurID && s.lag() <= bound {
+		return true
+	}
+
+	form := url.Values{}
+	for k, v := range r.Form {
+		form[k] = v
+	}
+	form.Set("local", "true")
+
+	replicas := shards.Replicas[shard]
+	start := s.nextReplica.Add(1)
+	for i := range replicas {
+		addr := replicas[(start+uint64(i))%uint64(len(replicas))]
+		if lag, err := s.replicaLag(addr); err != nil || lag > bound {
+			continue
+		}
+
+		url := "http://" + addr + r.URL.Path + "?" + form.Encode()
+		resp, err := peerGet(url)
+		if err != nil {
+			continue
+		}
+		s.relay(shard, url, resp, nil, w)
+		return false
+	}
+
+	// No replica is recent enough.
+	if shard == shards.CurID {
+		s.redirect(shard, w, r)
+		return false
+	}
+	return s.local(shard, w, r)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"distributed-db/config"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+)
+
+// RoutingTable is the routing table of a server, returned by /routes.
+// Shard is the shard of the server, or -1 if it owns no keys, and
+// Primaries and Replicas are the addresses of the servers of every shard.
+type RoutingTable struct {
+	Epoch     uint64
+	Shard     int
+	Count     int
+	Primaries map[int]string
+	Replicas  map[int][]string
+}
+
+// members returns the addresses of the primary and the replicas of a
+// shard, sorted.
+func members(shards *config.Shards, id int) []string {
+	res := append([]string{shards.Addrs[id]}, shards.Replicas[id]...)
+	slices.Sort(res)
+	return res
+}
+
+// Reload switches the server to the routing table of a config that was
+// changed without resharding, such as a config with new replicas. It
+// returns the epoch of the new routing table.
+//
+// The server keeps its shard and every key keeps its owner: a config that
+// assigns the server or any key to another shard is rejected, since the
+// keys would not move. So is a config that changes the members of the
+// server's Raft group. Primaries that took over from the primary in the
+// config stay the primaries of their shards.
+func (s *Server) Reload(next *config.Shards) (uint64, error) {
+	s.reshardMu.Lock()
+	defer s.reshardMu.Unlock()
+	if s.migration != nil {
+		return 0, errors.New("a resharding is in progress")
+	}
+
+	var routes *config.Shards
+	for {
+		cur := s.shards()
+		if next.CurID != cur.CurID {
+			return 0, fmt.Errorf("the config moves the server from shard %d to shard %d; reshard the cluster to move its keys", cur.CurID, next.CurID)
+		}
+		if !next.SameOwners(cur) {
+			return 0, errors.New("the config assigns keys to other shards; POST it to /reshard to move them")
+		}
+		if s.raft != nil && (!next.Raft[next.CurID] || !slices.Equal(members(cur, cur.CurID), members(next, next.CurID))) {
+			return 0, fmt.Errorf("the config changes the Raft group of shard %d, which needs a restart", cur.CurID)
+		}
+
+		routes = next
+		for id, addr := range cur.Addrs {
+			if addr != routes.Addrs[id] && slices.Contains(routes.Replicas[id], addr) {
+				routes = routes.WithPrimary(id, addr)
+			}
+		}
+		r := *routes
+		r.Epoch = cur.Epoch + 1
+		if s.routes.CompareAndSwap(cur, &r) {
+			routes = &r
+			break
+		}
+	}
+	s.resolvePeers(routes)
+	log.Printf("Reload: switched to %d shards (epoch %d)", routes.Count, routes.Epoch)
+
+	// The primary keeps its log for the replicas of the new config.
+	if s.raft == nil && s.primary() && routes.CurID >= 0 {
+		if err := s.db.SetReplicas(routes.Replicas[routes.CurID]); err != nil {
+			return routes.Epoch, fmt.Errorf("SetReplicas: %w", err)
+		}
+	}
+	return routes.Epoch, nil
+}
+
+// RoutesHandler returns the RoutingTable of the server as JSON.
+func (s *Server) RoutesHandler(w http.ResponseWriter, r *http.Request) {
+	shards := s.shards()
+	json.NewEncoder(w).Encode(&RoutingTable{
+		Epoch:     shards.Epoch,
+		Shard:     shards.CurID,
+		Count:     shards.Count,
+		Primaries: shards.Addrs,
+		Replicas:  shards.Replicas,
+	})
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"distributed-db/db"
+	"distributed-db/replication"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// merkleCache is the hash tree of a namespace at a position of the log.
+// A replica requests every level of the tree separately, so the primary
+// reuses it as long as no change was committed.
+type merkleCache struct {
+	seq  uint64
+	tree *db.MerkleTree
+}
+
+// ReplicaRepair is the result of /repair on a replica. Err is empty if
+// the repair succeeded.
+type ReplicaRepair struct {
+	Replica string
+	Results []replication.RepairResult
+	Err     string
+}
+
+// parseInts parses a comma-separated list of numbers in [0, max).
+func parseInts(s string, max int) ([]int, error) {
+	var res []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 || n >= max {
+			return nil, fmt.Errorf("invalid number %q", f)
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+// merkleTree returns the hash tree of a namespace.
+func (s *Server) merkleTree(ns string) (*db.MerkleTree, error) {
+	seq, err := s.db.LogSequence()
+	if err != nil {
+		return nil, err
+	}
+
+	s.treesMu.Lock()
+	defer s.treesMu.Unlock()
+	if c, ok := s.trees[ns]; ok && c.seq == seq {
+		return c.tree, nil
+	}
+	tree, err := s.db.MerkleTree(ns)
+	if err != nil {
+		return nil, err
+	}
+	s.trees[ns] = merkleCache{seq: seq, tree: tree}
+	return tree, nil
+}
+
+// MerkleTreeHandler returns the hashes of the nodes of the hash tree of
+// the namespace given by the ns parameter as a JSON array. The nodes
+// parameter is a comma-separated list of node numbers; see db.MerkleTree.
+func (s *Server) MerkleTreeHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	nodes, err := parseInts(r.Form.Get("nodes"), 2*db.MerkleLeaves)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: nodes: %v\n", err)
+		return
+	}
+
+	tree, err := s.merkleTree(r.Form.Get("ns"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+
+	hashes := make([][]byte, len(nodes))
+	for i, node := range nodes {
+		hashes[i] = tree.Node(node)
+	}
+	json.NewEncoder(w).Encode(hashes)
+}
+
+// MerkleEntriesHandler returns the keys of the namespace given by the ns
+// parameter that belong to the leaves of its hash tree given by the
+// comma-separated leaves parameter, as a JSON array of db.Change.
+func (s *Server) MerkleEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	leaves, err := parseInts(r.Form.Get("leaves"), db.MerkleLeaves)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: leaves: %v\n", err)
+		return
+	}
+
+	entries, err := s.db.MerkleEntries(r.Form.Get("ns"), leaves)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+	if entries == nil {
+		entries = []db.Change{}
+	}
+	json.NewEncoder(w).Encode(entries)
+}
+
+// RepairHandler compares the keys of a replica with those of the primary
+// of its shard and repairs the ones that differ, like the periodic
+// anti-entropy does, and returns a JSON array of
+// replication.RepairResult. On the primary, it repairs all replicas of the
+// shard and returns a JSON array of ReplicaRepair.
+func (s *Server) RepairHandler(w http.ResponseWriter, r *http.Request) {
+	shards := s.shards()
+	if s.raft != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: shards with raft replication do not need repairs\n")
+		return
+	}
+
+	if !s.primary() {
+		results, err := replication.Repair(r.Context(), s.db, shards.Addrs[shards.CurID])
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprintf(w, "error: %v\n", err)
+			return
+		}
+		if results == nil {
+			results = []replication.RepairResult{}
+		}
+		json.NewEncoder(w).Encode(results)
+		return
+	}
+
+	replicas := shards.Replicas[shards.CurID]
+	res := make([]ReplicaRepair, len(replicas))
+	var wg sync.WaitGroup
+	for i, addr := range replicas {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+
+			res[i].Replica = addr
+			resp, err := http.Post("http://"+addr+"/repair", "", nil)
+			if err != nil {
+				res[i].Err = err.Error()
+				return
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				res[i].Err = fmt.Sprintf("status %s", resp.Status)
+				return
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&res[i].Results); err != nil {
+				res[i].Err = err.Error()
+			}
+		}(i, addr)
+	}
+	wg.Wait()
+
+	json.NewEncoder(w).Encode(res)
+}
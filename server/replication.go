@@ -0,0 +1,265 @@
+package server
+
+import (
+	"context"
+	"distributed-db/db"
+	"distributed-db/replication"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultLogLimit is the number of changes returned by /replication/log
+	// without a limit parameter.
+	defaultLogLimit = 100
+	// maxLogLimit is the largest number of changes a replica can request.
+	maxLogLimit = replication.MaxBatchSize
+
+	// defaultAckTimeout is how long a write waits for the replicas
+	// without an ack_timeout parameter.
+	defaultAckTimeout = 5 * time.Second
+)
+
+// errAckTimeout is returned when a write was committed locally but not
+// applied by enough replicas in time.
+var errAckTimeout = errors.New("write committed locally but not applied by enough replicas")
+
+// ackLevel is the durability a client asked for: the number of replicas
+// that must apply a write before it is acknowledged, -1 for all of them.
+type ackLevel struct {
+	replicas int
+	timeout  time.Duration
+}
+
+// parseAck parses the ack and ack_timeout parameters of a write. ack is
+// "local" (the default) to acknowledge the write once it is committed on
+// the primary, a number N to wait until N replicas applied it or "all" to
+// wait for all registered replicas. ack_timeout bounds the wait.
+func (s *Server) parseAck(form url.Values) (ackLevel, error) {
+	ack := ackLevel{timeout: defaultAckTimeout}
+	switch a := form.Get("ack"); a {
+	case "", "local":
+		return ack, nil
+	case "all":
+		ack.replicas = -1
+	default:
+		n, err := strconv.Atoi(a)
+		if err != nil || n < 0 {
+			return ack, fmt.Errorf("invalid ack %q", a)
+		}
+		ack.replicas = n
+	}
+
+	if t := form.Get("ack_timeout"); t != "" {
+		var err error
+		if ack.timeout, err = time.ParseDuration(t); err != nil || ack.timeout <= 0 {
+			return ack, fmt.Errorf("invalid ack_timeout %q", t)
+		}
+	}
+
+	// Raft writes are always acknowledged by a majority of the group.
+	if s.raft != nil {
+		return ack, fmt.Errorf("ack is not supported on shards with raft replication")
+	}
+	if ack.replicas > 0 {
+		replicas, err := s.db.Replicas()
+		if err != nil {
+			return ack, err
+		}
+		if ack.replicas > len(replicas) {
+			return ack, fmt.Errorf("ack %d: shard only has %d replicas", ack.replicas, len(replicas))
+		}
+	}
+	return ack, nil
+}
+
+// waitForReplicas waits until the replicas required by ack applied all
+// changes committed so far, which include the write of the request.
+func (s *Server) waitForReplicas(ack ackLevel) error {
+	if ack.replicas == 0 {
+		return nil
+	}
+
+	seq, err := s.db.LogSequence()
+	if err != nil {
+		return err
+	}
+	want := ack.replicas
+	if want < 0 {
+		replicas, err := s.db.Replicas()
+		if err != nil {
+			return err
+		}
+		want = len(replicas)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ack.timeout)
+	defer cancel()
+	got, err := s.db.WaitReplicated(ctx, seq, want)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %d of %d replicas within %v", errAckTimeout, got, want, ack.timeout)
+	}
+	return err
+}
+
+// ReplicationLogHandler returns the changes of the replication log that
+// follow the after parameter as a JSON array. Requesting the changes after
+// a position acknowledges that the replica given by the replica parameter
+// has applied everything up to it, which lets the log be truncated.
+// Responds with 410 Gone if the requested changes were already truncated.
+func (s *Server) ReplicationLogHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	after, err := strconv.ParseUint(r.Form.Get("after"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: invalid after %q\n", r.Form.Get("after"))
+		return
+	}
+
+	limit := defaultLogLimit
+	if l := r.Form.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 || limit > maxLogLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: invalid limit %q\n", l)
+			return
+		}
+	}
+
+	if replica := r.Form.Get("replica"); replica != "" {
+		if err := s.ackReplication(replica, after); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: %v\n", err)
+			return
+		}
+	}
+
+	changes, err := s.db.ReadLog(after, limit)
+	if errors.Is(err, db.ErrLogTruncated) {
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+
+	if changes == nil {
+		changes = []db.Change{}
+	}
+	json.NewEncoder(w).Encode(changes)
+}
+
+// ReplicationStreamHandler pushes the changes of the replication log to a
+// replica over a long-lived connection, starting after the after parameter,
+// as soon as they are committed. The replica acknowledges every batch on
+// the same connection; see replication.Protocol. Responds with 410 Gone if
+// the requested changes were already truncated.
+func (s *Server) ReplicationStreamHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	replica := r.Form.Get("replica")
+
+	if r.Header.Get("Upgrade") != replication.Protocol {
+		w.Header().Set("Upgrade", replication.Protocol)
+		w.WriteHeader(http.StatusUpgradeRequired)
+		fmt.Fprintf(w, "error: expected an upgrade to %s\n", replication.Protocol)
+		return
+	}
+
+	after, err := strconv.ParseUint(r.Form.Get("after"), 10, 64)
+	if err != nil || replica == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: invalid replica %q or after %q\n", replica, r.Form.Get("after"))
+		return
+	}
+
+	if err := s.ackReplication(replica, after); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+	if _, err := s.db.ReadLog(after, 0); errors.Is(err, db.ErrLogTruncated) {
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: streaming is not supported\n")
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("ReplicationStreamHandler: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", replication.Protocol)
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	// Acknowledgements are read concurrently with the batches being sent.
+	// Every batch is acknowledged, so a replica that stays silent for
+	// longer than the timeout is gone.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dec := json.NewDecoder(rw)
+		for {
+			conn.SetReadDeadline(time.Now().Add(replication.StreamTimeout))
+			var ack replication.Ack
+			if err := dec.Decode(&ack); err != nil {
+				return
+			}
+			if err := s.ackReplication(replica, ack.Applied); err != nil {
+				log.Printf("ReplicationStreamHandler: replica %q: %v", replica, err)
+				return
+			}
+		}
+	}()
+
+	enc := json.NewEncoder(rw)
+	sent := after
+	for {
+		changed := s.db.LogChanged()
+		changes, err := s.db.ReadLog(sent, maxLogLimit)
+		if err != nil {
+			log.Printf("ReplicationStreamHandler: replica %q: %v", replica, err)
+			return
+		}
+
+		if len(changes) == 0 {
+			select {
+			case <-changed:
+				continue
+			case <-done:
+				return
+			case <-time.After(replication.HeartbeatInterval):
+			}
+			changes = []db.Change{}
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(replication.StreamTimeout))
+		if err := enc.Encode(changes); err != nil {
+			return
+		}
+		if err := rw.Flush(); err != nil {
+			return
+		}
+		if len(changes) > 0 {
+			sent = changes[len(changes)-1].Seq
+		}
+	}
+}
@@ -0,0 +1,869 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"distributed-db/config"
+	"distributed-db/db"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Resharding moves the cluster to a new sharding config while it keeps
+// serving requests. The server that receives /reshard coordinates it:
+//
+//  1. Every primary of the old and the new config receives the new config
+//     on /reshard/start. Primaries copy the keys that the new config
+//     assigns to other shards to their new owners, then forward every
+//     change of those keys from their replication log, so that writes,
+//     which are still routed by the old config, reach both owners.
+//  2. Once all copies are done, /reshard/freeze blocks writes on every
+//     primary until the new owners have all changes.
+//  3. /reshard/prepare tells every frozen primary that the commit is about
+//     to start, so that it no longer aborts the resharding on its own
+//     when the commit takes long.
+//  4. /reshard/commit switches all servers to the new config at once and
+//     lets writes through again. Only then do the primaries purge the keys
+//     that moved away.
+//
+// Only the servers of the cluster may call the endpoints of the steps and
+// /reshard/apply, which the migrations use to send keys to their new
+// owners.
+//
+// If a step before the commit fails, /reshard/abort cancels the migration
+// and the cluster keeps the old config. Once a server switched to the new
+// config, the resharding can no longer be aborted, so the commit is retried
+// until every server has it. Shards with Raft replication cannot be
+// resharded.
+
+const (
+	// reshardBatch is the number of keys or changes sent to a new owner
+	// in a single request.
+	reshardBatch = 100
+	// reshardRetry is how long a migration waits before it retries to send
+	// a batch that a new owner did not accept.
+	reshardRetry = time.Second
+	// reshardPoll is how often the coordinator and frozen servers check
+	// the progress of the migrations.
+	reshardPoll = 50 * time.Millisecond
+	// freezeTimeout is how long a server blocks writes for a cutover
+	// before it aborts the resharding.
+	freezeTimeout = 30 * time.Second
+	// reshardPin pins the log of the primary, so that it keeps the changes
+	// that the migration has not forwarded yet.
+	reshardPin = "reshard"
+)
+
+// Phases of a resharding on a server.
+const (
+	phaseCopying    = "copying"
+	phaseDualWrite  = "dual-write"
+	phaseFrozen     = "frozen"
+	phaseFailed     = "failed"
+	phaseCommitting = "committing"
+)
+
+// ReshardStatus is the state of a resharding on a server, returned by
+// /reshard/status. Copied is the number of keys copied to their new owners
+// and Pending the number of changes of the log that were not forwarded to
+// them yet. Err is the last error of the migration. On the server that
+// coordinates the resharding, Uncommitted lists the servers that did not
+// switch to the new config yet.
+type ReshardStatus struct {
+	Phase       string
+	Copied      int
+	Pending     uint64
+	Err         string
+	Uncommitted []string `json:",omitempty"`
+}
+
+// migration is the resharding in progress on a server.
+type migration struct {
+	next *config.Shards
+	// cancel stops the copy and the forwarding of keys, and done is closed
+	// once they stopped. Both are nil on servers without keys to move.
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu        sync.Mutex
+	status    ReshardStatus
+	forwarded uint64
+	// frozen is set while the server blocks writes, until thaw fires.
+	// Once the migration is prepared, thaw is stopped and writes stay
+	// blocked until the commit.
+	frozen   bool
+	thaw     *time.Timer
+	prepared bool
+}
+
+// update changes the status of the migration.
+func (m *migration) update(fn func(st *ReshardStatus)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fn(&m.status)
+}
+
+// localWrite is like local for a write of the key. The routing table does
+// not change while the write is served locally, so the returned function
+// must be called once the write is done. Writes wait while a resharding
+// cuts over to a new config.
+func (s *Server) localWrite(key string, w http.ResponseWriter, r *http.Request) (int, func(), bool) {
+	for {
+		shards := s.shards()
+		shard := shards.Id(key)
+		if !s.local(shard, w, r) {
+			return shard, nil, false
+		}
+		s.writes.RLock()
+		if s.shards() == shards {
+			return shard, s.writes.RUnlock, true
+		}
+		// The routing table changed while the write was waiting.
+		s.writes.RUnlock()
+	}
+}
+
+// nextShards returns the routing table of the server in the config c. The
+// server keeps the shard of its primary; a server whose shard is not in c
+// owns no keys.
+func (s *Server) nextShards(c config.Config) (*config.Shards, error) {
+	shards := s.shards()
+	if len(shards.Raft) > 0 {
+		return nil, errors.New("shards with raft replication cannot be resharded")
+	}
+	if len(c.Shards) == 0 {
+		return nil, errors.New("the config has no shards")
+	}
+
+	name, found := c.Shards[0].Name, false
+	for _, sh := range c.Shards {
+		if sh.Address == shards.Addrs[shards.CurID] {
+			name, found = sh.Name, true
+		}
+	}
+	next, err := config.ParseConfig(c, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(next.Raft) > 0 {
+		return nil, errors.New("shards with raft replication cannot be resharded")
+	}
+	if !found {
+		next.CurID = -1
+	}
+	return next, nil
+}
+
+// decodeConfig reads the JSON config sent to the resharding endpoints.
+func decodeConfig(w http.ResponseWriter, r *http.Request) (config.Config, bool) {
+	var c config.Config
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: invalid config: %v\n", err)
+		return c, false
+	}
+	return c, true
+}
+
+// ReshardStartHandler starts moving the keys of the server to their owners
+// in the config given as JSON in the request body. Responds with 409
+// Conflict if a resharding is already in progress.
+func (s *Server) ReshardStartHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.peersOnly(w, r) {
+		return
+	}
+	c, ok := decodeConfig(w, r)
+	if !ok {
+		return
+	}
+	next, err := s.nextShards(c)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+
+	s.reshardMu.Lock()
+	defer s.reshardMu.Unlock()
+	if s.migration != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "error: a resharding is already in progress\n")
+		return
+	}
+
+	m := &migration{next: next, status: ReshardStatus{Phase: phaseDualWrite}}
+	if s.primary() {
+		ctx, cancel := context.WithCancel(context.Background())
+		m.cancel, m.done = cancel, make(chan struct{})
+		m.status.Phase = phaseCopying
+		go s.migrate(ctx, m)
+	}
+	s.migration = m
+	// The servers of the new config take part in the resharding.
+	s.resolvePeers(s.shards(), next)
+	fmt.Fprintf(w, "ok\n")
+}
+
+// ReshardStatusHandler returns the ReshardStatus of the server as JSON.
+// Responds with 404 Not Found if no resharding is in progress.
+func (s *Server) ReshardStatusHandler(w http.ResponseWriter, r *http.Request) {
+	s.reshardMu.Lock()
+	m, uncommitted := s.migration, s.uncommitted
+	s.reshardMu.Unlock()
+	if m == nil {
+		if len(uncommitted) > 0 {
+			json.NewEncoder(w).Encode(&ReshardStatus{Phase: phaseCommitting, Uncommitted: uncommitted})
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "error: no resharding in progress\n")
+		return
+	}
+
+	seq, err := s.db.LogSequence()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+	m.mu.Lock()
+	st := m.status
+	if m.done != nil && seq > m.forwarded {
+		st.Pending = seq - m.forwarded
+	}
+	m.mu.Unlock()
+	st.Uncommitted = uncommitted
+	json.NewEncoder(w).Encode(&st)
+}
+
+// ReshardFreezeHandler blocks the writes of the server and waits until the
+// new owners of its keys have all changes. Writes stay blocked until the
+// resharding is committed or aborted, or for at most freezeTimeout unless
+// it is prepared.
+func (s *Server) ReshardFreezeHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.peersOnly(w, r) {
+		return
+	}
+	s.reshardMu.Lock()
+	m := s.migration
+	if m == nil {
+		s.reshardMu.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "error: no resharding in progress\n")
+		return
+	}
+
+	// The gate is taken under reshardMu, so that neither another freeze
+	// nor an abort gets between taking it and setting frozen. Writes do
+	// not need reshardMu to finish.
+	m.mu.Lock()
+	frozen := m.frozen
+	m.mu.Unlock()
+	if !frozen {
+		s.writes.Lock()
+		m.mu.Lock()
+		m.frozen = true
+		m.thaw = time.AfterFunc(freezeTimeout, func() {
+			log.Printf("Reshard: no commit within %v, aborting", freezeTimeout)
+			s.abortReshard()
+		})
+		m.mu.Unlock()
+	}
+	s.reshardMu.Unlock()
+
+	if m.done != nil {
+		seq, err := s.db.LogSequence()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v\n", err)
+			return
+		}
+		for {
+			m.mu.Lock()
+			forwarded, st := m.forwarded, m.status
+			m.mu.Unlock()
+			if st.Phase == phaseFailed {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: %s\n", st.Err)
+				return
+			}
+			if st.Phase != phaseCopying && forwarded >= seq {
+				break
+			}
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(reshardPoll):
+			}
+		}
+	}
+	m.update(func(st *ReshardStatus) { st.Phase = phaseFrozen })
+	fmt.Fprintf(w, "ok\n")
+}
+
+// ReshardPrepareHandler tells a frozen server that the coordinator is
+// about to commit the resharding. Once the commit may have reached any
+// server, the resharding can no longer be aborted on its own, so the server
+// stops the timer that would abort it and keeps writes blocked until the
+// commit arrives. Responds with 409 Conflict if the server is not frozen,
+// for example because the timer already aborted the resharding.
+func (s *Server) ReshardPrepareHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.peersOnly(w, r) {
+		return
+	}
+	s.reshardMu.Lock()
+	defer s.reshardMu.Unlock()
+	m := s.migration
+	if m == nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "error: no resharding in progress\n")
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.prepared {
+		// A timer that already fired aborts the resharding once
+		// reshardMu is released.
+		if !m.frozen || !m.thaw.Stop() {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "error: the resharding is not frozen\n")
+			return
+		}
+		m.prepared = true
+	}
+	fmt.Fprintf(w, "ok\n")
+}
+
+// ReshardCommitHandler switches the server to the config given as JSON in
+// the request body and lets writes through again. A primary then deletes
+// the keys that moved to other shards. Replicas only learn about the
+// resharding when it is committed; a primary without a resharding in
+// progress responds with 409 Conflict, since it did not move its keys,
+// unless it already switched to the config.
+func (s *Server) ReshardCommitHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.peersOnly(w, r) {
+		return
+	}
+	c, ok := decodeConfig(w, r)
+	if !ok {
+		return
+	}
+
+	s.reshardMu.Lock()
+	defer s.reshardMu.Unlock()
+	var next *config.Shards
+	if s.migration != nil {
+		next = s.migration.next
+	} else {
+		var err error
+		if next, err = s.nextShards(c); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: %v\n", err)
+			return
+		}
+		if s.primary() {
+			if cur := s.shards(); cur.CurID == next.CurID && cur.SameOwners(next) {
+				// A retry of a commit that already succeeded.
+				fmt.Fprintf(w, "ok\n")
+				return
+			}
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "error: no resharding in progress, it may have been aborted\n")
+			return
+		}
+	}
+
+	routes := *next
+	routes.Epoch = s.shards().Epoch + 1
+	s.routes.Store(&routes)
+	s.resolvePeers(&routes)
+	log.Printf("Reshard: switched to %d shards (epoch %d)", next.Count, routes.Epoch)
+
+	if m := s.migration; m != nil {
+		s.stopMigration(m)
+		s.migration = nil
+		if m.done != nil {
+			go s.purgeMoved(next)
+		}
+	}
+	fmt.Fprintf(w, "ok\n")
+}
+
+// ReshardAbortHandler cancels the resharding in progress on the server,
+// which keeps its current config.
+func (s *Server) ReshardAbortHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.peersOnly(w, r) {
+		return
+	}
+	s.abortReshard()
+	fmt.Fprintf(w, "ok\n")
+}
+
+// abortReshard cancels the resharding in progress, if any.
+func (s *Server) abortReshard() {
+	s.reshardMu.Lock()
+	defer s.reshardMu.Unlock()
+	if m := s.migration; m != nil {
+		s.stopMigration(m)
+		s.migration = nil
+		s.resolvePeers(s.shards())
+	}
+}
+
+// stopMigration stops copying and forwarding keys and lets writes through
+// again.
+func (s *Server) stopMigration(m *migration) {
+	if m.done != nil {
+		m.cancel()
+		<-m.done
+		if err := s.db.UnpinLog(reshardPin); err != nil {
+			log.Printf("Reshard: %v", err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.frozen {
+		m.thaw.Stop()
+		m.frozen = false
+		s.writes.Unlock()
+	}
+}
+
+// purgeMoved deletes the keys that the server no longer owns. The
+// deletions are added to the log, so that the replicas delete them too.
+func (s *Server) purgeMoved(next *config.Shards) {
+	moved := func(key string) bool { return next.Id(key) != next.CurID }
+	names, err := s.db.Namespaces()
+	if err != nil {
+		log.Printf("Reshard: purging moved keys: %v", err)
+		return
+	}
+	for _, ns := range names {
+		var after []byte
+		for {
+			changes, last, err := s.db.ExportKeys(ns, after, reshardBatch, moved)
+			if err == nil {
+				_, err = s.db.DeleteExported(changes)
+			}
+			if err != nil {
+				log.Printf("Reshard: purging moved keys of namespace %q: %v", ns, err)
+				return
+			}
+			if last == nil {
+				break
+			}
+			after = last
+		}
+	}
+}
+
+// migrate copies the keys that move to other shards and then forwards the
+// changes of those keys until ctx is done.
+func (s *Server) migrate(ctx context.Context, m *migration) {
+	defer close(m.done)
+
+	fail := func(err error) {
+		log.Printf("Reshard: %v", err)
+		m.update(func(st *ReshardStatus) { st.Phase, st.Err = phaseFailed, err.Error() })
+	}
+
+	// The log keeps all changes made from now on until they were
+	// forwarded, including those to keys that are being copied.
+	start, err := s.db.LogSequence()
+	if err == nil {
+		err = s.db.PinLog(reshardPin, start)
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+	m.mu.Lock()
+	m.forwarded = start
+	m.mu.Unlock()
+
+	moving := func(key string) bool { return m.next.Id(key) != m.next.CurID }
+	names, err := s.db.Namespaces()
+	if err != nil {
+		fail(err)
+		return
+	}
+	for _, ns := range names {
+		var after []byte
+		for {
+			changes, last, err := s.db.ExportKeys(ns, after, reshardBatch, moving)
+			if err != nil {
+				fail(err)
+				return
+			}
+			if !s.sendChanges(ctx, m, changes) {
+				return
+			}
+			m.update(func(st *ReshardStatus) { st.Copied += len(changes) })
+			if last == nil {
+				break
+			}
+			after = last
+		}
+	}
+	m.update(func(st *ReshardStatus) {
+		if st.Phase == phaseCopying {
+			st.Phase = phaseDualWrite
+		}
+	})
+
+	for {
+		changed := s.db.LogChanged()
+		m.mu.Lock()
+		after := m.forwarded
+		m.mu.Unlock()
+
+		changes, err := s.db.ReadLog(after, reshardBatch)
+		if err != nil {
+			fail(err)
+			return
+		}
+		if len(changes) == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+			}
+			continue
+		}
+
+		var send []db.Change
+		for _, c := range changes {
+			if c.Drop || moving(string(c.Key)) {
+				send = append(send, c)
+			}
+		}
+		if !s.sendChanges(ctx, m, send) {
+			return
+		}
+		last := changes[len(changes)-1].Seq
+		if err := s.db.PinLog(reshardPin, last); err != nil {
+			fail(err)
+			return
+		}
+		m.mu.Lock()
+		m.forwarded = last
+		m.mu.Unlock()
+	}
+}
+
+// sendChanges sends the changes to the new owners of their keys, in order,
+// retrying until they accepted them. Drops of namespaces go to all other
+// shards. It reports false if ctx is done first.
+func (s *Server) sendChanges(ctx context.Context, m *migration, changes []db.Change) bool {
+	// Batches are sent one after the other, so that a change never
+	// overtakes an earlier change of the same key.
+	var batches [][]db.Change
+	var addrs []string
+	for _, c := range changes {
+		targets := []int{m.next.Id(string(c.Key))}
+		if c.Drop {
+			targets = targets[:0]
+			for id := range m.next.Addrs {
+				if id != m.next.CurID {
+					targets = append(targets, id)
+				}
+			}
+		}
+		for _, id := range targets {
+			addr := m.next.Addrs[id]
+			if n := len(addrs); n > 0 && addrs[n-1] == addr {
+				batches[n-1] = append(batches[n-1], c)
+				continue
+			}
+			addrs = append(addrs, addr)
+			batches = append(batches, []db.Change{c})
+		}
+	}
+
+	for i, batch := range batches {
+		for {
+			err := postJSON(ctx, addrs[i], "/reshard/apply", batch, nil)
+			if err == nil {
+				break
+			}
+			m.update(func(st *ReshardStatus) { st.Err = fmt.Sprintf("%s: %v", addrs[i], err) })
+			select {
+			case <-ctx.Done():
+				return false
+			case <-time.After(reshardRetry):
+			}
+		}
+	}
+	return ctx.Err() == nil
+}
+
+// ReshardApplyHandler applies the changes of keys that moved to this
+// server, sent as a JSON array of db.Change by their previous owner.
+func (s *Server) ReshardApplyHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.peersOnly(w, r) {
+		return
+	}
+	var changes []db.Change
+	if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+	if err := s.db.ImportChanges(changes); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "ok\n")
+}
+
+// postJSON posts in as JSON to path on the server at addr and decodes the
+// JSON response into out, unless out is nil.
+func postJSON(ctx context.Context, addr, path string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+addr+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(peerHeader, "true")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: status %s: %s", path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// ReshardHandler reshards the cluster to the config given in the format
+// of the config file in the request body, coordinating all servers of the
+// current and of the new config.
+func (s *Server) ReshardHandler(w http.ResponseWriter, r *http.Request) {
+	c, err := config.Decode(r.Body)
+	if err == nil && len(c.Shards) == 0 {
+		err = errors.New("the config has no shards")
+	}
+	if err == nil {
+		_, err = config.ParseConfig(c, c.Shards[0].Name)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: invalid config: %v\n", err)
+		return
+	}
+	s.reshardMu.Lock()
+	committing := len(s.uncommitted) > 0
+	s.reshardMu.Unlock()
+	if committing {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "error: the last resharding is still being committed\n")
+		return
+	}
+
+	// Primaries take part in every step; replicas only switch to the new
+	// config.
+	seen := make(map[string]bool)
+	var primaries, all []string
+	add := func(addr string, primary bool) {
+		if seen[addr] {
+			return
+		}
+		seen[addr] = true
+		all = append(all, addr)
+		if primary {
+			primaries = append(primaries, addr)
+		}
+	}
+	shards := s.shards()
+	for _, addr := range shards.Addrs {
+		add(addr, true)
+	}
+	for _, sh := range c.Shards {
+		add(sh.Address, true)
+	}
+	for _, replicas := range shards.Replicas {
+		for _, addr := range replicas {
+			add(addr, false)
+		}
+	}
+	for _, sh := range c.Shards {
+		for _, addr := range sh.Replicas {
+			add(addr, false)
+		}
+	}
+
+	ctx := r.Context()
+	abort := func(err error) {
+		forEach(primaries, func(addr string) error {
+			return postJSON(context.Background(), addr, "/reshard/abort", nil, nil)
+		})
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "error: resharding aborted: %v\n", err)
+	}
+
+	if err := forEach(primaries, func(addr string) error {
+		return postJSON(ctx, addr, "/reshard/start", c, nil)
+	}); err != nil {
+		abort(err)
+		return
+	}
+
+	// Wait until every primary copied its keys.
+	for {
+		var copying atomic.Bool
+		if err := forEach(primaries, func(addr string) error {
+			var st ReshardStatus
+			if err := getStatus(ctx, addr, &st); err != nil {
+				return err
+			}
+			switch st.Phase {
+			case phaseFailed:
+				return errors.New(st.Err)
+			case phaseCopying:
+				copying.Store(true)
+			}
+			return nil
+		}); err != nil {
+			abort(err)
+			return
+		}
+		if !copying.Load() {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			abort(ctx.Err())
+			return
+		case <-time.After(reshardPoll):
+		}
+	}
+
+	if err := forEach(primaries, func(addr string) error {
+		return postJSON(ctx, addr, "/reshard/freeze", nil, nil)
+	}); err != nil {
+		abort(err)
+		return
+	}
+	if err := forEach(primaries, func(addr string) error {
+		return postJSON(ctx, addr, "/reshard/prepare", nil, nil)
+	}); err != nil {
+		abort(err)
+		return
+	}
+	failed := commitReshard(all, c)
+	if len(failed) == 0 {
+		fmt.Fprintf(w, "Resharded to %d shards\n", len(c.Shards))
+		return
+	}
+
+	// The request does not wait for servers that are down.
+	s.reshardMu.Lock()
+	s.uncommitted = failed
+	s.reshardMu.Unlock()
+	go s.retryCommit(failed, c)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Resharded to %d shards, still committing on %d servers; see /reshard/status\n", len(c.Shards), len(failed))
+}
+
+// commitReshard switches the servers at addrs to the config c and returns
+// the addresses of those that failed to switch.
+func commitReshard(addrs []string, c config.Config) []string {
+	var mu sync.Mutex
+	var failed []string
+	err := forEach(addrs, func(addr string) error {
+		err := postJSON(context.Background(), addr, "/reshard/commit", c, nil)
+		if err != nil {
+			mu.Lock()
+			defer mu.Unlock()
+			failed = append(failed, addr)
+		}
+		return err
+	})
+	if err != nil {
+		log.Printf("Reshard: committing the new config: %v", err)
+	}
+	return failed
+}
+
+// retryCommit retries the commit of the config c on the servers at addrs
+// until all of them switched to it or the server is closed. Frozen
+// primaries that did not switch keep blocking writes until they do.
+func (s *Server) retryCommit(addrs []string, c config.Config) {
+	for len(addrs) > 0 {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(reshardRetry):
+		}
+		addrs = commitReshard(addrs, c)
+
+		s.reshardMu.Lock()
+		s.uncommitted = addrs
+		s.reshardMu.Unlock()
+	}
+	log.Printf("Reshard: all servers switched to the new config")
+}
+
+// getStatus fetches the ReshardStatus of the server at addr.
+func getStatus(ctx context.Context, addr string, st *ReshardStatus) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/reshard/status", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(st)
+}
+
+// forEach calls fn for every address concurrently and returns the errors
+// of all calls that failed.
+func forEach(addrs []string, fn func(addr string) error) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			if err := fn(addr); err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+			}
+		}(addr)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
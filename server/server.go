@@ -1,114 +1,888 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"distributed-db/config"
 	"distributed-db/db"
+	"distributed-db/raft"
 	"distributed-db/replication"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Server contains HTTP method handlers for the database.
 type Server struct {
-	db     *db.DB
-	shards *config.Shards
+	db *db.DB
+	// routes is the current routing table. It is replaced as a whole when
+	// a shard gets a new primary or the server switches to a new config.
+	routes atomic.Pointer[config.Shards]
+	// raft is the member of the shard's Raft group if the shard uses Raft
+	// replication.
+	raft *raft.Node
+
+	// status is the state of the replication of a replica.
+	status replication.Status
+	// nextReplica rotates the replicas that serve eventually consistent
+	// reads.
+	nextReplica atomic.Uint64
+	// lags caches the replication lag reported by the replicas of all
+	// shards. It is guarded by lagsMu.
+	lagsMu sync.Mutex
+	lags   map[string]lagSample
+	// trees caches the hash trees of the namespaces that replicas compare
+	// with their own. It is guarded by treesMu.
+	treesMu sync.Mutex
+	trees   map[string]merkleCache
+	// contacts tracks the replicas of a primary. It is guarded by
+	// contactsMu.
+	contactsMu sync.Mutex
+	contacts   map[string]contact
+
+	// migration is the resharding in progress, if any. It is guarded by
+	// reshardMu.
+	reshardMu sync.Mutex
+	migration *migration
+	// uncommitted lists the servers that a resharding coordinated by this
+	// server did not switch to the new config yet. It is guarded by
+	// reshardMu.
+	uncommitted []string
+	// writes is held by every write served locally, and exclusively while
+	// a resharding cuts over to a new config.
+	writes sync.RWMutex
+
+	// ctx is done once the server is closed, which stops the background
+	// work that the server starts on its own.
+	ctx   context.Context
+	close context.CancelFunc
+
+	// peers is the set of addresses of the servers in the config, which
+	// fromPeer trusts.
+	peers atomic.Pointer[peerSet]
 }
 
 // NewServer creates a new instance of Server
 func NewServer(db *db.DB, shards *config.Shards) *Server {
-	return &Server{
-		db:     db,
-		shards: shards,
+	s := &Server{
+		db:       db,
+		lags:     make(map[string]lagSample),
+		trees:    make(map[string]merkleCache),
+		contacts: make(map[string]contact),
+	}
+	s.ctx, s.close = context.WithCancel(context.Background())
+	s.routes.Store(shards)
+	s.resolvePeers(shards)
+	return s
+}
+
+// Close stops the background work that the server started on its own,
+// such as following a new primary after stepping down.
+func (s *Server) Close() {
+	s.close()
+}
+
+// shards returns the current routing table.
+func (s *Server) shards() *config.Shards {
+	return s.routes.Load()
+}
+
+// local reports whether a request for a key of the shard is handled by
+// this server, and forwards it otherwise. On a shard that uses Raft
+// replication, the requests are forwarded to the leader.
+func (s *Server) local(shard int, w http.ResponseWriter, r *http.Request) bool {
+	if shard != s.shards().CurID {
+		s.redirect(shard, w, r)
+		return false
+	}
+	if s.raft == nil {
+		return true
+	}
+
+	// Without a known leader, writes fail with db.ErrNotLeader.
+	leader := s.raft.Leader()
+	if leader == "" || leader == s.raft.ID() {
+		return true
 	}
+	url := "http://" + leader + r.RequestURI
+	resp, err := http.Get(url)
+	s.relay(shard, url, resp, err, w)
+	return false
 }
 
 func (s *Server) redirect(shard int, w http.ResponseWriter, r *http.Request) {
-	url := "http://" + s.shards.Addrs[shard] + r.RequestURI
-	fmt.Fprintf(w, "redirecting from shard %d to shard %d (%q)\n", s.shards.CurID, shard, url)
+	url := "http://" + s.shards().Addrs[shard] + r.RequestURI
 	// http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 
 	resp, err := http.Get(url)
+	if err != nil && s.discoverPrimary(shard) {
+		// The shard failed over to one of its replicas.
+		url = "http://" + s.shards().Addrs[shard] + r.RequestURI
+		resp, err = http.Get(url)
+	}
+	s.relay(shard, url, resp, err, w)
+}
+
+// relay passes the response of a request forwarded to url on to the
+// client.
+func (s *Server) relay(shard int, url string, resp *http.Response, err error, w http.ResponseWriter) {
 	if err != nil {
+		fmt.Fprintf(w, "redirecting from shard %d to shard %d (%q)\n", s.shards().CurID, shard, url)
 		fmt.Fprintf(w, "Error redirecting the request: %v\n", err)
 		return
 	}
 	defer resp.Body.Close()
 
+	// Pass on the status code so that e.g. conflicts reach the client.
+	w.WriteHeader(resp.StatusCode)
+	fmt.Fprintf(w, "redirecting from shard %d to shard %d (%q)\n", s.shards().CurID, shard, url)
 	io.Copy(w, resp.Body)
 }
 
-// GetHandler handles GET requests to the server.
+// GetHandler handles GET requests to the server. Reads go to the primary
+// of the shard unless the consistency or max_staleness parameters allow a
+// replica to serve them; see parseStaleness.
 func (s *Server) GetHandler(w http.ResponseWriter, r *http.Request) {
 	// fmt.Fprintf(w, "Called get\n")
 	r.ParseForm()
-	key := r.Form.Get("key")
+	ns, key := r.Form.Get("ns"), r.Form.Get("key")
 
-	shard := s.shards.Id(key)
-	if shard != s.shards.CurID {
-		s.redirect(shard, w, r)
+	shard := s.shards().Id(key)
+	bound, eventual, err := parseStaleness(r.Form)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+	if eventual {
+		if !s.localRead(shard, bound, w, r) {
+			return
+		}
+	} else if !s.local(shard, w, r) {
 		return
 	}
 
-	value, err := s.db.GetKey(key)
+	var value []byte
+	var version uint64
+	if v := r.Form.Get("version"); v != "" {
+		if version, err = strconv.ParseUint(v, 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Shard : %d, ShardID : %d, Error: invalid version %q: %v\n", shard, s.shards().CurID, v, err)
+			return
+		}
+		value, err = s.db.GetKeyAtVersion(ns, key, version)
+	} else {
+		value, version, err = s.db.GetKey(ns, key)
+	}
 
-	fmt.Fprintf(w, "Shard : %d, ShardID : %d, addr = %q Value : %q, Error: %v\n",
-		shard, s.shards.CurID, s.shards.Addrs[shard], value, err)
+	fmt.Fprintf(w, "Shard : %d, ShardID : %d, addr = %q Value : %q, Version : %d, Error: %v\n",
+		shard, s.shards().CurID, s.shards().Addrs[shard], value, version, err)
 }
 
-// SetHandler handles PUT requests to the server.
+// SetHandler handles PUT requests to the server. The ack parameter selects
+// when the write is acknowledged; see parseAck. Responds with 504 Gateway
+// Timeout if the write was committed locally but not applied by enough
+// replicas in time.
 func (s *Server) SetHandler(w http.ResponseWriter, r *http.Request) {
 	// fmt.Fprintf(w, "Called set\n")
 	r.ParseForm()
-	key := r.Form.Get("key")
+	ns, key := r.Form.Get("ns"), r.Form.Get("key")
 	value := r.Form.Get("value")
 
-	shard := s.shards.Id(key)
-	if shard != s.shards.CurID {
-		s.redirect(shard, w, r)
+	shard, release, ok := s.localWrite(key, w, r)
+	if !ok {
 		return
 	}
+	// The write only holds up a resharding until it is committed, not
+	// while it waits for the replicas.
+	release = sync.OnceFunc(release)
+	defer release()
 
-	err := s.db.SetKey(key, []byte(value))
-	fmt.Fprintf(w, "Shard : %d, shardID : %d, Error : %v\n", shard, s.shards.CurID, err)
+	var ttl time.Duration
+	if t := r.Form.Get("ttl"); t != "" {
+		var err error
+		if ttl, err = time.ParseDuration(t); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Shard : %d, shardID : %d, Error : invalid ttl %q: %v\n", shard, s.shards().CurID, t, err)
+			return
+		}
+	}
+
+	ack, err := s.parseAck(r.Form)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Shard : %d, shardID : %d, Error : %v\n", shard, s.shards().CurID, err)
+		return
+	}
+
+	switch {
+	case r.Form.Get("if_absent") == "true":
+		err = s.db.SetKeyIfVersionWithTTL(ns, key, []byte(value), 0, ttl)
+	case r.Form.Has("if_version"):
+		var version uint64
+		if version, err = strconv.ParseUint(r.Form.Get("if_version"), 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Shard : %d, shardID : %d, Error : invalid if_version %q: %v\n",
+				shard, s.shards().CurID, r.Form.Get("if_version"), err)
+			return
+		}
+		err = s.db.SetKeyIfVersionWithTTL(ns, key, []byte(value), version, ttl)
+	default:
+		err = s.db.SetKeyWithTTL(ns, key, []byte(value), ttl)
+	}
+	release()
+	if err == nil {
+		err = s.waitForReplicas(ack)
+	}
+
+	switch {
+	case errors.Is(err, db.ErrConflict):
+		w.WriteHeader(http.StatusConflict)
+	case errors.Is(err, db.ErrNotLeader):
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case errors.Is(err, errAckTimeout):
+		w.WriteHeader(http.StatusGatewayTimeout)
+	}
+	fmt.Fprintf(w, "Shard : %d, shardID : %d, Error : %v\n", shard, s.shards().CurID, err)
 }
 
-// ListenAndServe starts the HTTP server.
-func (s *Server) ListenAndServe(httpAddress *string) error {
-	return http.ListenAndServe(*httpAddress, nil)
+// CompareAndSwapHandler sets a key to value if its current value equals
+// expected. A missing expected parameter only matches a missing key.
+// Responds with 409 Conflict if the current value does not match.
+func (s *Server) CompareAndSwapHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	ns, key := r.Form.Get("ns"), r.Form.Get("key")
+	value := r.Form.Get("value")
+
+	shard, release, ok := s.localWrite(key, w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	var expected []byte
+	if r.Form.Has("expected") {
+		expected = []byte(r.Form.Get("expected"))
+	}
+
+	err := s.db.CompareAndSwap(ns, key, expected, []byte(value))
+	switch {
+	case errors.Is(err, db.ErrConflict):
+		w.WriteHeader(http.StatusConflict)
+	case errors.Is(err, db.ErrNotLeader):
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintf(w, "Shard : %d, shardID : %d, Error : %v\n", shard, s.shards().CurID, err)
 }
 
-// DeleteExtraKeysHandler deletes all keys that do not belong to the current shard.
-func (s *Server) DeleteExtraKeysHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "Error: %v\n", s.db.DeleteExtraKeys(func(key string) bool {
-		return s.shards.Id(key) != s.shards.CurID
-	}))
+// HistoryItem is a single version of a key returned by /history.
+type HistoryItem struct {
+	Version uint64
+	Value   string
 }
 
-// GetNextKeyForReplication returns the next key-value pair for replication.
-func (s *Server) GetNextKeyForReplication(w http.ResponseWriter, r *http.Request) {
-	enc := json.NewEncoder(w)
-	k, v, err := s.db.GetNextKeyForReplication()
-	enc.Encode(&replication.NextKeyValue{
-		Key:   string(k),
-		Value: string(v),
-		Err:   err,
-	})
+// HistoryHandler returns the current and the previous versions of a key,
+// newest first.
+func (s *Server) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	ns, key := r.Form.Get("ns"), r.Form.Get("key")
+
+	shard := s.shards().Id(key)
+	if !s.local(shard, w, r) {
+		return
+	}
+
+	versions, err := s.db.History(ns, key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+
+	res := make([]HistoryItem, 0, len(versions))
+	for _, v := range versions {
+		res = append(res, HistoryItem{Version: v.Version, Value: string(v.Value)})
+	}
+	json.NewEncoder(w).Encode(res)
 }
 
-func (s *Server) DeleteReplicationKey(w http.ResponseWriter, r *http.Request) {
+// DeleteHandler handles DELETE requests to the server.
+func (s *Server) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
+	ns, key := r.Form.Get("ns"), r.Form.Get("key")
 
-	key := r.Form.Get("key")
-	value := r.Form.Get("value")
+	shard, release, ok := s.localWrite(key, w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	err := s.db.DeleteKey(ns, key)
+	if errors.Is(err, db.ErrNotLeader) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintf(w, "Shard : %d, shardID : %d, Error : %v\n", shard, s.shards().CurID, err)
+}
+
+const (
+	// defaultScanLimit is the page size of scans without a limit parameter.
+	defaultScanLimit = 100
+	// maxScanLimit is the largest page size a client can request.
+	maxScanLimit = 1000
+)
+
+// ScanItem is a single key-value pair returned by the /scan endpoint.
+type ScanItem struct {
+	Key   string
+	Value string
+}
+
+// ScanResult is a page of a scan. Next is the token to pass to the next
+// request to get the following page, or empty if this is the last page.
+type ScanResult struct {
+	Items []ScanItem
+	Next  string
+}
+
+// ScanHandler handles range and prefix scans. The scan is sent to every
+// shard that may own keys in the range, which with range partitioning are
+// only the shards whose ranges overlap it, and the results are merged so
+// that each page is globally ordered.
+// Parameters: start and end (or prefix) select the range, limit the page
+// size and token continues a previous scan.
+func (s *Server) ScanHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	ns := r.Form.Get("ns")
+	start, end := r.Form.Get("start"), r.Form.Get("end")
+	if prefix := r.Form.Get("prefix"); prefix != "" {
+		start, end = prefix, db.PrefixEnd(prefix)
+	}
+
+	// Scans forwarded by another server ask for one more item than the
+	// page size of the client.
+	maxLimit := maxScanLimit
+	if s.forwarded(r) {
+		maxLimit++
+	}
+	limit := defaultScanLimit
+	if l := r.Form.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 || limit > maxLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: invalid limit %q\n", l)
+			return
+		}
+	}
+
+	if token := r.Form.Get("token"); token != "" {
+		last, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: invalid token %q\n", token)
+			return
+		}
+		// The smallest key after the last returned one.
+		if next := string(last) + "\x00"; next > start {
+			start = next
+		}
+	}
+
+	if s.forwarded(r) {
+		items, err := s.localScan(ns, start, end, limit)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v\n", err)
+			return
+		}
+		json.NewEncoder(w).Encode(&ScanResult{Items: items})
+		return
+	}
+
+	// Every shard returns one more item than requested so that we know
+	// whether there is another page.
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		items []ScanItem
+		errs  []error
+	)
+	shards := s.shards()
+	for _, id := range shards.Overlapping(start, end) {
+		wg.Add(1)
+		go func(id int, addr string) {
+			defer wg.Done()
+
+			var res []ScanItem
+			var err error
+			if id == shards.CurID {
+				res, err = s.localScan(ns, start, end, limit+1)
+			} else {
+				res, err = remoteScan(addr, ns, start, end, limit+1)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("shard %d: %w", id, err))
+				return
+			}
+			items = append(items, res...)
+		}(id, shards.Addrs[id])
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "error: %v\n", errors.Join(errs...))
+		return
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+
+	res := &ScanResult{Items: items}
+	if len(items) > limit {
+		res.Items = items[:limit]
+		res.Next = base64.RawURLEncoding.EncodeToString([]byte(items[limit-1].Key))
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func (s *Server) localScan(ns, start, end string, limit int) ([]ScanItem, error) {
+	kvs, err := s.db.Scan(ns, start, end, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]ScanItem, 0, len(kvs))
+	for _, kv := range kvs {
+		items = append(items, ScanItem{Key: kv.Key, Value: string(kv.Value)})
+	}
+	return items, nil
+}
+
+// remoteScan scans the local keys of the shard at addr.
+func remoteScan(addr, ns, start, end string, limit int) ([]ScanItem, error) {
+	u := url.Values{}
+	u.Set("ns", ns)
+	u.Set("start", start)
+	u.Set("end", end)
+	u.Set("limit", strconv.Itoa(limit))
+	u.Set("local", "true")
+
+	resp, err := peerGet("http://" + addr + "/scan?" + u.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var res ScanResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return res.Items, nil
+}
+
+// BatchItem is the result for a single key of /mget and /mset. Value and
+// Found are only set by /mget. Err is empty if the operation succeeded.
+type BatchItem struct {
+	Key   string
+	Value string
+	Found bool
+	Err   string
+}
+
+// groupByShard groups the indices of the keys by the shard that owns them.
+func (s *Server) groupByShard(keys []string) map[int][]int {
+	groups := make(map[int][]int)
+	for i, key := range keys {
+		shard := s.shards().Id(key)
+		groups[shard] = append(groups[shard], i)
+	}
+	return groups
+}
+
+// MultiGetHandler gets multiple keys given as repeated key parameters.
+// Keys owned by other shards are fetched concurrently from their shards.
+func (s *Server) MultiGetHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	ns, keys := r.Form.Get("ns"), r.Form["key"]
+
+	res := make([]BatchItem, len(keys))
+	for i, key := range keys {
+		res[i].Key = key
+	}
+
+	if s.forwarded(r) {
+		s.localMultiGet(ns, keys, res)
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for shard, idx := range s.groupByShard(keys) {
+		wg.Add(1)
+		go func(shard int, idx []int) {
+			defer wg.Done()
+
+			group := make([]string, len(idx))
+			for i, j := range idx {
+				group[i] = keys[j]
+			}
+
+			items := make([]BatchItem, len(group))
+			if shard == s.shards().CurID {
+				s.localMultiGet(ns, group, items)
+			} else {
+				u := url.Values{"ns": {ns}, "key": group}
+				if err := s.forwardBatch(shard, "/mget", u, items); err != nil {
+					for i := range items {
+						items[i] = BatchItem{Key: group[i], Err: err.Error()}
+					}
+				}
+			}
+
+			for i, j := range idx {
+				res[j] = items[i]
+			}
+		}(shard, idx)
+	}
+	wg.Wait()
+
+	json.NewEncoder(w).Encode(res)
+}
+
+func (s *Server) localMultiGet(ns string, keys []string, res []BatchItem) {
+	values, err := s.db.GetKeys(ns, keys)
+	for i, key := range keys {
+		res[i] = BatchItem{Key: key}
+		if err != nil {
+			res[i].Err = err.Error()
+			continue
+		}
+		res[i].Value = string(values[i])
+		res[i].Found = values[i] != nil
+	}
+}
+
+// MultiSetHandler sets multiple keys given as repeated key and value
+// parameters, where the n-th value belongs to the n-th key. Keys owned by
+// other shards are forwarded concurrently to their shards.
+func (s *Server) MultiSetHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	ns := r.Form.Get("ns")
+	keys, values := r.Form["key"], r.Form["value"]
+	if len(keys) != len(values) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: got %d keys and %d values\n", len(keys), len(values))
+		return
+	}
+
+	res := make([]BatchItem, len(keys))
+	if s.forwarded(r) {
+		s.localMultiSet(ns, keys, values, res)
+		json.NewEncoder(w).Encode(res)
+		return
+	}
 
-	err := s.db.DeleteReplicationKey([]byte(key), []byte(value))
+	var wg sync.WaitGroup
+	for shard, idx := range s.groupByShard(keys) {
+		wg.Add(1)
+		go func(shard int, idx []int) {
+			defer wg.Done()
+
+			groupKeys := make([]string, len(idx))
+			groupValues := make([]string, len(idx))
+			for i, j := range idx {
+				groupKeys[i], groupValues[i] = keys[j], values[j]
+			}
+
+			items := make([]BatchItem, len(idx))
+			if shard == s.shards().CurID {
+				s.localMultiSet(ns, groupKeys, groupValues, items)
+			} else {
+				u := url.Values{"ns": {ns}, "key": groupKeys, "value": groupValues}
+				if err := s.forwardBatch(shard, "/mset", u, items); err != nil {
+					for i := range items {
+						items[i] = BatchItem{Key: groupKeys[i], Err: err.Error()}
+					}
+				}
+			}
+
+			for i, j := range idx {
+				res[j] = items[i]
+			}
+		}(shard, idx)
+	}
+	wg.Wait()
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// localMultiSet sets the keys that this server owns. Keys that moved to
+// another shard during a resharding fail and must be retried.
+func (s *Server) localMultiSet(ns string, keys, values []string, res []BatchItem) {
+	s.writes.RLock()
+	defer s.writes.RUnlock()
+	shards := s.shards()
+
+	var kvs []db.KeyValue
+	var idx []int
+	for i := range keys {
+		res[i] = BatchItem{Key: keys[i]}
+		if shard := shards.Id(keys[i]); shard != shards.CurID {
+			res[i].Err = fmt.Sprintf("key moved to shard %d", shard)
+			continue
+		}
+		kvs = append(kvs, db.KeyValue{Key: keys[i], Value: []byte(values[i])})
+		idx = append(idx, i)
+	}
+
+	if err := s.db.SetKeys(ns, kvs); err != nil {
+		for _, i := range idx {
+			res[i].Err = err.Error()
+		}
+	}
+}
+
+// forwardBatch posts a batch request to the shard that owns all of the keys
+// and decodes the per-key results into res.
+func (s *Server) forwardBatch(shard int, path string, form url.Values, res []BatchItem) error {
+	form.Set("local", "true")
+
+	resp, err := peerPostForm("http://"+s.shards().Addrs[shard]+path, form)
 	if err != nil {
-		w.WriteHeader(http.StatusExpectationFailed)
-		fmt.Fprintf(w, "error: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("shard %d: status %s: %s", shard, resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var items []BatchItem
+	if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+		return fmt.Errorf("shard %d: %w", shard, err)
+	}
+	if len(items) != len(res) {
+		return fmt.Errorf("shard %d: got %d results, want %d", shard, len(items), len(res))
+	}
+
+	copy(res, items)
+	return nil
+}
+
+// NamespacesHandler lists the namespaces of all shards as a sorted JSON
+// array. Namespaces are created on demand, so a namespace may only exist on
+// the shards that own some of its keys.
+func (s *Server) NamespacesHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	// Listing the namespaces of this server alone is harmless, so unlike
+	// the other local requests it is not limited to peers.
+	if r.Form.Get("local") == "true" {
+		names, err := s.db.Namespaces()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v\n", err)
+			return
+		}
+		json.NewEncoder(w).Encode(names)
 		return
 	}
 
-	fmt.Fprintf(w, "ok\n")
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		seen = make(map[string]bool)
+		errs []error
+	)
+	for id, addr := range s.shards().Addrs {
+		wg.Add(1)
+		go func(id int, addr string) {
+			defer wg.Done()
+
+			var names []string
+			var err error
+			if id == s.shards().CurID {
+				names, err = s.db.Namespaces()
+			} else {
+				names, err = remoteNamespaces(addr)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("shard %d: %w", id, err))
+				return
+			}
+			for _, name := range names {
+				seen[name] = true
+			}
+		}(id, addr)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "error: %v\n", errors.Join(errs...))
+		return
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	json.NewEncoder(w).Encode(names)
+}
+
+// remoteNamespaces lists the namespaces of the shard at addr.
+func remoteNamespaces(addr string) ([]string, error) {
+	resp, err := http.Get("http://" + addr + "/namespaces?local=true")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var names []string
+	if err := json.NewDecoder(resp.Body).Decode(&names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// CreateNamespaceHandler creates the namespace given by the ns parameter
+// on every shard.
+func (s *Server) CreateNamespaceHandler(w http.ResponseWriter, r *http.Request) {
+	s.namespaceAdmin(w, r, "/namespaces/create", s.db.CreateNamespace)
+}
+
+// DropNamespaceHandler drops the namespace given by the ns parameter and
+// all of its keys on every shard.
+func (s *Server) DropNamespaceHandler(w http.ResponseWriter, r *http.Request) {
+	s.namespaceAdmin(w, r, "/namespaces/drop", s.db.DropNamespace)
+}
+
+// namespaceAdmin applies op to the requested namespace locally and, unless
+// local=true, on all other shards, and reports the result of every shard.
+func (s *Server) namespaceAdmin(w http.ResponseWriter, r *http.Request, path string, op func(string) error) {
+	r.ParseForm()
+	ns := r.Form.Get("ns")
+	if ns == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: missing ns parameter\n")
+		return
+	}
+
+	if s.forwarded(r) {
+		if err := op(ns); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: %v\n", err)
+			return
+		}
+		fmt.Fprintf(w, "ok\n")
+		return
+	}
+
+	results := make(map[int]error)
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for id, addr := range s.shards().Addrs {
+		wg.Add(1)
+		go func(id int, addr string) {
+			defer wg.Done()
+
+			var err error
+			if id == s.shards().CurID {
+				err = op(ns)
+			} else {
+				err = forwardNamespaceAdmin(addr, path, ns)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[id] = err
+		}(id, addr)
+	}
+	wg.Wait()
+
+	ids := make([]int, 0, len(results))
+	failed := false
+	for id, err := range results {
+		ids = append(ids, id)
+		failed = failed || err != nil
+	}
+	sort.Ints(ids)
+
+	if failed {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	for _, id := range ids {
+		fmt.Fprintf(w, "Shard : %d, Namespace : %q, Error : %v\n", id, ns, results[id])
+	}
+}
+
+// forwardNamespaceAdmin applies a namespace operation on the shard at addr.
+func forwardNamespaceAdmin(addr, path, ns string) error {
+	resp, err := peerPostForm("http://"+addr+path, url.Values{"ns": {ns}, "local": {"true"}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	msg, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(string(bytes.TrimPrefix(bytes.TrimSpace(msg), []byte("error: "))))
+	}
+	return nil
+}
+
+// BackupHandler streams a consistent snapshot of the shard's database as a
+// BoltDB file. The shard keeps serving reads and writes during the backup.
+func (s *Server) BackupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"shard-%d.db\"", s.shards().CurID))
+
+	n, err := s.db.WriteSnapshot(w)
+	if err != nil {
+		if n == 0 {
+			// Nothing was sent yet, so the client can still get an error.
+			w.Header().Del("Content-Disposition")
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v\n", err)
+			return
+		}
+		// The client detects the truncated snapshot when restoring it.
+		log.Printf("BackupHandler: snapshot failed after %d bytes: %v", n, err)
+	}
+}
+
+// ListenAndServe starts the HTTP server.
+func (s *Server) ListenAndServe(httpAddress *string) error {
+	return http.ListenAndServe(*httpAddress, nil)
 }
@@ -2,38 +2,36 @@ package server_test
 
 import (
 	"bytes"
+	"context"
 	"distributed-db/config"
 	"distributed-db/db"
+	"distributed-db/raft"
+	"distributed-db/replication"
 	"distributed-db/server"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"net/url"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
 )
 
-func createShardDB(t *testing.T, id int) *db.DB {
+func createShardDB(t *testing.T) *db.DB {
 	t.Helper()
 
-	tmp, err := os.CreateTemp(os.TempDir(), fmt.Sprintf("dbtest-%d", id))
-	if err != nil {
-		t.Fatalf("Could not create a temp db: %v", err)
-	}
-	name := tmp.Name()
-	tmp.Close()
-
-	db, closeFunc, err := db.NewDB(name, false)
+	db, closeFunc, err := db.NewDBWithStorage(db.NewMemoryStorage(), false)
 	if err != nil {
-		t.Fatalf("NewDB: Could not create a new database: %v", err)
+		t.Fatalf("NewDBWithStorage: Could not create a new database: %v", err)
 	}
-
-	t.Cleanup(func() {
-		closeFunc()
-		os.Remove(name)
-	})
+	t.Cleanup(func() { closeFunc() })
 
 	return db
 }
@@ -41,7 +39,7 @@ func createShardDB(t *testing.T, id int) *db.DB {
 func createShardServer(t *testing.T, id int, addrs map[int]string) (*db.DB, *server.Server) {
 	t.Helper()
 
-	db := createShardDB(t, id)
+	db := createShardDB(t)
 	shards := &config.Shards{
 		CurID: id,
 		Addrs: addrs,
@@ -52,6 +50,38 @@ func createShardServer(t *testing.T, id int, addrs map[int]string) (*db.DB, *ser
 	return db, s
 }
 
+// peerRequest returns a request to a handler as if another server of the
+// cluster on the local host sent it.
+func peerRequest(method, target string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set("X-Peer", "true")
+	return r
+}
+
+// startShards starts n shards on test HTTP servers. register is called to
+// install the handlers of every shard's server.
+func startShards(t *testing.T, n int, register func(*http.ServeMux, *server.Server)) (map[int]string, []*db.DB) {
+	t.Helper()
+
+	addrs := make(map[int]string)
+	muxes := make([]*http.ServeMux, n)
+	for i := range muxes {
+		muxes[i] = http.NewServeMux()
+		ts := httptest.NewServer(muxes[i])
+		t.Cleanup(ts.Close)
+		addrs[i] = strings.TrimPrefix(ts.URL, "http://")
+	}
+
+	dbs := make([]*db.DB, n)
+	for i := range muxes {
+		d, s := createShardServer(t, i, addrs)
+		register(muxes[i], s)
+		dbs[i] = d
+	}
+	return addrs, dbs
+}
+
 func TestServerCreate(t *testing.T) {
 	var GetHandler1, SetHandler1 func(w http.ResponseWriter, r *http.Request)
 	var GetHandler2, SetHandler2 func(w http.ResponseWriter, r *http.Request)
@@ -118,7 +148,7 @@ func TestServerCreate(t *testing.T) {
 		log.Printf("Key %q: %q\n", key, contents)
 	}
 
-	val1, err := db1.GetKey("a")
+	val1, _, err := db1.GetKey(db.DefaultNamespace, "a")
 	if err != nil {
 		t.Fatalf("GetKey: Could not get key: %v", err)
 	}
@@ -128,7 +158,7 @@ func TestServerCreate(t *testing.T) {
 		t.Errorf("Unexpected value for key 'a': got %q, want %q", val1, want1)
 	}
 
-	val2, err := db2.GetKey("b")
+	val2, _, err := db2.GetKey(db.DefaultNamespace, "b")
 	if err != nil {
 		t.Fatalf("GetKey: Could not get key: %v", err)
 	}
@@ -138,3 +168,2056 @@ func TestServerCreate(t *testing.T) {
 		t.Errorf("Unexpected value for key 'b': got %q, want %q", val2, want2)
 	}
 }
+
+func TestDeleteHandler(t *testing.T) {
+	addrs, dbs := startShards(t, 2, func(mux *http.ServeMux, s *server.Server) {
+		mux.HandleFunc("/set", s.SetHandler)
+		mux.HandleFunc("/delete", s.DeleteHandler)
+	})
+
+	for _, key := range []string{"a", "b"} {
+		resp, err := http.Get("http://" + addrs[0] + "/set?key=" + key + "&value=value-" + key)
+		if err != nil {
+			t.Fatalf("Could not set key %q: %v", key, err)
+		}
+		resp.Body.Close()
+
+		resp, err = http.Get("http://" + addrs[0] + "/delete?key=" + key)
+		if err != nil {
+			t.Fatalf("Could not delete key %q: %v", key, err)
+		}
+		resp.Body.Close()
+	}
+
+	for _, d := range dbs {
+		for _, key := range []string{"a", "b"} {
+			val, _, err := d.GetKey(db.DefaultNamespace, key)
+			if err != nil {
+				t.Fatalf("GetKey: Could not get key: %v", err)
+			}
+			if val != nil {
+				t.Errorf("Unexpected value for key %q after delete: got %q, want nil", key, val)
+			}
+		}
+	}
+}
+
+func TestScanHandler(t *testing.T) {
+	addrs, dbs := startShards(t, 2, func(mux *http.ServeMux, s *server.Server) {
+		mux.HandleFunc("/scan", s.ScanHandler)
+	})
+
+	for i, key := range []string{"k1", "k2", "k3", "k4", "k5", "x"} {
+		d := dbs[i%2]
+		if err := d.SetKey(db.DefaultNamespace, key, []byte("value-"+key)); err != nil {
+			t.Fatalf("SetKey(%q): %v", key, err)
+		}
+	}
+
+	var got []string
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("Too many pages, got keys %q so far", got)
+		}
+
+		resp, err := http.Get("http://" + addrs[0] + "/scan?prefix=k&limit=2&token=" + token)
+		if err != nil {
+			t.Fatalf("Could not scan: %v", err)
+		}
+		var res server.ScanResult
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Could not decode scan result: %v", err)
+		}
+
+		for _, item := range res.Items {
+			if item.Value != "value-"+item.Key {
+				t.Errorf("Unexpected value for key %q: got %q, want %q", item.Key, item.Value, "value-"+item.Key)
+			}
+			got = append(got, item.Key)
+		}
+
+		if res.Next == "" {
+			break
+		}
+		token = res.Next
+	}
+
+	if want := []string{"k1", "k2", "k3", "k4", "k5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected scan result: got %q, want %q", got, want)
+	}
+
+	// The shards are asked for one more key than the largest page.
+	resp, err := http.Get("http://" + addrs[0] + "/scan?prefix=k&limit=1000")
+	if err != nil {
+		t.Fatalf("Could not scan: %v", err)
+	}
+	var res server.ScanResult
+	if resp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(resp.Body).Decode(&res)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || err != nil || len(res.Items) != 5 {
+		t.Errorf("Scan with the largest page: got status %d, %d keys and error %v, want 5 keys", resp.StatusCode, len(res.Items), err)
+	}
+	resp, err = http.Get("http://" + addrs[0] + "/scan?prefix=k&limit=1001")
+	if err != nil {
+		t.Fatalf("Could not scan: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Scan with a page that is too large: got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestMultiGetSet(t *testing.T) {
+	addrs, dbs := startShards(t, 2, func(mux *http.ServeMux, s *server.Server) {
+		mux.HandleFunc("/mget", s.MultiGetHandler)
+		mux.HandleFunc("/mset", s.MultiSetHandler)
+	})
+
+	post := func(path string, form url.Values) []server.BatchItem {
+		t.Helper()
+
+		resp, err := http.PostForm("http://"+addrs[0]+path, form)
+		if err != nil {
+			t.Fatalf("Could not post to %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+
+		var res []server.BatchItem
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatalf("Could not decode %s result: %v", path, err)
+		}
+		return res
+	}
+
+	// "a" belongs to shard 0 and "b" to shard 1.
+	res := post("/mset", url.Values{"key": {"a", "b"}, "value": {"value-a", "value-b"}})
+	if want := []server.BatchItem{{Key: "a"}, {Key: "b"}}; !reflect.DeepEqual(res, want) {
+		t.Errorf("Unexpected /mset result: got %+v, want %+v", res, want)
+	}
+
+	if val, _, err := dbs[1].GetKey(db.DefaultNamespace, "b"); err != nil || string(val) != "value-b" {
+		t.Errorf("GetKey(%q) on shard 1: got (%q, %v), want (%q, nil)", "b", val, err, "value-b")
+	}
+
+	res = post("/mget", url.Values{"key": {"b", "c", "a"}})
+	want := []server.BatchItem{
+		{Key: "b", Value: "value-b", Found: true},
+		{Key: "c"},
+		{Key: "a", Value: "value-a", Found: true},
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("Unexpected /mget result: got %+v, want %+v", res, want)
+	}
+
+	resp, err := http.PostForm("http://"+addrs[0]+"/mset", url.Values{"key": {"a", "b"}, "value": {"value-a"}})
+	if err != nil {
+		t.Fatalf("Could not post to /mset: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Unexpected /mset status for mismatched values: got %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestLocalFromClient(t *testing.T) {
+	addrs, dbs := startShards(t, 2, func(mux *http.ServeMux, s *server.Server) {
+		mux.HandleFunc("/mget", s.MultiGetHandler)
+	})
+
+	// "b" belongs to shard 1.
+	if err := dbs[1].SetKey(db.DefaultNamespace, "b", []byte("value-b")); err != nil {
+		t.Fatalf("SetKey: %v", err)
+	}
+
+	mget := func(header http.Header) []server.BatchItem {
+		t.Helper()
+
+		form := url.Values{"key": {"b"}, "local": {"true"}}
+		req, err := http.NewRequest(http.MethodPost, "http://"+addrs[0]+"/mget", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header = header
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Could not post to /mget: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var res []server.BatchItem
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatalf("Could not decode /mget result: %v", err)
+		}
+		return res
+	}
+
+	// A client cannot skip the routing of its request.
+	res := mget(http.Header{})
+	if want := []server.BatchItem{{Key: "b", Value: "value-b", Found: true}}; !reflect.DeepEqual(res, want) {
+		t.Errorf("Unexpected /mget result from a client: got %+v, want %+v", res, want)
+	}
+
+	// The test servers run on the host of the client, which makes it a peer.
+	res = mget(http.Header{"X-Peer": {"true"}})
+	if want := []server.BatchItem{{Key: "b"}}; !reflect.DeepEqual(res, want) {
+		t.Errorf("Unexpected /mget result from a peer: got %+v, want %+v", res, want)
+	}
+}
+
+func TestCompareAndSwapHandler(t *testing.T) {
+	addrs, _ := startShards(t, 2, func(mux *http.ServeMux, s *server.Server) {
+		mux.HandleFunc("/set", s.SetHandler)
+		mux.HandleFunc("/cas", s.CompareAndSwapHandler)
+	})
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"/set?key=b&value=1&if_absent=true", http.StatusOK},
+		{"/set?key=b&value=2&if_absent=true", http.StatusConflict},
+		{"/cas?key=b&expected=2&value=3", http.StatusConflict},
+		{"/cas?key=b&expected=1&value=3", http.StatusOK},
+		{"/set?key=b&value=4&if_version=100", http.StatusConflict},
+		{"/set?key=b&value=4&if_version=x", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		// Requests are sent to shard 0, while "b" belongs to shard 1.
+		resp, err := http.Get("http://" + addrs[0] + tt.query)
+		if err != nil {
+			t.Fatalf("Could not get %q: %v", tt.query, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.want {
+			t.Errorf("Unexpected status for %q: got %d, want %d", tt.query, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	addrs, dbs := startShards(t, 2, func(mux *http.ServeMux, s *server.Server) {
+		mux.HandleFunc("/get", s.GetHandler)
+		mux.HandleFunc("/history", s.HistoryHandler)
+	})
+	dbs[1].SetHistoryLimit(10)
+
+	for _, v := range []string{"old", "new"} {
+		if err := dbs[1].SetKey(db.DefaultNamespace, "b", []byte(v)); err != nil {
+			t.Fatalf("SetKey(%q, %q): %v", "b", v, err)
+		}
+	}
+
+	resp, err := http.Get("http://" + addrs[1] + "/history?key=b")
+	if err != nil {
+		t.Fatalf("Could not get history: %v", err)
+	}
+	var history []server.HistoryItem
+	err = json.NewDecoder(resp.Body).Decode(&history)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Could not decode history: %v", err)
+	}
+
+	if len(history) != 2 || history[0].Value != "new" || history[1].Value != "old" {
+		t.Fatalf("Unexpected history: got %+v, want [new old]", history)
+	}
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/get?key=b&version=%d", addrs[0], history[1].Version))
+	if err != nil {
+		t.Fatalf("Could not get old version: %v", err)
+	}
+	contents, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Could not read old version: %v", err)
+	}
+
+	if want := []byte(`Value : "old"`); !bytes.Contains(contents, want) {
+		t.Errorf("Unexpected contents for old version: got %q, want %q", contents, want)
+	}
+}
+
+func TestNamespaceHandlers(t *testing.T) {
+	addrs, dbs := startShards(t, 2, func(mux *http.ServeMux, s *server.Server) {
+		mux.HandleFunc("/set", s.SetHandler)
+		mux.HandleFunc("/namespaces", s.NamespacesHandler)
+		mux.HandleFunc("/namespaces/create", s.CreateNamespaceHandler)
+		mux.HandleFunc("/namespaces/drop", s.DropNamespaceHandler)
+	})
+
+	get := func(path string) (int, []byte) {
+		t.Helper()
+		resp, err := http.Get("http://" + addrs[0] + path)
+		if err != nil {
+			t.Fatalf("Could not get %q: %v", path, err)
+		}
+		defer resp.Body.Close()
+		contents, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Could not read %q: %v", path, err)
+		}
+		return resp.StatusCode, contents
+	}
+
+	// "b" belongs to shard 1, so the set is redirected there.
+	get("/set?ns=tenant&key=b&value=1")
+	if val, _, err := dbs[1].GetKey("tenant", "b"); err != nil || string(val) != "1" {
+		t.Errorf("GetKey(tenant, b) on shard 1: got (%q, %v), want (%q, nil)", val, err, "1")
+	}
+	if val, _, _ := dbs[1].GetKey(db.DefaultNamespace, "b"); val != nil {
+		t.Errorf("GetKey(default, b) on shard 1: got %q, want nil", val)
+	}
+
+	if code, contents := get("/namespaces/create?ns=other"); code != http.StatusOK {
+		t.Fatalf("Unexpected status for create: got %d (%q), want %d", code, contents, http.StatusOK)
+	}
+
+	_, contents := get("/namespaces")
+	var names []string
+	if err := json.Unmarshal(contents, &names); err != nil {
+		t.Fatalf("Could not decode namespaces %q: %v", contents, err)
+	}
+	if want := []string{"default", "other", "tenant"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Unexpected namespaces: got %q, want %q", names, want)
+	}
+
+	// tenant only exists on shard 1; dropping it on shard 0 is a no-op.
+	if code, contents := get("/namespaces/drop?ns=tenant"); code != http.StatusOK {
+		t.Errorf("Unexpected status for drop: got %d (%q), want %d", code, contents, http.StatusOK)
+	}
+	if val, _, _ := dbs[1].GetKey("tenant", "b"); val != nil {
+		t.Errorf("GetKey(tenant, b) after drop: got %q, want nil", val)
+	}
+
+	if code, _ := get("/namespaces/drop?ns=default"); code != http.StatusBadGateway {
+		t.Errorf("Unexpected status for dropping the default namespace: got %d, want %d", code, http.StatusBadGateway)
+	}
+}
+
+func TestBackupHandler(t *testing.T) {
+	addrs, dbs := startShards(t, 1, func(mux *http.ServeMux, s *server.Server) {
+		mux.HandleFunc("/backup", s.BackupHandler)
+	})
+	if err := dbs[0].SetKey(db.DefaultNamespace, "a", []byte("b")); err != nil {
+		t.Fatalf("SetKey: %v", err)
+	}
+
+	resp, err := http.Get("http://" + addrs[0] + "/backup")
+	if err != nil {
+		t.Fatalf("Could not get backup: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status: got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	path := t.TempDir() + "/backup.db"
+	if err := db.RestoreSnapshot(resp.Body, path); err != nil {
+		t.Fatalf("RestoreSnapshot: %v", err)
+	}
+
+	restored, closeFunc, err := db.NewDB(path, true)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer closeFunc()
+	if val, _, err := restored.GetKey(db.DefaultNamespace, "a"); err != nil || string(val) != "b" {
+		t.Errorf("GetKey(a) on restored backup: got (%q, %v), want (%q, nil)", val, err, "b")
+	}
+}
+
+func TestReplicationLogHandler(t *testing.T) {
+	addrs, dbs := startShards(t, 1, func(mux *http.ServeMux, s *server.Server) {
+		mux.HandleFunc("/replication/log", s.ReplicationLogHandler)
+	})
+	if err := dbs[0].SetReplicas([]string{"r1"}); err != nil {
+		t.Fatalf("SetReplicas: %v", err)
+	}
+	for _, v := range []string{"1", "2"} {
+		if err := dbs[0].SetKey(db.DefaultNamespace, "a", []byte(v)); err != nil {
+			t.Fatalf("SetKey: %v", err)
+		}
+	}
+
+	get := func(query string) (int, []db.Change) {
+		t.Helper()
+		resp, err := http.Get("http://" + addrs[0] + "/replication/log?" + query)
+		if err != nil {
+			t.Fatalf("Could not get %q: %v", query, err)
+		}
+		defer resp.Body.Close()
+
+		var changes []db.Change
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&changes); err != nil {
+				t.Fatalf("Could not decode changes: %v", err)
+			}
+		}
+		return resp.StatusCode, changes
+	}
+
+	code, changes := get("replica=r1&after=0")
+	if code != http.StatusOK || len(changes) != 2 || string(changes[1].Value) != "2" {
+		t.Fatalf("Unexpected log: got %d %+v, want both changes", code, changes)
+	}
+
+	replica := createShardDB(t)
+	if err := replica.ApplyChanges(changes); err != nil {
+		t.Fatalf("ApplyChanges: %v", err)
+	}
+	if val, _, err := replica.GetKey(db.DefaultNamespace, "a"); err != nil || string(val) != "2" {
+		t.Errorf("GetKey(a) on the replica: got (%q, %v), want (%q, nil)", val, err, "2")
+	}
+
+	// Acknowledging both changes truncates the log.
+	if code, changes := get("replica=r1&after=2"); code != http.StatusOK || len(changes) != 0 {
+		t.Errorf("Unexpected log after 2: got %d %+v, want no changes", code, changes)
+	}
+	if code, _ := get("after=0"); code != http.StatusGone {
+		t.Errorf("Unexpected status for a truncated position: got %d, want %d", code, http.StatusGone)
+	}
+	if code, _ := get("after=x"); code != http.StatusBadRequest {
+		t.Errorf("Unexpected status for an invalid position: got %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestReplicationStream(t *testing.T) {
+	addrs, dbs := startShards(t, 1, func(mux *http.ServeMux, s *server.Server) {
+		mux.HandleFunc("/replication/stream", s.ReplicationStreamHandler)
+	})
+	primary := dbs[0]
+	replica := createShardDB(t)
+	if err := primary.SetReplicas([]string{"replica"}); err != nil {
+		t.Fatalf("SetReplicas: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		replication.Run(ctx, replica, addrs[0], "replica", nil)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	for i := 0; i < 10; i++ {
+		if err := primary.SetKey(db.DefaultNamespace, "a", []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("SetKey: %v", err)
+		}
+	}
+
+	// The changes are pushed and acknowledged without polling.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		replicas, err := primary.Replicas()
+		if err != nil {
+			t.Fatalf("Replicas: %v", err)
+		}
+		if replicas["replica"] == 10 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Replica did not acknowledge all changes: got %v", replicas)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if val, _, err := replica.GetKey(db.DefaultNamespace, "a"); err != nil || string(val) != "9" {
+		t.Errorf("GetKey(a) on the replica: got (%q, %v), want (%q, nil)", val, err, "9")
+	}
+
+	resp, err := http.Get("http://" + addrs[0] + "/replication/stream?replica=x&after=0")
+	if err != nil {
+		t.Fatalf("Could not get stream: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("Unexpected status without upgrade: got %d, want %d", resp.StatusCode, http.StatusUpgradeRequired)
+	}
+}
+
+func TestReplicationBootstrap(t *testing.T) {
+	addrs, dbs := startShards(t, 1, func(mux *http.ServeMux, s *server.Server) {
+		mux.HandleFunc("/backup", s.BackupHandler)
+		mux.HandleFunc("/replication/stream", s.ReplicationStreamHandler)
+	})
+	primary := dbs[0]
+
+	// Another replica applied every change, so the log is truncated before
+	// the new replica joins.
+	for i := 0; i < 5; i++ {
+		if err := primary.SetKey(db.DefaultNamespace, "a", []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("SetKey: %v", err)
+		}
+	}
+	if err := primary.AckReplication("other", 5); err != nil {
+		t.Fatalf("AckReplication: %v", err)
+	}
+
+	replica := createShardDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		replication.Run(ctx, replica, addrs[0], "replica", nil)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	if err := primary.SetKey(db.DefaultNamespace, "b", []byte("x")); err != nil {
+		t.Fatalf("SetKey: %v", err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		replicas, err := primary.Replicas()
+		if err != nil {
+			t.Fatalf("Replicas: %v", err)
+		}
+		if replicas["replica"] == 6 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Replica did not catch up: got %v", replicas)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for key, want := range map[string]string{"a": "4", "b": "x"} {
+		if val, _, err := replica.GetKey(db.DefaultNamespace, key); err != nil || string(val) != want {
+			t.Errorf("GetKey(%s) on the replica: got (%q, %v), want (%q, nil)", key, val, err, want)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	// Shard 0 has a primary and two replicas, shard 1 only a primary.
+	names := []string{"primary", "replica1", "replica2", "other"}
+	muxes := make(map[string]*http.ServeMux)
+	servers := make(map[string]*httptest.Server)
+	addrs := make(map[string]string)
+	for _, name := range names {
+		muxes[name] = http.NewServeMux()
+		servers[name] = httptest.NewServer(muxes[name])
+		t.Cleanup(servers[name].Close)
+		addrs[name] = strings.TrimPrefix(servers[name].URL, "http://")
+	}
+
+	dbs := make(map[string]*db.DB)
+	shardServers := make(map[string]*server.Server)
+	for _, name := range names {
+		d, closeFunc, err := db.NewDBWithStorage(db.NewMemoryStorage(), strings.HasPrefix(name, "replica"))
+		if err != nil {
+			t.Fatalf("NewDBWithStorage: %v", err)
+		}
+		t.Cleanup(func() { closeFunc() })
+
+		curID := 0
+		if name == "other" {
+			curID = 1
+		}
+		s := server.NewServer(d, &config.Shards{
+			Count:    2,
+			CurID:    curID,
+			Addrs:    map[int]string{0: addrs["primary"], 1: addrs["other"]},
+			Replicas: map[int][]string{0: {addrs["replica1"], addrs["replica2"]}},
+		})
+		muxes[name].HandleFunc("/get", s.GetHandler)
+		muxes[name].HandleFunc("/set", s.SetHandler)
+		muxes[name].HandleFunc("/backup", s.BackupHandler)
+		muxes[name].HandleFunc("/replication/stream", s.ReplicationStreamHandler)
+		muxes[name].HandleFunc("/replication/position", s.PositionHandler)
+		muxes[name].HandleFunc("/replication/primary", s.PrimaryHandler)
+		dbs[name], shardServers[name] = d, s
+	}
+	if err := dbs["primary"].SetReplicas([]string{addrs["replica1"], addrs["replica2"]}); err != nil {
+		t.Fatalf("SetReplicas: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{}, 2)
+	for _, name := range []string{"replica1", "replica2"} {
+		go func(name string) {
+			defer func() { done <- struct{}{} }()
+			shardServers[name].Follow(ctx, addrs[name])
+		}(name)
+	}
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		<-done
+	})
+
+	// Find a key that belongs to shard 0.
+	shards := &config.Shards{Count: 2}
+	key := "a"
+	for i := 0; shards.Id(key) != 0; i++ {
+		key = fmt.Sprint("a", i)
+	}
+	if err := dbs["primary"].SetKey(db.DefaultNamespace, key, []byte("1")); err != nil {
+		t.Fatalf("SetKey: %v", err)
+	}
+	waitFor(t, "both replicas to apply the change", func() bool {
+		replicas, err := dbs["primary"].Replicas()
+		return err == nil && replicas[addrs["replica1"]] == 1 && replicas[addrs["replica2"]] == 1
+	})
+
+	servers["primary"].Close()
+
+	// Both replicas are equally up to date, so the one with the smallest
+	// address takes over.
+	winner, loser := "replica1", "replica2"
+	if addrs[loser] < addrs[winner] {
+		winner, loser = loser, winner
+	}
+	waitFor(t, "a replica to be promoted", func() bool { return !dbs[winner].ReadOnly() })
+	if !dbs[loser].ReadOnly() {
+		t.Errorf("Both replicas were promoted")
+	}
+
+	// The other shard routes writes to the new primary and the remaining
+	// replica follows it.
+	resp, err := http.Get("http://" + addrs["other"] + "/set?" + url.Values{"key": {key}, "value": {"2"}}.Encode())
+	if err != nil {
+		t.Fatalf("Could not set key: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "Error : <nil>") {
+		t.Fatalf("Set through the other shard failed: %s", body)
+	}
+	if val, _, err := dbs[winner].GetKey(db.DefaultNamespace, key); err != nil || string(val) != "2" {
+		t.Errorf("GetKey on the new primary: got (%q, %v), want (%q, nil)", val, err, "2")
+	}
+	waitFor(t, "the remaining replica to follow the new primary", func() bool {
+		val, _, err := dbs[loser].GetKey(db.DefaultNamespace, key)
+		return err == nil && string(val) == "2"
+	})
+}
+
+// waitFor polls cond until it holds and fails the test if it does not hold
+// within 10 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRaftShard(t *testing.T) {
+	const members = 3
+	servers := make([]*httptest.Server, members)
+	muxes := make([]*http.ServeMux, members)
+	addrs := make([]string, members)
+	for i := range servers {
+		muxes[i] = http.NewServeMux()
+		servers[i] = httptest.NewServer(muxes[i])
+		t.Cleanup(servers[i].Close)
+		addrs[i] = strings.TrimPrefix(servers[i].URL, "http://")
+	}
+
+	dbs := make([]*db.DB, members)
+	nodes := make([]*raft.Node, members)
+	stops := make([]func(), members)
+	for i := range servers {
+		d := createShardDB(t)
+		var peers []string
+		for j, addr := range addrs {
+			if j != i {
+				peers = append(peers, addr)
+			}
+		}
+		n, err := raft.NewNode(d, addrs[i], peers)
+		if err != nil {
+			t.Fatalf("NewNode: %v", err)
+		}
+		d.SetProposer(n)
+
+		s := server.NewServer(d, &config.Shards{
+			Count:    1,
+			Addrs:    map[int]string{0: addrs[0]},
+			Replicas: map[int][]string{0: addrs[1:]},
+			Raft:     map[int]bool{0: true},
+		})
+		s.UseRaft(n)
+		muxes[i].HandleFunc("/get", s.GetHandler)
+		muxes[i].HandleFunc("/set", s.SetHandler)
+		muxes[i].HandleFunc("/raft/vote", s.RaftVoteHandler)
+		muxes[i].HandleFunc("/raft/append", s.RaftAppendHandler)
+		muxes[i].HandleFunc("/raft/snapshot", s.RaftSnapshotHandler)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			n.Run(ctx)
+		}()
+		stops[i] = func() {
+			cancel()
+			<-done
+		}
+		t.Cleanup(stops[i])
+		dbs[i], nodes[i] = d, n
+	}
+
+	leaderOf := func(exclude int) int {
+		t.Helper()
+		res := -1
+		waitFor(t, "a leader", func() bool {
+			for i, n := range nodes {
+				if i != exclude && n.IsLeader() {
+					res = i
+					return true
+				}
+			}
+			return false
+		})
+		return res
+	}
+
+	set := func(member int, key, value string) {
+		t.Helper()
+		resp, err := http.Get("http://" + addrs[member] + "/set?" + url.Values{"key": {key}, "value": {value}}.Encode())
+		if err != nil {
+			t.Fatalf("Could not set key: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "Error : <nil>") {
+			t.Fatalf("Set %q on member %d: status %d: %s", key, member, resp.StatusCode, body)
+		}
+	}
+
+	// Writes sent to a follower are forwarded to the leader and only
+	// acknowledged once a majority stored them.
+	leader := leaderOf(-1)
+	set((leader+1)%members, "a", "1")
+	stored := 0
+	for _, d := range dbs {
+		entries, err := d.RaftEntries(0, 100)
+		if err != nil {
+			t.Fatalf("RaftEntries: %v", err)
+		}
+		for _, e := range entries {
+			if len(e.Changes) == 1 && string(e.Changes[0].Key) == "a" {
+				stored++
+			}
+		}
+	}
+	if stored < 2 {
+		t.Errorf("Write stored by %d members when it was acknowledged, want at least 2", stored)
+	}
+
+	// The group survives the loss of the leader without losing the write.
+	servers[leader].Close()
+	stops[leader]()
+	newLeader := leaderOf(leader)
+	if val, _, err := dbs[newLeader].GetKey(db.DefaultNamespace, "a"); err != nil || string(val) != "1" {
+		t.Errorf("GetKey(a) on the new leader: got (%q, %v), want (%q, nil)", val, err, "1")
+	}
+
+	follower := 3 - leader - newLeader
+	set(follower, "b", "2")
+	waitFor(t, "the follower to apply the write", func() bool {
+		val, _, err := dbs[follower].GetKey(db.DefaultNamespace, "b")
+		return err == nil && string(val) == "2"
+	})
+
+	// Without a majority, a write times out and may still be committed by
+	// a later leader, so the leader steps down instead of accepting writes
+	// that would not see it.
+	servers[follower].Close()
+	stops[follower]()
+	resp, err := http.Get("http://" + addrs[newLeader] + "/set?" + url.Values{"key": {"c"}, "value": {"3"}}.Encode())
+	if err != nil {
+		t.Fatalf("Could not set key: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Contains(string(body), "Error : <nil>") {
+		t.Errorf("Set without a majority: got %s, want an error", body)
+	}
+	if nodes[newLeader].IsLeader() {
+		t.Errorf("Member %d is still the leader after a write timed out", newLeader)
+	}
+}
+
+func TestSetAckLevels(t *testing.T) {
+	addrs, dbs := startShards(t, 1, func(mux *http.ServeMux, s *server.Server) {
+		mux.HandleFunc("/set", s.SetHandler)
+		mux.HandleFunc("/replication/stream", s.ReplicationStreamHandler)
+	})
+	primary := dbs[0]
+	if err := primary.SetReplicas([]string{"replica"}); err != nil {
+		t.Fatalf("SetReplicas: %v", err)
+	}
+
+	replica := createShardDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		replication.Run(ctx, replica, addrs[0], "replica", nil)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	set := func(key string, params url.Values) (int, string) {
+		t.Helper()
+		params.Set("key", key)
+		params.Set("value", key)
+		resp, err := http.Get("http://" + addrs[0] + "/set?" + params.Encode())
+		if err != nil {
+			t.Fatalf("Could not set key: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// The write is on the replica as soon as it is acknowledged.
+	for _, ack := range []string{"1", "all"} {
+		key := "ack-" + ack
+		if status, body := set(key, url.Values{"ack": {ack}}); status != http.StatusOK {
+			t.Fatalf("Set with ack=%s: status %d: %s", ack, status, body)
+		}
+		if val, _, err := replica.GetKey(db.DefaultNamespace, key); err != nil || string(val) != key {
+			t.Errorf("GetKey(%s) on the replica after ack=%s: got (%q, %v), want (%q, nil)", key, ack, val, err, key)
+		}
+	}
+
+	for _, ack := range []string{"2", "-1", "some"} {
+		if status, body := set("bad", url.Values{"ack": {ack}}); status != http.StatusBadRequest {
+			t.Errorf("Set with ack=%s: got status %d (%s), want %d", ack, status, body, http.StatusBadRequest)
+		}
+	}
+
+	// A replica that never applies the write makes ack=all time out, but
+	// the write is committed on the primary.
+	if err := primary.SetReplicas([]string{"replica", "gone"}); err != nil {
+		t.Fatalf("SetReplicas: %v", err)
+	}
+	status, body := set("slow", url.Values{"ack": {"all"}, "ack_timeout": {"100ms"}})
+	if status != http.StatusGatewayTimeout || !strings.Contains(body, "1 of 2 replicas") {
+		t.Errorf("Set with ack=all and a missing replica: got status %d (%s), want %d", status, body, http.StatusGatewayTimeout)
+	}
+	if val, _, err := primary.GetKey(db.DefaultNamespace, "slow"); err != nil || string(val) != "slow" {
+		t.Errorf("GetKey(slow) on the primary: got (%q, %v), want (%q, nil)", val, err, "slow")
+	}
+}
+
+func TestReplicaReads(t *testing.T) {
+	// Shard 0 has a primary, a replica that follows it and a replica that
+	// never caught up. Shard 1 only has a primary.
+	names := []string{"primary", "fresh", "stale", "other"}
+	muxes := make(map[string]*http.ServeMux)
+	addrs := make(map[string]string)
+	for _, name := range names {
+		muxes[name] = http.NewServeMux()
+		ts := httptest.NewServer(muxes[name])
+		t.Cleanup(ts.Close)
+		addrs[name] = strings.TrimPrefix(ts.URL, "http://")
+	}
+
+	dbs := make(map[string]*db.DB)
+	shardServers := make(map[string]*server.Server)
+	for _, name := range names {
+		replica := name == "fresh" || name == "stale"
+		d, closeFunc, err := db.NewDBWithStorage(db.NewMemoryStorage(), replica)
+		if err != nil {
+			t.Fatalf("NewDBWithStorage: %v", err)
+		}
+		t.Cleanup(func() { closeFunc() })
+
+		curID := 0
+		if name == "other" {
+			curID = 1
+		}
+		s := server.NewServer(d, &config.Shards{
+			Count:    2,
+			CurID:    curID,
+			Addrs:    map[int]string{0: addrs["primary"], 1: addrs["other"]},
+			Replicas: map[int][]string{0: {addrs["fresh"], addrs["stale"]}},
+		})
+		muxes[name].HandleFunc("/get", s.GetHandler)
+		muxes[name].HandleFunc("/replication/stream", s.ReplicationStreamHandler)
+		muxes[name].HandleFunc("/replication/position", s.PositionHandler)
+		dbs[name], shardServers[name] = d, s
+	}
+	if err := dbs["primary"].SetReplicas([]string{addrs["fresh"], addrs["stale"]}); err != nil {
+		t.Fatalf("SetReplicas: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		shardServers["fresh"].Follow(ctx, addrs["fresh"])
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	// Find a key that belongs to shard 0.
+	shards := &config.Shards{Count: 2}
+	key := "a"
+	for i := 0; shards.Id(key) != 0; i++ {
+		key = fmt.Sprint("a", i)
+	}
+	if err := dbs["primary"].SetKey(db.DefaultNamespace, key, []byte("1")); err != nil {
+		t.Fatalf("SetKey: %v", err)
+	}
+	waitFor(t, "the replica to catch up", func() bool {
+		val, _, err := dbs["fresh"].GetKey(db.DefaultNamespace, key)
+		return err == nil && string(val) == "1"
+	})
+
+	get := func(addr string, params url.Values) (int, string) {
+		t.Helper()
+		params.Set("key", key)
+		resp, err := http.Get("http://" + addr + "/get?" + params.Encode())
+		if err != nil {
+			t.Fatalf("Could not get key: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	// Forwarded reads start with the URL they were forwarded to.
+	servedBy := func(body, name string) bool {
+		return strings.Contains(body, "http://"+addrs[name]+"/get?")
+	}
+
+	// Strong reads go to the primary.
+	if _, body := get(addrs["other"], url.Values{}); !servedBy(body, "primary") {
+		t.Errorf("Strong read was not served by the primary: %s", body)
+	}
+
+	// Bounded reads skip the replica that never caught up.
+	for i := 0; i < 4; i++ {
+		_, body := get(addrs["other"], url.Values{"max_staleness": {"5s"}})
+		if !servedBy(body, "fresh") || !strings.Contains(body, `Value : "1"`) {
+			t.Errorf("Bounded read was not served by the fresh replica: %s", body)
+		}
+	}
+
+	// Eventually consistent reads alternate between the replicas.
+	served := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		_, body := get(addrs["other"], url.Values{"consistency": {"eventual"}})
+		for _, name := range []string{"primary", "fresh", "stale"} {
+			if servedBy(body, name) {
+				served[name] = true
+			}
+		}
+	}
+	if want := map[string]bool{"fresh": true, "stale": true}; !reflect.DeepEqual(served, want) {
+		t.Errorf("Eventually consistent reads served by %v, want %v", served, want)
+	}
+
+	// A stale replica does not serve bounded reads of its own shard.
+	if _, body := get(addrs["stale"], url.Values{"max_staleness": {"5s"}}); !strings.Contains(body, `Value : "1"`) {
+		t.Errorf("Bounded read on the stale replica: got %s", body)
+	}
+
+	if code, _ := get(addrs["other"], url.Values{"max_staleness": {"soon"}}); code != http.StatusBadRequest {
+		t.Errorf("Invalid max_staleness: got status %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestRepairHandler(t *testing.T) {
+	names := []string{"primary", "replica"}
+	muxes := make(map[string]*http.ServeMux)
+	addrs := make(map[string]string)
+	for _, name := range names {
+		muxes[name] = http.NewServeMux()
+		ts := httptest.NewServer(muxes[name])
+		t.Cleanup(ts.Close)
+		addrs[name] = strings.TrimPrefix(ts.URL, "http://")
+	}
+
+	dbs := make(map[string]*db.DB)
+	for _, name := range names {
+		d, closeFunc, err := db.NewDBWithStorage(db.NewMemoryStorage(), name == "replica")
+		if err != nil {
+			t.Fatalf("NewDBWithStorage: %v", err)
+		}
+		t.Cleanup(func() { closeFunc() })
+
+		s := server.NewServer(d, &config.Shards{
+			Count:    1,
+			Addrs:    map[int]string{0: addrs["primary"]},
+			Replicas: map[int][]string{0: {addrs["replica"]}},
+		})
+		muxes[name].HandleFunc("/namespaces", s.NamespacesHandler)
+		muxes[name].HandleFunc("/replication/tree", s.MerkleTreeHandler)
+		muxes[name].HandleFunc("/replication/entries", s.MerkleEntriesHandler)
+		muxes[name].HandleFunc("/repair", s.RepairHandler)
+		dbs[name] = d
+	}
+
+	// The replica never received the changes of the primary and has a key
+	// in a namespace that the primary does not have.
+	for i := 0; i < 20; i++ {
+		if err := dbs["primary"].SetKey("", fmt.Sprint("key", i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("SetKey: %v", err)
+		}
+	}
+	if err := dbs["replica"].ApplyChanges([]db.Change{
+		{Seq: 1, Namespace: "other", Key: []byte("stale"), Value: []byte("x"), Version: 1},
+	}); err != nil {
+		t.Fatalf("ApplyChanges: %v", err)
+	}
+
+	resp, err := http.Post("http://"+addrs["primary"]+"/repair", "", nil)
+	if err != nil {
+		t.Fatalf("Could not repair: %v", err)
+	}
+	defer resp.Body.Close()
+	var res []server.ReplicaRepair
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("Could not decode the repair results: %v", err)
+	}
+	if len(res) != 1 || res[0].Err != "" {
+		t.Fatalf("Repair results: got %+v, want one result without error", res)
+	}
+	repaired := make(map[string]int)
+	for _, r := range res[0].Results {
+		repaired[r.Namespace] = r.Repaired
+	}
+	if want := map[string]int{db.DefaultNamespace: 20, "other": 1}; !reflect.DeepEqual(repaired, want) {
+		t.Errorf("Repaired keys by namespace: got %v, want %v", repaired, want)
+	}
+
+	for i := 0; i < 20; i++ {
+		if val, _, err := dbs["replica"].GetKey("", fmt.Sprint("key", i)); err != nil || string(val) != fmt.Sprint(i) {
+			t.Errorf("GetKey(key%d) on the replica = %q, %v, want %q, nil", i, val, err, fmt.Sprint(i))
+		}
+	}
+	if val, _, _ := dbs["replica"].GetKey("other", "stale"); val != nil {
+		t.Errorf("The stale key was not deleted: got %q", val)
+	}
+}
+
+func TestReplicationStatus(t *testing.T) {
+	names := []string{"primary", "replica"}
+	muxes := make(map[string]*http.ServeMux)
+	addrs := make(map[string]string)
+	for _, name := range names {
+		muxes[name] = http.NewServeMux()
+		ts := httptest.NewServer(muxes[name])
+		t.Cleanup(ts.Close)
+		addrs[name] = strings.TrimPrefix(ts.URL, "http://")
+	}
+
+	dbs := make(map[string]*db.DB)
+	shardServers := make(map[string]*server.Server)
+	for _, name := range names {
+		d, closeFunc, err := db.NewDBWithStorage(db.NewMemoryStorage(), name == "replica")
+		if err != nil {
+			t.Fatalf("NewDBWithStorage: %v", err)
+		}
+		t.Cleanup(func() { closeFunc() })
+
+		s := server.NewServer(d, &config.Shards{
+			Count:    1,
+			Addrs:    map[int]string{0: addrs["primary"]},
+			Replicas: map[int][]string{0: {addrs["replica"], "gone"}},
+		})
+		muxes[name].HandleFunc("/replication/stream", s.ReplicationStreamHandler)
+		muxes[name].HandleFunc("/replication/position", s.PositionHandler)
+		muxes[name].HandleFunc("/replication/status", s.ReplicationStatusHandler)
+		dbs[name], shardServers[name] = d, s
+	}
+	if err := dbs["primary"].SetReplicas([]string{addrs["replica"], "gone"}); err != nil {
+		t.Fatalf("SetReplicas: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := dbs["primary"].SetKey("", fmt.Sprint("key", i), []byte("v")); err != nil {
+			t.Fatalf("SetKey: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		shardServers["replica"].Follow(ctx, addrs["replica"])
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	status := func(name string) server.ReplicationStatus {
+		t.Helper()
+		resp, err := http.Get("http://" + addrs[name] + "/replication/status")
+		if err != nil {
+			t.Fatalf("Could not get the status: %v", err)
+		}
+		defer resp.Body.Close()
+		var st server.ReplicationStatus
+		if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+			t.Fatalf("Could not decode the status: %v", err)
+		}
+		return st
+	}
+	waitFor(t, "the replica to catch up", func() bool {
+		st := status("replica")
+		return st.Replication != nil && st.Replication.Connected && st.Replication.Applied == 3
+	})
+
+	st := status("replica")
+	if st.Primary || st.Position != 3 || st.Replication.Primary != addrs["primary"] {
+		t.Errorf("Replica status: got %+v, want a replica of %s at position 3", st, addrs["primary"])
+	}
+	if r := st.Replication; r.LagSeconds < 0 || r.LagSeconds > 5 || r.Errors != 0 || r.BackoffSeconds != 0 {
+		t.Errorf("Replica replication status: got %+v, want a recent sync without errors", r)
+	}
+
+	waitFor(t, "the primary to see the replica catch up", func() bool {
+		st := status("primary")
+		return len(st.Replicas) == 2 && st.Replicas[0].Acked == 3
+	})
+	st = status("primary")
+	if !st.Primary || st.Position != 3 {
+		t.Errorf("Primary status: got %+v, want a primary at position 3", st)
+	}
+	byID := make(map[string]server.ReplicaLag)
+	for _, r := range st.Replicas {
+		byID[r.Replica] = r
+	}
+	if r := byID[addrs["replica"]]; r.EntriesBehind != 0 || r.SecondsBehind != 0 || r.LastContact.IsZero() {
+		t.Errorf("Status of the replica on the primary: got %+v, want it caught up", r)
+	}
+	if r := byID["gone"]; r.EntriesBehind != 3 || r.SecondsBehind != -1 || !r.LastContact.IsZero() {
+		t.Errorf("Status of the missing replica on the primary: got %+v, want it 3 entries behind and never seen", r)
+	}
+}
+
+func TestReshard(t *testing.T) {
+	// Two shards are resharded to three with consistent hashing while a
+	// client keeps writing.
+	muxes := make([]*http.ServeMux, 3)
+	addrs := make([]string, 3)
+	for i := range muxes {
+		muxes[i] = http.NewServeMux()
+		ts := httptest.NewServer(muxes[i])
+		t.Cleanup(ts.Close)
+		addrs[i] = strings.TrimPrefix(ts.URL, "http://")
+	}
+	cfg := func(n int, hashing string) config.Config {
+		c := config.Config{Hashing: hashing}
+		for i := 0; i < n; i++ {
+			c.Shards = append(c.Shards, config.Shard{Name: fmt.Sprint("s", i), ShardID: i, Address: addrs[i]})
+		}
+		return c
+	}
+	oldConfig, newConfig := cfg(2, ""), cfg(3, config.HashingConsistent)
+
+	dbs := make([]*db.DB, 3)
+	for i := range muxes {
+		c := oldConfig
+		if i == 2 {
+			c = newConfig
+		}
+		shards, err := config.ParseConfig(c, fmt.Sprint("s", i))
+		if err != nil {
+			t.Fatalf("ParseConfig: %v", err)
+		}
+		dbs[i] = createShardDB(t)
+		// Keep the log to check the deletions of the moved keys.
+		if err := dbs[i].PinLog("test", 0); err != nil {
+			t.Fatalf("PinLog: %v", err)
+		}
+		s := server.NewServer(dbs[i], shards)
+		muxes[i].HandleFunc("/get", s.GetHandler)
+		muxes[i].HandleFunc("/set", s.SetHandler)
+		muxes[i].HandleFunc("/reshard", s.ReshardHandler)
+		muxes[i].HandleFunc("/reshard/start", s.ReshardStartHandler)
+		muxes[i].HandleFunc("/reshard/status", s.ReshardStatusHandler)
+		muxes[i].HandleFunc("/reshard/freeze", s.ReshardFreezeHandler)
+		muxes[i].HandleFunc("/reshard/prepare", s.ReshardPrepareHandler)
+		muxes[i].HandleFunc("/reshard/commit", s.ReshardCommitHandler)
+		muxes[i].HandleFunc("/reshard/abort", s.ReshardAbortHandler)
+		muxes[i].HandleFunc("/reshard/apply", s.ReshardApplyHandler)
+	}
+
+	set := func(key, value string) error {
+		resp, err := http.Get("http://" + addrs[0] + "/set?" + url.Values{"key": {key}, "value": {value}}.Encode())
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if !strings.Contains(string(body), "Error : <nil>") {
+			return fmt.Errorf("set %q: %s", key, body)
+		}
+		return nil
+	}
+	want := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint("key", i)
+		if err := set(key, "old"); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		want[key] = "old"
+	}
+	// A replica that never catches up keeps the logs of the old owners.
+	for i := 0; i < 2; i++ {
+		if err := dbs[i].AckReplication("replica", 0); err != nil {
+			t.Fatalf("AckReplication: %v", err)
+		}
+	}
+
+	// Overwrite the keys while resharding.
+	stop := make(chan struct{})
+	written := make(chan map[string]string)
+	go func() {
+		res := make(map[string]string)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				written <- res
+				return
+			default:
+			}
+			key, value := fmt.Sprint("key", i%100), fmt.Sprint("new", i)
+			if err := set(key, value); err == nil {
+				res[key] = value
+			}
+		}
+	}()
+
+	var body bytes.Buffer
+	if err := toml.NewEncoder(&body).Encode(newConfig); err != nil {
+		t.Fatalf("Could not encode the config: %v", err)
+	}
+	resp, err := http.Post("http://"+addrs[1]+"/reshard", "application/toml", &body)
+	if err != nil {
+		t.Fatalf("Could not reshard: %v", err)
+	}
+	msg, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Reshard failed: %s", msg)
+	}
+	close(stop)
+	for key, value := range <-written {
+		want[key] = value
+	}
+
+	shards, err := config.ParseConfig(newConfig, "s0")
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	moved := 0
+	for key, value := range want {
+		owner := shards.Id(key)
+		if owner == 2 {
+			moved++
+		}
+		if got, _, err := dbs[owner].GetKey("", key); err != nil || string(got) != value {
+			t.Errorf("GetKey(%q) on shard %d = %q, %v, want %q, nil", key, owner, got, err, value)
+		}
+	}
+	if moved == 0 {
+		t.Errorf("No key moved to the new shard")
+	}
+
+	// The old owners purge the keys that moved away.
+	for i := 0; i < 2; i++ {
+		waitFor(t, fmt.Sprint("shard ", i, " to purge moved keys"), func() bool {
+			kvs, err := dbs[i].Scan("", "", "", 1000)
+			if err != nil {
+				return false
+			}
+			for _, kv := range kvs {
+				if shards.Id(kv.Key) != i {
+					return false
+				}
+			}
+			return true
+		})
+
+		// The deletions are logged for the replicas of the old owners.
+		changes, err := dbs[i].ReadLog(0, 100000)
+		if err != nil {
+			t.Fatalf("ReadLog on shard %d: %v", i, err)
+		}
+		deleted := 0
+		for _, c := range changes {
+			if c.Deleted && shards.Id(string(c.Key)) == 2 {
+				deleted++
+			}
+		}
+		if deleted == 0 {
+			t.Errorf("The log of shard %d has no deletions of moved keys", i)
+		}
+	}
+
+	// All servers route by the new config.
+	for key, value := range want {
+		resp, err := http.Get("http://" + addrs[0] + "/get?" + url.Values{"key": {key}}.Encode())
+		if err != nil {
+			t.Fatalf("Could not get key: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.Contains(string(body), fmt.Sprintf("Value : %q", value)) {
+			t.Errorf("Get %q after resharding: got %s, want %q", key, body, value)
+		}
+	}
+}
+
+func TestReshardCommitRetry(t *testing.T) {
+	// The commit fails on one of two shards at first, after the other
+	// shard already switched to the new config.
+	muxes := make([]*http.ServeMux, 3)
+	addrs := make([]string, 3)
+	for i := range muxes {
+		muxes[i] = http.NewServeMux()
+		ts := httptest.NewServer(muxes[i])
+		t.Cleanup(ts.Close)
+		addrs[i] = strings.TrimPrefix(ts.URL, "http://")
+	}
+	cfg := func(n int) config.Config {
+		c := config.Config{Hashing: config.HashingConsistent}
+		for i := 0; i < n; i++ {
+			c.Shards = append(c.Shards, config.Shard{Name: fmt.Sprint("s", i), ShardID: i, Address: addrs[i]})
+		}
+		return c
+	}
+	oldConfig, newConfig := cfg(2), cfg(3)
+
+	var commits atomic.Int32
+	for i := range muxes {
+		c := oldConfig
+		if i == 2 {
+			c = newConfig
+		}
+		shards, err := config.ParseConfig(c, fmt.Sprint("s", i))
+		if err != nil {
+			t.Fatalf("ParseConfig: %v", err)
+		}
+		s := server.NewServer(createShardDB(t), shards)
+		muxes[i].HandleFunc("/reshard", s.ReshardHandler)
+		muxes[i].HandleFunc("/reshard/start", s.ReshardStartHandler)
+		muxes[i].HandleFunc("/reshard/status", s.ReshardStatusHandler)
+		muxes[i].HandleFunc("/reshard/freeze", s.ReshardFreezeHandler)
+		muxes[i].HandleFunc("/reshard/prepare", s.ReshardPrepareHandler)
+		muxes[i].HandleFunc("/reshard/abort", s.ReshardAbortHandler)
+		muxes[i].HandleFunc("/reshard/apply", s.ReshardApplyHandler)
+		muxes[i].HandleFunc("/routes", s.RoutesHandler)
+		if i != 1 {
+			muxes[i].HandleFunc("/reshard/commit", s.ReshardCommitHandler)
+			continue
+		}
+		muxes[i].HandleFunc("/reshard/commit", func(w http.ResponseWriter, r *http.Request) {
+			if commits.Add(1) <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintf(w, "error: unavailable\n")
+				return
+			}
+			s.ReshardCommitHandler(w, r)
+		})
+	}
+
+	var body bytes.Buffer
+	if err := toml.NewEncoder(&body).Encode(newConfig); err != nil {
+		t.Fatalf("Could not encode the config: %v", err)
+	}
+	resp, err := http.Post("http://"+addrs[0]+"/reshard", "application/toml", &body)
+	if err != nil {
+		t.Fatalf("Could not reshard: %v", err)
+	}
+	msg, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Reshard: got status %d, want %d: %s", resp.StatusCode, http.StatusAccepted, msg)
+	}
+
+	// The coordinator retries the commit in the background.
+	status := func() (int, server.ReshardStatus) {
+		t.Helper()
+		resp, err := http.Get("http://" + addrs[0] + "/reshard/status")
+		if err != nil {
+			t.Fatalf("Could not get the status: %v", err)
+		}
+		defer resp.Body.Close()
+		var st server.ReshardStatus
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+				t.Fatalf("Could not decode the status: %v", err)
+			}
+		}
+		return resp.StatusCode, st
+	}
+	if code, st := status(); code != http.StatusOK || !reflect.DeepEqual(st.Uncommitted, []string{addrs[1]}) {
+		t.Errorf("Status while committing: got %d %+v, want shard 1 uncommitted", code, st)
+	}
+	waitFor(t, "the commit on shard 1", func() bool {
+		code, _ := status()
+		return code == http.StatusNotFound
+	})
+	if n := commits.Load(); n != 3 {
+		t.Errorf("Commits on shard 1: got %d, want 3", n)
+	}
+
+	for i, addr := range addrs {
+		resp, err := http.Get("http://" + addr + "/routes")
+		if err != nil {
+			t.Fatalf("Could not get the routes: %v", err)
+		}
+		var routes server.RoutingTable
+		err = json.NewDecoder(resp.Body).Decode(&routes)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Could not decode the routes: %v", err)
+		}
+		if routes.Count != 3 || routes.Shard != i {
+			t.Errorf("Routes of shard %d: got %+v, want shard %d of 3", i, routes, i)
+		}
+	}
+}
+
+func TestReshardConcurrentFreeze(t *testing.T) {
+	addr := "127.0.0.1:1"
+	_, s := createShardServer(t, 0, map[int]string{0: addr})
+	t.Cleanup(s.Close)
+
+	c, err := json.Marshal(config.Config{Shards: []config.Shard{{Name: "s0", ShardID: 0, Address: addr}}})
+	if err != nil {
+		t.Fatalf("Could not encode the config: %v", err)
+	}
+	w := httptest.NewRecorder()
+	s.ReshardStartHandler(w, peerRequest(http.MethodPost, "/reshard/start", bytes.NewReader(c)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("ReshardStartHandler: got status %d: %s", w.Code, w.Body)
+	}
+
+	// Both freezes return, and the abort lets writes through again.
+	done := make(chan int)
+	for i := 0; i < 2; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			s.ReshardFreezeHandler(w, peerRequest(http.MethodPost, "/reshard/freeze", nil))
+			done <- w.Code
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case code := <-done:
+			if code != http.StatusOK {
+				t.Errorf("ReshardFreezeHandler: got status %d, want %d", code, http.StatusOK)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Concurrent freezes did not return")
+		}
+	}
+	s.ReshardAbortHandler(httptest.NewRecorder(), peerRequest(http.MethodPost, "/reshard/abort", nil))
+
+	written := make(chan string)
+	go func() {
+		w := httptest.NewRecorder()
+		s.SetHandler(w, httptest.NewRequest(http.MethodGet, "/set?key=a&value=b", nil))
+		written <- w.Body.String()
+	}()
+	select {
+	case body := <-written:
+		if !strings.Contains(body, "Error : <nil>") {
+			t.Errorf("Set after the abort: got %q, want no error", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Set after the abort is still blocked")
+	}
+}
+
+func TestReshardCommitAfterAbort(t *testing.T) {
+	addrs := map[int]string{0: "127.0.0.1:1"}
+	c, err := json.Marshal(config.Config{Shards: []config.Shard{
+		{Name: "s0", ShardID: 0, Address: addrs[0]},
+		{Name: "s1", ShardID: 1, Address: "127.0.0.1:2"},
+	}})
+	if err != nil {
+		t.Fatalf("Could not encode the config: %v", err)
+	}
+	call := func(handler http.HandlerFunc, path string, body []byte) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler(w, peerRequest(http.MethodPost, path, bytes.NewReader(body)))
+		return w.Code
+	}
+	count := func(s *server.Server) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.RoutesHandler(w, httptest.NewRequest(http.MethodGet, "/routes", nil))
+		var routes server.RoutingTable
+		if err := json.NewDecoder(w.Body).Decode(&routes); err != nil {
+			t.Fatalf("Could not decode /routes: %v", err)
+		}
+		return routes.Count
+	}
+
+	// The migration of the primary was aborted before the commit reached it.
+	_, primary := createShardServer(t, 0, addrs)
+	t.Cleanup(primary.Close)
+	call(primary.ReshardStartHandler, "/reshard/start", c)
+	call(primary.ReshardFreezeHandler, "/reshard/freeze", nil)
+	call(primary.ReshardAbortHandler, "/reshard/abort", nil)
+	if code := call(primary.ReshardPrepareHandler, "/reshard/prepare", nil); code != http.StatusConflict {
+		t.Errorf("Prepare after an abort: got status %d, want %d", code, http.StatusConflict)
+	}
+	if code := call(primary.ReshardCommitHandler, "/reshard/commit", c); code != http.StatusConflict {
+		t.Errorf("Commit on a primary after an abort: got status %d, want %d", code, http.StatusConflict)
+	}
+	if n := count(primary); n != 1 {
+		t.Errorf("Shards of the primary after a rejected commit: got %d, want 1", n)
+	}
+
+	// Replicas only learn about the resharding with the commit.
+	d, closeFunc, err := db.NewDBWithStorage(db.NewMemoryStorage(), true)
+	if err != nil {
+		t.Fatalf("NewDBWithStorage: %v", err)
+	}
+	t.Cleanup(func() { closeFunc() })
+	replica := server.NewServer(d, &config.Shards{CurID: 0, Addrs: addrs, Count: 1})
+	t.Cleanup(replica.Close)
+	if code := call(replica.ReshardCommitHandler, "/reshard/commit", c); code != http.StatusOK {
+		t.Errorf("Commit on a replica: got status %d, want %d", code, http.StatusOK)
+	}
+	if n := count(replica); n != 2 {
+		t.Errorf("Shards of the replica after the commit: got %d, want 2", n)
+	}
+}
+
+func TestPeersOnly(t *testing.T) {
+	d, s := createShardServer(t, 0, map[int]string{0: "127.0.0.1:1"})
+	t.Cleanup(s.Close)
+
+	changes, err := json.Marshal([]db.Change{{Namespace: db.DefaultNamespace, Key: []byte("a"), Value: []byte("b")}})
+	if err != nil {
+		t.Fatalf("Could not encode the changes: %v", err)
+	}
+	for path, handler := range map[string]http.HandlerFunc{
+		"/reshard/start":   s.ReshardStartHandler,
+		"/reshard/freeze":  s.ReshardFreezeHandler,
+		"/reshard/prepare": s.ReshardPrepareHandler,
+		"/reshard/commit":  s.ReshardCommitHandler,
+		"/reshard/abort":   s.ReshardAbortHandler,
+		"/reshard/apply":   s.ReshardApplyHandler,
+		"/purge/apply":     s.PurgeApplyHandler,
+	} {
+		// The request claims to come from a peer, but not from its host.
+		r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(changes))
+		r.Header.Set("X-Peer", "true")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s from a client: got status %d, want %d", path, w.Code, http.StatusForbidden)
+		}
+	}
+	if val, _, err := d.GetKey(db.DefaultNamespace, "a"); err != nil || val != nil {
+		t.Errorf("GetKey(%q) after /reshard/apply and /purge/apply from a client: got (%q, %v), want (nil, nil)", "a", val, err)
+	}
+}
+
+func TestPurgeRebalance(t *testing.T) {
+	addrs, dbs := startShards(t, 2, func(mux *http.ServeMux, s *server.Server) {
+		mux.HandleFunc("/purge", s.DeleteExtraKeysHandler)
+		mux.HandleFunc("/purge/apply", s.PurgeApplyHandler)
+	})
+	shards := &config.Shards{Addrs: addrs, Count: 2}
+
+	// Shard 0 holds keys of shard 1, as after a config change. One of them
+	// was written to shard 1 since.
+	var moving []string
+	for i := 0; len(moving) < 250; i++ {
+		key := fmt.Sprint("key-", i)
+		if shards.Id(key) == 1 {
+			moving = append(moving, key)
+		}
+		if err := dbs[0].SetKey(db.DefaultNamespace, key, []byte("old")); err != nil {
+			t.Fatalf("SetKey(%q): %v", key, err)
+		}
+	}
+	if err := dbs[0].SetKey("other", moving[0], []byte("other")); err != nil {
+		t.Fatalf("SetKey(%q): %v", moving[0], err)
+	}
+	if err := dbs[1].SetKey(db.DefaultNamespace, moving[1], []byte("new")); err != nil {
+		t.Fatalf("SetKey(%q): %v", moving[1], err)
+	}
+
+	purge := func(query string) string {
+		t.Helper()
+
+		resp, err := http.Post("http://"+addrs[0]+"/purge?"+query, "", nil)
+		if err != nil {
+			t.Fatalf("Could not post to /purge: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected /purge?%s status: got %d, want %d: %s", query, resp.StatusCode, http.StatusOK, body)
+		}
+		return string(body)
+	}
+
+	want := fmt.Sprintf("Shard : 1, Keys : %d\nTotal : %d, Error : <nil>\n", len(moving)+1, len(moving)+1)
+	if got := purge("dry_run=true"); got != want {
+		t.Errorf("Unexpected dry run report: got %q, want %q", got, want)
+	}
+	if val, _, err := dbs[0].GetKey(db.DefaultNamespace, moving[0]); err != nil || string(val) != "old" {
+		t.Errorf("GetKey(%q) on shard 0 after dry run: got (%q, %v), want (%q, nil)", moving[0], val, err, "old")
+	}
+
+	body := purge("mode=rebalance")
+	if want := fmt.Sprintf("Moved : %d, Kept : 0, Error : <nil>\n", len(moving)+1); !strings.HasSuffix(body, want) {
+		t.Errorf("Unexpected /purge report: got %q, want suffix %q", body, want)
+	}
+	if !strings.Contains(body, "Namespace : \"default\", Shard : 1, Moved : ") {
+		t.Errorf("/purge report has no progress: %q", body)
+	}
+
+	for _, key := range moving {
+		want := "old"
+		if key == moving[1] {
+			want = "new"
+		}
+		if val, _, err := dbs[1].GetKey(db.DefaultNamespace, key); err != nil || string(val) != want {
+			t.Errorf("GetKey(%q) on shard 1: got (%q, %v), want (%q, nil)", key, val, err, want)
+		}
+		if val, _, err := dbs[0].GetKey(db.DefaultNamespace, key); err != nil || val != nil {
+			t.Errorf("GetKey(%q) on shard 0: got (%q, %v), want (nil, nil)", key, val, err)
+		}
+	}
+	if val, _, err := dbs[1].GetKey("other", moving[0]); err != nil || string(val) != "other" {
+		t.Errorf("GetKey(%q, %q) on shard 1: got (%q, %v), want (%q, nil)", "other", moving[0], val, err, "other")
+	}
+
+	if got, want := purge("dry_run=true"), "Total : 0, Error : <nil>\n"; got != want {
+		t.Errorf("Unexpected dry run report after purge: got %q, want %q", got, want)
+	}
+}
+
+func TestRangeSplit(t *testing.T) {
+	// The range of shard 0 of two range shards is split to a third shard.
+	muxes := make([]*http.ServeMux, 3)
+	servers := make([]*httptest.Server, 3)
+	addrs := make([]string, 3)
+	for i := range muxes {
+		muxes[i] = http.NewServeMux()
+		servers[i] = httptest.NewServer(muxes[i])
+		t.Cleanup(servers[i].Close)
+		addrs[i] = strings.TrimPrefix(servers[i].URL, "http://")
+	}
+	oldConfig := config.Config{Hashing: config.HashingRange, Shards: []config.Shard{
+		{Name: "s0", ShardID: 0, Address: addrs[0]},
+		{Name: "s1", ShardID: 1, Address: addrs[1], Start: "m"},
+	}}
+	newConfig, err := config.SplitRange(oldConfig, 0, "f", config.Shard{Name: "s2", Address: addrs[2]})
+	if err != nil {
+		t.Fatalf("SplitRange: %v", err)
+	}
+
+	dbs := make([]*db.DB, 3)
+	for i := range muxes {
+		c := oldConfig
+		if i == 2 {
+			c = newConfig
+		}
+		shards, err := config.ParseConfig(c, fmt.Sprint("s", i))
+		if err != nil {
+			t.Fatalf("ParseConfig: %v", err)
+		}
+		dbs[i] = createShardDB(t)
+		s := server.NewServer(dbs[i], shards)
+		muxes[i].HandleFunc("/set", s.SetHandler)
+		muxes[i].HandleFunc("/scan", s.ScanHandler)
+		muxes[i].HandleFunc("/reshard", s.ReshardHandler)
+		muxes[i].HandleFunc("/reshard/start", s.ReshardStartHandler)
+		muxes[i].HandleFunc("/reshard/status", s.ReshardStatusHandler)
+		muxes[i].HandleFunc("/reshard/freeze", s.ReshardFreezeHandler)
+		muxes[i].HandleFunc("/reshard/prepare", s.ReshardPrepareHandler)
+		muxes[i].HandleFunc("/reshard/commit", s.ReshardCommitHandler)
+		muxes[i].HandleFunc("/reshard/abort", s.ReshardAbortHandler)
+		muxes[i].HandleFunc("/reshard/apply", s.ReshardApplyHandler)
+	}
+
+	keys := []string{"apple", "avocado", "fig", "grape", "kiwi", "mango", "pear"}
+	for _, key := range keys {
+		resp, err := http.Get("http://" + addrs[0] + "/set?" + url.Values{"key": {key}, "value": {key}}.Encode())
+		if err != nil {
+			t.Fatalf("Could not set %q: %v", key, err)
+		}
+		resp.Body.Close()
+	}
+
+	var body bytes.Buffer
+	if err := toml.NewEncoder(&body).Encode(newConfig); err != nil {
+		t.Fatalf("Could not encode the config: %v", err)
+	}
+	resp, err := http.Post("http://"+addrs[0]+"/reshard", "application/toml", &body)
+	if err != nil {
+		t.Fatalf("Could not reshard: %v", err)
+	}
+	msg, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Reshard failed: %s", msg)
+	}
+
+	for _, key := range keys {
+		owner := 0
+		switch {
+		case key >= "m":
+			owner = 1
+		case key >= "f":
+			owner = 2
+		}
+		if got, _, err := dbs[owner].GetKey("", key); err != nil || string(got) != key {
+			t.Errorf("GetKey(%q) on shard %d = %q, %v, want %q, nil", key, owner, got, err, key)
+		}
+	}
+
+	// Scans only ask the shards whose ranges overlap the scanned keys, so
+	// they succeed while shard 1 is down.
+	servers[1].Close()
+	scan := func(prefix string) []string {
+		t.Helper()
+
+		resp, err := http.Get("http://" + addrs[0] + "/scan?" + url.Values{"prefix": {prefix}}.Encode())
+		if err != nil {
+			t.Fatalf("Could not scan: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(resp.Body)
+			t.Fatalf("Scan of prefix %q failed: %s", prefix, msg)
+		}
+		var res server.ScanResult
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatalf("Could not decode the scan result: %v", err)
+		}
+		var got []string
+		for _, item := range res.Items {
+			got = append(got, item.Key)
+		}
+		return got
+	}
+	if got, want := scan("a"), []string{"apple", "avocado"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan of prefix %q: got %q, want %q", "a", got, want)
+	}
+	if got, want := scan("g"), []string{"grape"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan of prefix %q: got %q, want %q", "g", got, want)
+	}
+}
+
+func TestReload(t *testing.T) {
+	cfg := func(replicas ...string) config.Config {
+		return config.Config{Shards: []config.Shard{
+			{Name: "s0", ShardID: 0, Address: "localhost:8080"},
+			{Name: "s1", ShardID: 1, Address: "localhost:8082", Replicas: replicas},
+		}}
+	}
+	parse := func(c config.Config, name string) *config.Shards {
+		t.Helper()
+		shards, err := config.ParseConfig(c, name)
+		if err != nil {
+			t.Fatalf("ParseConfig: %v", err)
+		}
+		return shards
+	}
+	s := server.NewServer(createShardDB(t), parse(cfg("localhost:8083"), "s0"))
+
+	routes := func() server.RoutingTable {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.RoutesHandler(w, httptest.NewRequest(http.MethodGet, "/routes", nil))
+		var res server.RoutingTable
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatalf("Could not decode /routes: %v", err)
+		}
+		return res
+	}
+
+	// Shard 1 failed over to its replica.
+	w := httptest.NewRecorder()
+	s.PrimaryHandler(w, peerRequest(http.MethodPost, "/replication/primary?shard=1&addr=localhost:8083", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("PrimaryHandler: got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	// A new replica is added to shard 1; the promoted replica stays its
+	// primary.
+	epoch, err := s.Reload(parse(cfg("localhost:8083", "localhost:8084"), "s0"))
+	if err != nil || epoch != 1 {
+		t.Fatalf("Reload: got (%d, %v), want (1, nil)", epoch, err)
+	}
+	want := server.RoutingTable{
+		Epoch:     1,
+		Shard:     0,
+		Count:     2,
+		Primaries: map[int]string{0: "localhost:8080", 1: "localhost:8083"},
+		Replicas:  map[int][]string{1: {"localhost:8084", "localhost:8082"}},
+	}
+	if got := routes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Routes after reload: got %+v, want %+v", got, want)
+	}
+
+	// A config that moves the server to another shard is rejected.
+	c := cfg()
+	c.Shards[0].Name, c.Shards[1].Name = "s1", "s0"
+	if _, err := s.Reload(parse(c, "s0")); err == nil {
+		t.Errorf("Reload to another shard: got nil error, want non-nil error")
+	}
+	if got := routes(); got.Epoch != 1 || got.Shard != 0 {
+		t.Errorf("Routes after rejected reload: got epoch %d and shard %d, want epoch 1 and shard 0", got.Epoch, got.Shard)
+	}
+
+	// So are configs that assign keys to other shards.
+	more := cfg()
+	more.Shards = append(more.Shards, config.Shard{Name: "s2", ShardID: 2, Address: "localhost:8085"})
+	consistent := cfg()
+	consistent.Hashing = config.HashingConsistent
+	for _, c := range []config.Config{more, consistent} {
+		if _, err := s.Reload(parse(c, "s0")); err == nil || !strings.Contains(err.Error(), "/reshard") {
+			t.Errorf("Reload with other owners of keys: got error %v, want an error pointing to /reshard", err)
+		}
+	}
+	if got := routes(); got.Epoch != 1 || got.Count != 2 {
+		t.Errorf("Routes after rejected reload: got epoch %d and %d shards, want epoch 1 and 2 shards", got.Epoch, got.Count)
+	}
+}
+
+func TestFailoverLivePrimary(t *testing.T) {
+	// The replica loses the connection to its primary, which stays up for
+	// clients, and takes over.
+	names := []string{"primary", "replica"}
+	muxes := make(map[string]*http.ServeMux)
+	addrs := make(map[string]string)
+	var partitioned atomic.Bool
+	for _, name := range names {
+		mux := http.NewServeMux()
+		muxes[name] = mux
+		handler := http.Handler(mux)
+		if name == "primary" {
+			handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if partitioned.Load() && strings.HasPrefix(r.URL.Path, "/replication/") && r.URL.Path != "/replication/primary" {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				mux.ServeHTTP(w, r)
+			})
+		}
+		ts := httptest.NewServer(handler)
+		t.Cleanup(ts.Close)
+		addrs[name] = strings.TrimPrefix(ts.URL, "http://")
+	}
+
+	dbs := make(map[string]*db.DB)
+	servers := make(map[string]*server.Server)
+	for _, name := range names {
+		d, closeFunc, err := db.NewDBWithStorage(db.NewMemoryStorage(), name == "replica")
+		if err != nil {
+			t.Fatalf("NewDBWithStorage: %v", err)
+		}
+		t.Cleanup(func() { closeFunc() })
+
+		s := server.NewServer(d, &config.Shards{
+			Count:    1,
+			Addrs:    map[int]string{0: addrs["primary"]},
+			Replicas: map[int][]string{0: {addrs["replica"]}},
+		})
+		t.Cleanup(s.Close)
+		muxes[name].HandleFunc("/get", s.GetHandler)
+		muxes[name].HandleFunc("/set", s.SetHandler)
+		muxes[name].HandleFunc("/backup", s.BackupHandler)
+		muxes[name].HandleFunc("/replication/stream", s.ReplicationStreamHandler)
+		muxes[name].HandleFunc("/replication/position", s.PositionHandler)
+		muxes[name].HandleFunc("/replication/primary", s.PrimaryHandler)
+		dbs[name], servers[name] = d, s
+	}
+	if err := dbs["primary"].SetReplicas([]string{addrs["replica"]}); err != nil {
+		t.Fatalf("SetReplicas: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		servers["replica"].Follow(ctx, addrs["replica"])
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	set := func(addr, value string) string {
+		t.Helper()
+		resp, err := http.Get("http://" + addr + "/set?" + url.Values{"key": {"a"}, "value": {value}}.Encode())
+		if err != nil {
+			t.Fatalf("Could not set key: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	if body := set(addrs["primary"], "1"); !strings.Contains(body, "Error : <nil>") {
+		t.Fatalf("Set on the primary failed: %s", body)
+	}
+	waitFor(t, "the replica to apply the change", func() bool {
+		val, _, err := dbs["replica"].GetKey(db.DefaultNamespace, "a")
+		return err == nil && string(val) == "1"
+	})
+
+	partitioned.Store(true)
+	waitFor(t, "the replica to be promoted", func() bool { return !dbs["replica"].ReadOnly() })
+	waitFor(t, "the old primary to step down", func() bool { return dbs["primary"].ReadOnly() })
+	partitioned.Store(false)
+
+	// The old primary no longer accepts writes that the new primary would
+	// never see, and follows the new primary.
+	if body := set(addrs["primary"], "lost"); strings.Contains(body, "Error : <nil>") {
+		t.Errorf("Set on the old primary after the failover: got %q, want an error", body)
+	}
+	if body := set(addrs["replica"], "2"); !strings.Contains(body, "Error : <nil>") {
+		t.Fatalf("Set on the new primary failed: %s", body)
+	}
+	waitFor(t, "the old primary to follow the new primary", func() bool {
+		val, _, err := dbs["primary"].GetKey(db.DefaultNamespace, "a")
+		return err == nil && string(val) == "2"
+	})
+}
+
+func TestPrimaryHandlerChecks(t *testing.T) {
+	// The replica of shard 0 is up, but is not a primary.
+	replica, closeFunc, err := db.NewDBWithStorage(db.NewMemoryStorage(), true)
+	if err != nil {
+		t.Fatalf("NewDBWithStorage: %v", err)
+	}
+	t.Cleanup(func() { closeFunc() })
+	mux := http.NewServeMux()
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	replicaAddr := strings.TrimPrefix(ts.URL, "http://")
+	shards := func() *config.Shards {
+		return &config.Shards{
+			Count:    2,
+			Addrs:    map[int]string{0: "127.0.0.1:1", 1: "127.0.0.1:3"},
+			Replicas: map[int][]string{0: {replicaAddr}, 1: {"127.0.0.1:4"}},
+		}
+	}
+	mux.HandleFunc("/replication/position", server.NewServer(replica, shards()).PositionHandler)
+
+	d := createShardDB(t)
+	s := server.NewServer(d, shards())
+	t.Cleanup(s.Close)
+	announce := func(r *http.Request) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.PrimaryHandler(w, r)
+		return w.Code
+	}
+
+	// Only servers of the cluster may announce a primary.
+	if code := announce(httptest.NewRequest(http.MethodPost, "/replication/primary?shard=1&addr=127.0.0.1:4", nil)); code != http.StatusForbidden {
+		t.Errorf("Announcement from a client: got status %d, want %d", code, http.StatusForbidden)
+	}
+	// Only a server of the shard may become its primary.
+	if code := announce(peerRequest(http.MethodPost, "/replication/primary?shard=1&addr=127.0.0.1:5", nil)); code != http.StatusBadRequest {
+		t.Errorf("Announcement of an unknown server: got status %d, want %d", code, http.StatusBadRequest)
+	}
+	// The primary does not step down for a server that is not a primary.
+	if code := announce(peerRequest(http.MethodPost, "/replication/primary?shard=0&addr="+replicaAddr, nil)); code != http.StatusConflict {
+		t.Errorf("Announcement of a replica: got status %d, want %d", code, http.StatusConflict)
+	}
+	if d.ReadOnly() {
+		t.Errorf("The primary stepped down for a replica")
+	}
+
+	w := httptest.NewRecorder()
+	s.RoutesHandler(w, httptest.NewRequest(http.MethodGet, "/routes", nil))
+	var routes server.RoutingTable
+	if err := json.NewDecoder(w.Body).Decode(&routes); err != nil {
+		t.Fatalf("Could not decode /routes: %v", err)
+	}
+	if want := map[int]string{0: "127.0.0.1:1", 1: "127.0.0.1:3"}; !reflect.DeepEqual(routes.Primaries, want) {
+		t.Errorf("Primaries after rejected announcements: got %v, want %v", routes.Primaries, want)
+	}
+}
+
+func TestSetAckDoesNotBlockFreeze(t *testing.T) {
+	addrs, dbs := startShards(t, 1, func(mux *http.ServeMux, s *server.Server) {
+		mux.HandleFunc("/set", s.SetHandler)
+		mux.HandleFunc("/reshard/start", s.ReshardStartHandler)
+		mux.HandleFunc("/reshard/freeze", s.ReshardFreezeHandler)
+		mux.HandleFunc("/reshard/abort", s.ReshardAbortHandler)
+	})
+	// The replica never applies any write.
+	if err := dbs[0].SetReplicas([]string{"gone"}); err != nil {
+		t.Fatalf("SetReplicas: %v", err)
+	}
+
+	post := func(path string, in any) {
+		t.Helper()
+		body, _ := json.Marshal(in)
+		req, err := http.NewRequest(http.MethodPost, "http://"+addrs[0]+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("X-Peer", "true")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Could not post to %s: %v", path, err)
+		}
+		msg, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", path, resp.StatusCode, msg)
+		}
+	}
+	post("/reshard/start", config.Config{Shards: []config.Shard{{Name: "s0", Address: addrs[0]}}})
+	t.Cleanup(func() { post("/reshard/abort", nil) })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := http.Get("http://" + addrs[0] + "/set?" + url.Values{"key": {"a"}, "value": {"1"}, "ack": {"all"}, "ack_timeout": {"2s"}}.Encode())
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	waitFor(t, "the write to be committed", func() bool {
+		val, _, err := dbs[0].GetKey(db.DefaultNamespace, "a")
+		return err == nil && string(val) == "1"
+	})
+
+	// The write waits for the replica, but no longer blocks writes.
+	start := time.Now()
+	post("/reshard/freeze", nil)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Freeze took %v while a write waited for its replicas, want less than a second", d)
+	}
+	<-done
+}
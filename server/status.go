@@ -0,0 +1,113 @@
+package server
+
+import (
+	"distributed-db/replication"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// contact is when the primary last heard from a replica and when the
+// replica last acknowledged all changes of the log.
+type contact struct {
+	last     time.Time
+	caughtUp time.Time
+}
+
+// ReplicaLag is the state of a replica as seen by the primary. Acked is
+// the sequence number of the last change it acknowledged. SecondsBehind is
+// how long ago it last acknowledged all changes, zero if it has, or -1 if
+// it did not since the primary started. LastContact is zero if the replica
+// did not connect since the primary started.
+type ReplicaLag struct {
+	Replica       string
+	Acked         uint64
+	EntriesBehind uint64
+	SecondsBehind float64
+	LastContact   time.Time
+}
+
+// ReplicationStatus is returned by /replication/status. Position is the
+// sequence number of the last change in the log of a primary or of the
+// last change applied by a replica. A primary lists its replicas; a
+// replica reports the state of its replication.
+type ReplicationStatus struct {
+	Shard       int
+	Primary     bool
+	Position    uint64
+	Replicas    []ReplicaLag        `json:",omitempty"`
+	Replication *replication.Report `json:",omitempty"`
+}
+
+// ackReplication records that the replica applied the changes up to seq.
+func (s *Server) ackReplication(replica string, seq uint64) error {
+	if err := s.db.AckReplication(replica, seq); err != nil {
+		return err
+	}
+	last, err := s.db.LogSequence()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	s.contactsMu.Lock()
+	defer s.contactsMu.Unlock()
+	c := s.contacts[replica]
+	c.last = now
+	if seq >= last {
+		c.caughtUp = now
+	}
+	s.contacts[replica] = c
+	return nil
+}
+
+// ReplicationStatusHandler returns the ReplicationStatus of the server as
+// JSON.
+func (s *Server) ReplicationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	st := ReplicationStatus{Shard: s.shards().CurID, Primary: s.primary()}
+	if err := s.replicationStatus(&st); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+	json.NewEncoder(w).Encode(&st)
+}
+
+// replicationStatus fills in the position and the replication state of
+// the server, depending on its role.
+func (s *Server) replicationStatus(st *ReplicationStatus) error {
+	var err error
+	if !st.Primary {
+		st.Position, err = s.db.AppliedSequence()
+		report := s.status.Report()
+		st.Replication = &report
+		return err
+	}
+
+	if st.Position, err = s.db.LogSequence(); err != nil {
+		return err
+	}
+	replicas, err := s.db.Replicas()
+	if err != nil {
+		return err
+	}
+
+	s.contactsMu.Lock()
+	defer s.contactsMu.Unlock()
+	for id, acked := range replicas {
+		c := s.contacts[id]
+		lag := ReplicaLag{Replica: id, Acked: acked, LastContact: c.last}
+		if acked < st.Position {
+			lag.EntriesBehind = st.Position - acked
+			lag.SecondsBehind = -1
+			if !c.caughtUp.IsZero() {
+				lag.SecondsBehind = time.Since(c.caughtUp).Seconds()
+			}
+		}
+		st.Replicas = append(st.Replicas, lag)
+	}
+	sort.Slice(st.Replicas, func(i, j int) bool { return st.Replicas[i].Replica < st.Replicas[j].Replica })
+	return nil
+}